@@ -2,56 +2,183 @@ package main
 
 import (
 	"archive/zip"
+	"bytes"
+	"crypto/sha256"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
+// ArchiveMetadataDirectory is directory inside of the archive for the application's own files.
+const ArchiveMetadataDirectory = ".sl-chat-log-sync"
+
 // ChatLogsArchive is .zip archive containing chat logs.
-// Structure: <account_name>/<chat_logs.txt>
+// Structure: <account_name>/<chat_logs.txt>, and application's files inside of ArchiveMetadataDirectory.
 type ChatLogsArchive struct {
 	fileName string
 	r        *zip.ReadCloser
 	wf       *os.File
 	w        *zip.Writer
+
+	// readCipher decrypts entries of the encrypted archive, it's nil for plain archive.
+	readCipher *ArchiveCipher
+	// writeCipher encrypts entries of new archive, it's nil for plain archive.
+	writeCipher *ArchiveCipher
+	// accountReadCiphers decrypt entries of accounts encrypted with their own keys.
+	accountReadCiphers map[string]*ArchiveCipher
+	// accountWriteCiphers encrypt entries of accounts with their own keys in new archive.
+	accountWriteCiphers map[string]*ArchiveCipher
+	// lockedAccounts are accounts encrypted with their own keys, which are not available.
+	// Their entries are copied into new archive as is.
+	lockedAccounts map[string]*EncryptionHeader
+
+	options ArchiveOptions
+	// identity is identity of the archive file at the time it was opened.
+	identity ArchiveIdentity
+	// attempt is count of merges with the archive changed by other devices.
+	attempt int
+	// writtenDigests are hashes of plain content of entries written into new archive.
+	writtenDigests map[string][sha256.Size]byte
+	// headerWritten is true if encryption header is written into new archive.
+	headerWritten bool
+	// writtenManifests are manifests of accounts written into new archive.
+	writtenManifests map[string]*AccountManifest
+	// formatVersion is format version of the archive, writeFormatVersion is format version of new archive.
+	formatVersion      int
+	writeFormatVersion int
+}
+
+// ArchiveOptions are options for opening chat logs archive.
+type ArchiveOptions struct {
+	// Passphrase is called if archive is encrypted.
+	Passphrase PassphraseFunc
+	// AccountPassphrase is called for each account encrypted with its own key.
+	AccountPassphrase AccountPassphraseFunc
+	// KeepGenerations is how many previous versions of the archive are kept in its history, 0 disables history.
+	KeepGenerations int
+	// SkipUnchanged leaves archive file untouched if content of new archive is the same, except for the archive manifest.
+	SkipUnchanged bool
 }
 
 // ReadChatLogsArchive opens chat logs archive.
-func ReadChatLogsArchive(fileName string) (*ChatLogsArchive, error) {
+// Encrypted archive is decrypted transparently, and new archive is encrypted with the same passphrase.
+func ReadChatLogsArchive(fileName string, options ArchiveOptions) (*ChatLogsArchive, error) {
+	// Archive may be replaced by cloud sync client while we're working with it, so remember what we've read.
+	identity, err := ReadArchiveIdentity(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	a, err := OpenChatLogsArchive(fileName, options)
+	if err != nil {
+		return nil, err
+	}
+
+	a.identity = identity
+
+	wf, err := os.CreateTemp(os.TempDir(), filepath.Base(fileName)+".*")
+	if err != nil {
+		_ = a.Close()
+		return nil, err
+	}
+
+	a.wf = wf
+	a.w = zip.NewWriter(wf)
+	a.writtenDigests = make(map[string][sha256.Size]byte)
+	a.writtenManifests = make(map[string]*AccountManifest)
+
+	return a, nil
+}
+
+// OpenChatLogsArchive opens chat logs archive for reading only.
+// Chat logs can't be written into archive opened this way, and Close leaves archive file untouched.
+func OpenChatLogsArchive(fileName string, options ArchiveOptions) (*ChatLogsArchive, error) {
 	r, err := zip.OpenReader(fileName)
 	if err != nil && !errors.Is(err, os.ErrNotExist) {
 		return nil, err
 	}
 
-	wf, err := os.Create(filepath.Join(os.TempDir(), fileName))
+	a := &ChatLogsArchive{
+		fileName:            fileName,
+		r:                   r,
+		accountReadCiphers:  make(map[string]*ArchiveCipher),
+		accountWriteCiphers: make(map[string]*ArchiveCipher),
+		lockedAccounts:      make(map[string]*EncryptionHeader),
+		options:             options,
+		writeFormatVersion:  ArchiveFormatVersion,
+	}
+
+	// Archive written by newer version of the application must not be touched.
+	err = a.readFormatVersion()
 	if err != nil {
-		if r != nil {
-			r.Close()
-		}
+		_ = a.Close()
 		return nil, err
 	}
 
-	fmt.Println(wf.Name())
+	err = a.openEncryption(options)
+	if err != nil {
+		_ = a.Close()
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// Abort closes internal .zip reader and writer, and removes new archive leaving old .zip file untouched.
+func (a *ChatLogsArchive) Abort() {
+	if a.r != nil {
+		_ = a.r.Close()
+	}
 
-	return &ChatLogsArchive{
-		fileName: fileName,
-		r:        r,
-		wf:       wf,
-		w:        zip.NewWriter(wf),
-	}, nil
+	if a.w != nil {
+		_ = a.w.Close()
+		_ = a.wf.Close()
+		_ = os.Remove(a.wf.Name())
+	}
 }
 
 // Close closes internal .zip reader, writer and replaces old .zip file with the new one.
 func (a *ChatLogsArchive) Close() error {
+	// Read-only archive, nothing to write.
+	if a.w == nil {
+		if a.r != nil {
+			_ = a.r.Close()
+		}
+		return nil
+	}
+
+	writtenFileName := a.wf.Name()
+
+	// Locked accounts are copied from the old archive, so it's closed after that.
+	var err error
+	if !a.headerWritten {
+		a.headerWritten = true
+		err = a.writeEncryptionHeader()
+	}
+	if err == nil {
+		err = a.copyLockedAccounts()
+	}
+	if err == nil {
+		err = a.writeManifests()
+	}
+
+	changed := err == nil && (a.options.KeepGenerations > 0 || a.options.SkipUnchanged) && a.isChanged()
+
 	if a.r != nil {
 		_ = a.r.Close()
 	}
 
-	writtenFileName := a.wf.Name()
+	if err != nil {
+		a.wf.Close()
+		_ = os.Remove(writtenFileName)
+		return err
+	}
 
-	err := a.w.Close()
+	err = a.w.Close()
 	if err != nil {
 		a.wf.Close()
 		_ = os.Remove(writtenFileName)
@@ -64,12 +191,17 @@ func (a *ChatLogsArchive) Close() error {
 		return fmt.Errorf("error closing file %s: %w", writtenFileName, err)
 	}
 
-	err = MoveFile(writtenFileName, a.fileName)
-	if err != nil {
-		return fmt.Errorf("error overwriting file %s with %s: %w", a.fileName, writtenFileName, err)
+	if a.options.SkipUnchanged && !changed {
+		_ = os.Remove(writtenFileName)
+		return nil
 	}
 
-	return nil
+	return a.replace(writtenFileName, changed)
+}
+
+// String returns file name of the archive.
+func (a *ChatLogsArchive) String() string {
+	return a.fileName
 }
 
 // GetAccountNames extracts account names from the archive.
@@ -88,7 +220,7 @@ func (a *ChatLogsArchive) GetAccountNames() ([]string, error) {
 		path := filepath.Dir(f.Name)
 
 		// Take files from 1st level directories only.
-		if path != "" && !strings.ContainsAny(path, "/\\") {
+		if path != "" && path != ArchiveMetadataDirectory && !strings.ContainsAny(path, "/\\") && a.lockedAccounts[path] == nil {
 			accountNamesMap[path] = nil
 		}
 	}
@@ -103,11 +235,10 @@ func (a *ChatLogsArchive) GetAccountNames() ([]string, error) {
 
 // ListChatLogFileNames returns list of chat log files for the specified account name inside of archive.
 func (a *ChatLogsArchive) ListChatLogFileNames(accountName string) (absolutePaths []string, relativePaths []string, err error) {
-	if a.r == nil {
+	if a.r == nil || a.lockedAccounts[accountName] != nil {
 		return nil, nil, nil
 	}
 
-	var logFileNames []string
 	for _, f := range a.r.File {
 		// Take only .txt files.
 		if filepath.Ext(f.Name) != ".txt" {
@@ -122,7 +253,7 @@ func (a *ChatLogsArchive) ListChatLogFileNames(accountName string) (absolutePath
 		fileName := filepath.Base(f.Name)
 		if !IsReservedFileName(fileName) {
 			absolutePaths = append(absolutePaths, f.Name)
-			relativePaths = append(logFileNames, fileName)
+			relativePaths = append(relativePaths, fileName)
 		}
 	}
 
@@ -132,24 +263,29 @@ func (a *ChatLogsArchive) ListChatLogFileNames(accountName string) (absolutePath
 // ReadChatLog read chat log file for specified account.
 // fileName must be relatiive to the chat logs directory.
 func (a *ChatLogsArchive) ReadChatLog(accountName string, fileName string) (Messages, error) {
-	if a.r == nil {
-		return nil, nil
-	}
-
 	logFilePath := strings.Join([]string{accountName, fileName}, "/")
-	f, err := a.r.Open(logFilePath)
 
-	// Do not return error if file doesn't exists.
-	if errors.Is(err, os.ErrNotExist) {
+	// Chat logs of locked account are not available, as if there were no such files.
+	if a.lockedAccounts[accountName] != nil {
 		return nil, nil
 	}
 
+	c, err := a.readCipherFor(accountName)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := a.readEntry(logFilePath, c)
 	if err != nil {
 		return nil, fmt.Errorf("unable to open chat log %s: %w", logFilePath, err)
 	}
-	defer f.Close()
 
-	messages, err := ReadMessages(f)
+	// Do not return error if file doesn't exists.
+	if data == nil {
+		return nil, nil
+	}
+
+	messages, err := ReadMessages(bytes.NewReader(data))
 	if err != nil {
 		return messages, fmt.Errorf("unable to read chat log %s: %w", logFilePath, err)
 	}
@@ -161,15 +297,255 @@ func (a *ChatLogsArchive) ReadChatLog(accountName string, fileName string) (Mess
 func (a *ChatLogsArchive) WriteChatLog(accountName string, fileName string, messages Messages) error {
 	logFilePath := strings.Join([]string{accountName, fileName}, "/")
 
-	f, err := a.w.Create(logFilePath)
+	c, err := a.writeCipherFor(accountName)
 	if err != nil {
-		return fmt.Errorf("error creating file %s: %w", logFilePath, err)
+		return err
 	}
 
-	err = messages.Write(f)
+	var buf bytes.Buffer
+	err = messages.Write(&buf)
 	if err != nil {
 		return fmt.Errorf("error writing file %s: %w", logFilePath, err)
 	}
 
+	err = a.writeEntry(logFilePath, buf.Bytes(), c)
+	if err != nil {
+		return err
+	}
+
+	a.addManifestEntry(accountName, fileName, buf.Bytes(), messages)
+
 	return nil
 }
+
+// readEntry reads and decrypts archive entry.
+// Returns nil if there's no such entry.
+func (a *ChatLogsArchive) readEntry(name string, c *ArchiveCipher) ([]byte, error) {
+	if a.r == nil {
+		return nil, nil
+	}
+
+	f, err := a.r.Open(name)
+
+	// Do not return error if file doesn't exists.
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("unable to open %s: %w", name, err)
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %s: %w", name, err)
+	}
+
+	if c != nil {
+		return c.Decrypt(name, data)
+	}
+
+	return data, nil
+}
+
+// writeEntry encrypts and writes entry into new archive.
+func (a *ChatLogsArchive) writeEntry(name string, data []byte, c *ArchiveCipher) error {
+	if a.w == nil {
+		return fmt.Errorf("archive %s is opened read-only", a.fileName)
+	}
+
+	// Encryption header is written first, so encrypted entries of truncated archive can be salvaged.
+	if !a.headerWritten {
+		a.headerWritten = true
+
+		err := a.writeEncryptionHeader()
+		if err != nil {
+			return err
+		}
+	}
+
+	header := &zip.FileHeader{Name: name, Method: zip.Deflate}
+	header.Modified = time.Now()
+
+	// Archive manifest is changed on each sync, so it's not compared.
+	if name != strings.Join([]string{ArchiveMetadataDirectory, manifestMetadataName}, "/") {
+		a.writtenDigests[name] = sha256.Sum256(data)
+	}
+
+	if c != nil {
+		var err error
+		data, err = c.Encrypt(name, data)
+		if err != nil {
+			return fmt.Errorf("error encrypting file %s: %w", name, err)
+		}
+
+		// Encrypted data is already compressed.
+		header.Method = zip.Store
+	}
+
+	f, err := a.w.CreateHeader(header)
+	if err != nil {
+		return fmt.Errorf("error creating file %s: %w", name, err)
+	}
+
+	_, err = f.Write(data)
+	if err != nil {
+		return fmt.Errorf("error writing file %s: %w", name, err)
+	}
+
+	return nil
+}
+
+// CopyAll copies all chat logs and application's files into new archive.
+func (a *ChatLogsArchive) CopyAll() error {
+	accountNames, err := a.GetAccountNames()
+	if err != nil {
+		return err
+	}
+
+	for _, accountName := range accountNames {
+		_, fileNames, err := a.ListChatLogFileNames(accountName)
+		if err != nil {
+			return err
+		}
+
+		for _, fileName := range fileNames {
+			messages, err := a.ReadChatLog(accountName, fileName)
+			if err != nil {
+				return err
+			}
+
+			err = a.WriteChatLog(accountName, fileName, messages)
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, name := range a.listAccountMetadata(accountName) {
+			data, err := a.ReadAccountMetadata(accountName, name)
+			if err != nil {
+				return err
+			}
+
+			err = a.WriteAccountMetadata(accountName, name, data)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, name := range a.listMetadata() {
+		data, err := a.ReadMetadata(name)
+		if err != nil {
+			return err
+		}
+
+		err = a.WriteMetadata(name, data)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ChatLogSize returns compressed and uncompressed size of chat log file inside of the archive.
+// Returns false if there's no such file in the archive.
+func (a *ChatLogsArchive) ChatLogSize(accountName string, fileName string) (compressed uint64, uncompressed uint64, ok bool) {
+	if a.r == nil {
+		return 0, 0, false
+	}
+
+	logFilePath := strings.Join([]string{accountName, fileName}, "/")
+	for _, f := range a.r.File {
+		if f.Name == logFilePath {
+			return f.CompressedSize64, f.UncompressedSize64, true
+		}
+	}
+
+	return 0, 0, false
+}
+
+// ReadMetadata reads application's file from the archive metadata directory.
+// Returns nil if there's no such file.
+func (a *ChatLogsArchive) ReadMetadata(name string) ([]byte, error) {
+	return a.readEntry(strings.Join([]string{ArchiveMetadataDirectory, name}, "/"), a.readCipher)
+}
+
+// WriteMetadata writes application's file into the metadata directory of new archive.
+func (a *ChatLogsArchive) WriteMetadata(name string, data []byte) error {
+	return a.writeEntry(strings.Join([]string{ArchiveMetadataDirectory, name}, "/"), data, a.writeCipher)
+}
+
+// ReadAccountMetadata reads application's file of the account from the archive metadata directory.
+// Returns nil if there's no such file.
+func (a *ChatLogsArchive) ReadAccountMetadata(accountName string, name string) ([]byte, error) {
+	c, err := a.readCipherFor(accountName)
+	if err != nil {
+		return nil, err
+	}
+
+	return a.readEntry(strings.Join([]string{ArchiveMetadataDirectory, "accounts", accountName, name}, "/"), c)
+}
+
+// WriteAccountMetadata writes application's file of the account into the metadata directory of new archive.
+func (a *ChatLogsArchive) WriteAccountMetadata(accountName string, name string, data []byte) error {
+	c, err := a.writeCipherFor(accountName)
+	if err != nil {
+		return err
+	}
+
+	return a.writeEntry(strings.Join([]string{ArchiveMetadataDirectory, "accounts", accountName, name}, "/"), data, c)
+}
+
+// listMetadata returns names of application's files inside of the archive metadata directory.
+// Encryption header, manifest and accounts' files are not listed.
+func (a *ChatLogsArchive) listMetadata() (names []string) {
+	if a.r == nil {
+		return nil
+	}
+
+	for _, f := range a.r.File {
+		name, ok := strings.CutPrefix(f.Name, ArchiveMetadataDirectory+"/")
+		if ok && name != "" && name != encryptionMetadataName && name != manifestMetadataName && !strings.HasPrefix(name, "accounts/") && !strings.HasSuffix(name, "/") {
+			names = append(names, name)
+		}
+	}
+
+	return
+}
+
+// listAccountMetadata returns names of application's files of the account inside of the archive metadata directory.
+// Account manifest is not listed.
+func (a *ChatLogsArchive) listAccountMetadata(accountName string) (names []string) {
+	if a.r == nil {
+		return nil
+	}
+
+	prefix := strings.Join([]string{ArchiveMetadataDirectory, "accounts", accountName, ""}, "/")
+	for _, f := range a.r.File {
+		name, ok := strings.CutPrefix(f.Name, prefix)
+		if ok && name != "" && name != manifestMetadataName && !strings.HasSuffix(name, "/") {
+			names = append(names, name)
+		}
+	}
+
+	return
+}
+
+// entryAccountName returns name of the account which the archive entry belongs to.
+// Returns empty string for application's files not related to any account.
+func entryAccountName(name string) string {
+	if rest, ok := strings.CutPrefix(name, ArchiveMetadataDirectory+"/accounts/"); ok {
+		accountName, _, _ := strings.Cut(rest, "/")
+		return accountName
+	}
+
+	accountName, _, ok := strings.Cut(name, "/")
+	if !ok || accountName == ArchiveMetadataDirectory {
+		return ""
+	}
+
+	return accountName
+}
@@ -0,0 +1,655 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/term"
+)
+
+// encryptionMetadataName is name of the archive encryption header inside of archive metadata directory.
+// The header itself is not encrypted.
+const encryptionMetadataName = "encryption.json"
+
+// PassphraseEnvironmentVariable is environment variable containing archive passphrase.
+const PassphraseEnvironmentVariable = "SL_CHAT_LOGS_PASSPHRASE"
+
+// encryptionCheckText is encrypted into archive header, so wrong passphrase is detected before reading chat logs.
+const encryptionCheckText = "sl-chat-log-sync"
+
+// ErrWrongPassphrase is returned if archive can't be decrypted with the passphrase.
+var ErrWrongPassphrase = errors.New("wrong passphrase")
+
+// EncryptionHeader describes how archive entries are encrypted.
+// Entries are compressed with deflate and encrypted with AES-256-GCM, using entry name as additional data,
+// so entries can't be swapped. Entry names themselves are not encrypted.
+// Top level key encrypts whole archive, and accounts may be encrypted with their own keys instead.
+type EncryptionHeader struct {
+	Cipher   string                       `json:"cipher,omitempty"`
+	KDF      string                       `json:"kdf,omitempty"`
+	Salt     []byte                       `json:"salt,omitempty"`
+	Time     uint32                       `json:"time,omitempty"`
+	Memory   uint32                       `json:"memory,omitempty"`
+	Lanes    uint8                        `json:"lanes,omitempty"`
+	Check    []byte                       `json:"check,omitempty"`
+	Accounts map[string]*EncryptionHeader `json:"accounts,omitempty"`
+}
+
+// ArchiveCipher encrypts and decrypts archive entries.
+type ArchiveCipher struct {
+	header EncryptionHeader
+	aead   cipher.AEAD
+}
+
+// NewArchiveCipher creates cipher with new random salt for the passphrase.
+func NewArchiveCipher(passphrase []byte) (*ArchiveCipher, error) {
+	header := EncryptionHeader{
+		Cipher: "aes-256-gcm",
+		KDF:    "argon2id",
+		Salt:   make([]byte, 16),
+		Time:   3,
+		Memory: 64 * 1024,
+		Lanes:  4,
+	}
+
+	_, err := rand.Read(header.Salt)
+	if err != nil {
+		return nil, fmt.Errorf("unable to generate salt: %w", err)
+	}
+
+	c, err := newArchiveCipher(header, passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	c.header.Check, err = c.Encrypt("check", []byte(encryptionCheckText))
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// OpenArchiveCipher derives cipher from the archive encryption header and checks passphrase.
+func OpenArchiveCipher(header EncryptionHeader, passphrase []byte) (*ArchiveCipher, error) {
+	if header.Cipher != "aes-256-gcm" || header.KDF != "argon2id" {
+		return nil, fmt.Errorf("unsupported encryption %s/%s", header.Cipher, header.KDF)
+	}
+
+	c, err := newArchiveCipher(header, passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	check, err := c.Decrypt("check", header.Check)
+	if err != nil || string(check) != encryptionCheckText {
+		return nil, ErrWrongPassphrase
+	}
+
+	return c, nil
+}
+
+func newArchiveCipher(header EncryptionHeader, passphrase []byte) (*ArchiveCipher, error) {
+	key := argon2.IDKey(passphrase, header.Salt, header.Time, header.Memory, header.Lanes, 32)
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ArchiveCipher{header: header, aead: aead}, nil
+}
+
+// Encrypt compresses and encrypts archive entry data.
+func (c *ArchiveCipher) Encrypt(name string, data []byte) ([]byte, error) {
+	var compressed bytes.Buffer
+
+	fw, err := flate.NewWriter(&compressed, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = fw.Write(data)
+	if err != nil {
+		return nil, err
+	}
+
+	err = fw.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+compressed.Len()+c.aead.Overhead())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, fmt.Errorf("unable to generate nonce: %w", err)
+	}
+
+	return c.aead.Seal(nonce, nonce, compressed.Bytes(), []byte(name)), nil
+}
+
+// Decrypt decrypts and decompresses archive entry data.
+func (c *ArchiveCipher) Decrypt(name string, data []byte) ([]byte, error) {
+	if len(data) < c.aead.NonceSize() {
+		return nil, fmt.Errorf("unable to decrypt %s: data is too short", name)
+	}
+
+	compressed, err := c.aead.Open(nil, data[:c.aead.NonceSize()], data[c.aead.NonceSize():], []byte(name))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt %s: %w", name, err)
+	}
+
+	fr := flate.NewReader(bytes.NewReader(compressed))
+	defer fr.Close()
+
+	plain, err := io.ReadAll(fr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decompress %s: %w", name, err)
+	}
+
+	return plain, nil
+}
+
+// readEncryptionHeader reads encryption header from the archive.
+// Returns nil if archive is not encrypted.
+func (a *ChatLogsArchive) readEncryptionHeader() (*EncryptionHeader, error) {
+	data, err := a.readEntry(strings.Join([]string{ArchiveMetadataDirectory, encryptionMetadataName}, "/"), nil)
+	if err != nil || data == nil {
+		return nil, err
+	}
+
+	var header EncryptionHeader
+	err = json.Unmarshal(data, &header)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse encryption header of %s: %w", a.fileName, err)
+	}
+
+	return &header, nil
+}
+
+// writeEncryptionHeader writes encryption header of the write ciphers into new archive.
+func (a *ChatLogsArchive) writeEncryptionHeader() error {
+	var header EncryptionHeader
+	if a.writeCipher != nil {
+		header = a.writeCipher.header
+	}
+
+	header.Accounts = make(map[string]*EncryptionHeader)
+	for accountName, c := range a.accountWriteCiphers {
+		accountHeader := c.header
+		header.Accounts[accountName] = &accountHeader
+	}
+	for accountName, accountHeader := range a.lockedAccounts {
+		header.Accounts[accountName] = accountHeader
+	}
+
+	if header.Cipher == "" && len(header.Accounts) == 0 {
+		return nil
+	}
+
+	data, err := json.Marshal(header)
+	if err != nil {
+		return fmt.Errorf("unable to encode encryption header: %w", err)
+	}
+
+	return a.writeEntry(strings.Join([]string{ArchiveMetadataDirectory, encryptionMetadataName}, "/"), data, nil)
+}
+
+// openEncryption checks if archive is encrypted, and asks for passphrases to decrypt it.
+// Accounts with their own keys are locked if their passphrases are not available.
+// New archive is written with the same encryption.
+func (a *ChatLogsArchive) openEncryption(options ArchiveOptions) error {
+	header, err := a.readEncryptionHeader()
+	if err != nil || header == nil {
+		return err
+	}
+
+	if header.Cipher != "" {
+		if options.Passphrase == nil {
+			return fmt.Errorf("archive %s is encrypted, but no passphrase is provided", a.fileName)
+		}
+
+		p, err := options.Passphrase(false)
+		if err != nil {
+			return err
+		}
+
+		a.readCipher, err = OpenArchiveCipher(*header, p)
+		if err != nil {
+			return fmt.Errorf("unable to decrypt archive %s: %w", a.fileName, err)
+		}
+
+		a.writeCipher = a.readCipher
+	}
+
+	for accountName, accountHeader := range header.Accounts {
+		var p []byte
+		if options.AccountPassphrase != nil {
+			p, err = options.AccountPassphrase(accountName)
+			if err != nil {
+				return err
+			}
+		}
+
+		if p == nil {
+			a.lockedAccounts[accountName] = accountHeader
+			continue
+		}
+
+		c, err := OpenArchiveCipher(*accountHeader, p)
+		if err != nil {
+			return fmt.Errorf("unable to decrypt account %s in archive %s: %w", accountName, a.fileName, err)
+		}
+
+		a.accountReadCiphers[accountName] = c
+		a.accountWriteCiphers[accountName] = c
+	}
+
+	return nil
+}
+
+// readCipherFor returns cipher for reading entries of the account.
+func (a *ChatLogsArchive) readCipherFor(accountName string) (*ArchiveCipher, error) {
+	if a.lockedAccounts[accountName] != nil {
+		return nil, fmt.Errorf("account %s in archive %s is encrypted with its own key, which is not available", accountName, a.fileName)
+	}
+
+	if c, ok := a.accountReadCiphers[accountName]; ok {
+		return c, nil
+	}
+
+	return a.readCipher, nil
+}
+
+// writeCipherFor returns cipher for writing entries of the account.
+func (a *ChatLogsArchive) writeCipherFor(accountName string) (*ArchiveCipher, error) {
+	if a.lockedAccounts[accountName] != nil {
+		return nil, fmt.Errorf("account %s in archive %s is encrypted with its own key, which is not available", accountName, a.fileName)
+	}
+
+	if c, ok := a.accountWriteCiphers[accountName]; ok {
+		return c, nil
+	}
+
+	return a.writeCipher, nil
+}
+
+// LockedAccounts returns accounts encrypted with their own keys, which are not available.
+// Such accounts can't be read or written, they're copied into new archive as is.
+func (a *ChatLogsArchive) LockedAccounts() []string {
+	var accountNames []string
+	for accountName := range a.lockedAccounts {
+		accountNames = append(accountNames, accountName)
+	}
+
+	sort.Strings(accountNames)
+
+	return accountNames
+}
+
+// copyLockedAccounts copies entries of locked accounts into new archive without decrypting them.
+func (a *ChatLogsArchive) copyLockedAccounts() error {
+	if a.r == nil || len(a.lockedAccounts) == 0 {
+		return nil
+	}
+
+	for _, f := range a.r.File {
+		if a.lockedAccounts[entryAccountName(f.Name)] == nil {
+			continue
+		}
+
+		err := a.w.Copy(f)
+		if err != nil {
+			return fmt.Errorf("error copying file %s: %w", f.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// AccountPassphraseFunc returns passphrase for the account encrypted with its own key.
+// Returns nil if passphrase is not available, so the account is skipped.
+type AccountPassphraseFunc func(accountName string) ([]byte, error)
+
+// AccountKeyFiles are files containing passphrases of accounts, set by "account=file" command line flags.
+type AccountKeyFiles map[string]string
+
+// String implements flag.Value.
+func (k AccountKeyFiles) String() string {
+	var pairs []string
+	for accountName, fileName := range k {
+		pairs = append(pairs, accountName+"="+fileName)
+	}
+
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, ",")
+}
+
+// Set implements flag.Value.
+func (k AccountKeyFiles) Set(value string) error {
+	accountName, fileName, ok := strings.Cut(value, "=")
+	if !ok || accountName == "" || fileName == "" {
+		return fmt.Errorf("must be account=file")
+	}
+
+	k[accountName] = fileName
+
+	return nil
+}
+
+// AccountPassphraseEnvironmentVariable returns environment variable containing passphrase of the account.
+// E.g. it's SL_CHAT_LOGS_PASSPHRASE_JOHN_DOE for john.doe.
+func AccountPassphraseEnvironmentVariable(accountName string) string {
+	suffix := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, strings.ToUpper(accountName))
+
+	return PassphraseEnvironmentVariable + "_" + suffix
+}
+
+// NewAccountPassphraseFunc returns passphrase of the account from the key file, from environment variable,
+// or asks user for it in terminal. Account is skipped if user enters empty passphrase or there's no terminal.
+// Passphrases are asked once and remembered.
+func NewAccountPassphraseFunc(keyFiles AccountKeyFiles) AccountPassphraseFunc {
+	passphrases := make(map[string][]byte)
+
+	return func(accountName string) ([]byte, error) {
+		if p, ok := passphrases[accountName]; ok {
+			return p, nil
+		}
+
+		keyFileName := keyFiles[accountName]
+		if keyFileName == "" && os.Getenv(AccountPassphraseEnvironmentVariable(accountName)) == "" && !term.IsTerminal(int(os.Stdin.Fd())) {
+			passphrases[accountName] = nil
+			return nil, nil
+		}
+
+		p, err := readAccountPassphrase(accountName, keyFileName, false)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(p) == 0 {
+			p = nil
+		}
+		passphrases[accountName] = p
+
+		return p, nil
+	}
+}
+
+// readAccountPassphrase reads passphrase of the account from the key file, from environment variable,
+// or asks user for it in terminal.
+func readAccountPassphrase(accountName string, keyFileName string, confirm bool) ([]byte, error) {
+	if keyFileName != "" {
+		data, err := os.ReadFile(keyFileName)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read key file %s: %w", keyFileName, err)
+		}
+
+		return bytes.TrimRight(data, "\r\n"), nil
+	}
+
+	env := AccountPassphraseEnvironmentVariable(accountName)
+	if p := os.Getenv(env); p != "" {
+		return []byte(p), nil
+	}
+
+	stdin := int(os.Stdin.Fd())
+	if !term.IsTerminal(stdin) {
+		return nil, fmt.Errorf("passphrase of %s is required, use -account-keyfile or %s environment variable", accountName, env)
+	}
+
+	prompt := fmt.Sprintf("Passphrase of %s (leave empty to skip the account): ", accountName)
+	if confirm {
+		prompt = fmt.Sprintf("New passphrase of %s: ", accountName)
+	}
+
+	return askPassphrase(prompt, confirm)
+}
+
+// askPassphrase asks user for the passphrase in terminal, optionally twice.
+func askPassphrase(prompt string, confirm bool) ([]byte, error) {
+	stdin := int(os.Stdin.Fd())
+
+	fmt.Fprintf(os.Stderr, "%s", prompt)
+	p, err := term.ReadPassword(stdin)
+	fmt.Fprintf(os.Stderr, "\n")
+	if err != nil {
+		return nil, fmt.Errorf("unable to read passphrase: %w", err)
+	}
+
+	if confirm {
+		fmt.Fprintf(os.Stderr, "Repeat passphrase: ")
+		repeated, err := term.ReadPassword(stdin)
+		fmt.Fprintf(os.Stderr, "\n")
+		if err != nil {
+			return nil, fmt.Errorf("unable to read passphrase: %w", err)
+		}
+
+		if !bytes.Equal(p, repeated) {
+			return nil, fmt.Errorf("passphrases don't match")
+		}
+	}
+
+	return p, nil
+}
+
+// PassphraseFunc returns passphrase for the archive.
+// If confirm is true, passphrase is going to be used for the new archive, so it should be asked twice.
+type PassphraseFunc func(confirm bool) ([]byte, error)
+
+// NewPassphraseFunc returns passphrase from the key file if it's set, from environment variable,
+// or asks user for it in terminal. Passphrase is asked once and remembered.
+func NewPassphraseFunc(keyFileName string) PassphraseFunc {
+	var passphrase []byte
+
+	return func(confirm bool) ([]byte, error) {
+		if passphrase != nil {
+			return passphrase, nil
+		}
+
+		p, err := readPassphrase(keyFileName, confirm)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(p) == 0 {
+			return nil, fmt.Errorf("passphrase is empty")
+		}
+
+		passphrase = p
+
+		return passphrase, nil
+	}
+}
+
+func readPassphrase(keyFileName string, confirm bool) ([]byte, error) {
+	if keyFileName != "" {
+		data, err := os.ReadFile(keyFileName)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read key file %s: %w", keyFileName, err)
+		}
+
+		return bytes.TrimRight(data, "\r\n"), nil
+	}
+
+	if env := os.Getenv(PassphraseEnvironmentVariable); env != "" {
+		return []byte(env), nil
+	}
+
+	stdin := int(os.Stdin.Fd())
+	if !term.IsTerminal(stdin) {
+		return nil, fmt.Errorf("passphrase is required, use -keyfile or %s environment variable", PassphraseEnvironmentVariable)
+	}
+
+	return askPassphrase("Archive passphrase: ", confirm)
+}
+
+// runEncryptArchive converts archive into encrypted one, or changes passphrase of encrypted archive.
+// With -account, only the account is encrypted with its own key.
+func runEncryptArchive(args []string) error {
+	flags := flag.NewFlagSet("encrypt", flag.ExitOnError)
+	accountName := flags.String("account", "", "encrypt only this account with its own key")
+	newKeyFileName := flags.String("new-keyfile", "", "file containing new passphrase (default: same as -keyfile or -account-keyfile)")
+	removeHistory := flags.Bool("remove-history", false, "remove previous versions of the archive without asking, they're not encrypted with the new passphrase")
+	_ = flags.Parse(args)
+
+	archive, err := ReadChatLogsArchive(*ArchiveFileName, archiveOptions())
+	if err != nil {
+		return err
+	}
+
+	var p []byte
+	if *accountName != "" {
+		if *newKeyFileName == "" {
+			*newKeyFileName = AccountKeyFileNames[*accountName]
+		}
+
+		if archive.lockedAccounts[*accountName] != nil {
+			archive.Abort()
+			return fmt.Errorf("passphrase of %s is required to change it", *accountName)
+		}
+
+		p, err = readAccountPassphrase(*accountName, *newKeyFileName, true)
+	} else {
+		if *newKeyFileName == "" {
+			*newKeyFileName = *KeyFileName
+		}
+
+		// Ask for the new passphrase, ignoring the remembered one.
+		p, err = NewPassphraseFunc(*newKeyFileName)(true)
+	}
+	if err == nil && len(p) == 0 {
+		err = fmt.Errorf("passphrase is empty")
+	}
+	if err != nil {
+		archive.Abort()
+		return err
+	}
+
+	c, err := NewArchiveCipher(p)
+	if err != nil {
+		archive.Abort()
+		return err
+	}
+
+	if *accountName != "" {
+		archive.accountWriteCiphers[*accountName] = c
+	} else {
+		archive.writeCipher = c
+	}
+
+	err = convertArchive(archive)
+	if err != nil {
+		return err
+	}
+
+	return removeOldHistory(*ArchiveFileName, *removeHistory)
+}
+
+// removeOldHistory removes previous versions of the archive, which are not encrypted with the new passphrase.
+// Unless remove is set, it's asked in terminal; otherwise, where they're kept is shown.
+func removeOldHistory(fileName string, remove bool) error {
+	snapshots, err := ListSnapshots(fileName)
+	if err != nil || len(snapshots) == 0 {
+		return err
+	}
+
+	directory, err := HistoryDirectory(fileName)
+	if err != nil {
+		return err
+	}
+
+	if !remove && term.IsTerminal(int(os.Stdin.Fd())) {
+		fmt.Fprintf(os.Stderr, "%d previous versions of %s in %s are not encrypted with the new passphrase. Remove them? [y/N] ", len(snapshots), fileName, directory)
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		remove = strings.EqualFold(strings.TrimSpace(answer), "y")
+	}
+
+	if !remove {
+		fmt.Printf("%d previous versions of %s are not encrypted with the new passphrase, they're kept in %s\n", len(snapshots), fileName, directory)
+		return nil
+	}
+
+	err = RemoveHistory(fileName)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Previous versions of %s are removed from %s\n", fileName, directory)
+
+	return nil
+}
+
+// runDecryptArchive converts encrypted archive into plain one.
+// With -account, the account's own key is removed, so the account is encrypted with the archive key, if any.
+func runDecryptArchive(args []string) error {
+	flags := flag.NewFlagSet("decrypt", flag.ExitOnError)
+	accountName := flags.String("account", "", "remove own key of this account only")
+	_ = flags.Parse(args)
+
+	archive, err := ReadChatLogsArchive(*ArchiveFileName, archiveOptions())
+	if err != nil {
+		return err
+	}
+
+	if *accountName != "" {
+		if archive.lockedAccounts[*accountName] != nil {
+			archive.Abort()
+			return fmt.Errorf("passphrase of %s is required to decrypt it", *accountName)
+		}
+
+		if archive.accountReadCiphers[*accountName] == nil {
+			archive.Abort()
+			return fmt.Errorf("account %s is not encrypted with its own key", *accountName)
+		}
+
+		delete(archive.accountWriteCiphers, *accountName)
+	} else {
+		if archive.readCipher == nil {
+			archive.Abort()
+			return fmt.Errorf("archive %s is not encrypted", *ArchiveFileName)
+		}
+
+		archive.writeCipher = nil
+	}
+
+	return convertArchive(archive)
+}
+
+// convertArchive rewrites all archive entries with the archive write cipher.
+// Replaced archive is not saved into the history, so it's not kept there unencrypted or encrypted with the old passphrase.
+func convertArchive(archive *ChatLogsArchive) error {
+	archive.options.KeepGenerations = 0
+
+	err := archive.CopyAll()
+	if err != nil {
+		archive.Abort()
+		return err
+	}
+
+	return archive.Close()
+}
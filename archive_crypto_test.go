@@ -0,0 +1,212 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestArchiveCipher(t *testing.T) {
+	c, err := NewArchiveCipher([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encrypted, err := c.Encrypt("alice/bob.txt", []byte("hi\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opened, err := OpenArchiveCipher(c.header, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := opened.Decrypt("alice/bob.txt", encrypted)
+	if err != nil || string(data) != "hi\n" {
+		t.Errorf("entry is decrypted as %q (%v)", data, err)
+	}
+
+	// Entry name is authenticated, so entries can't be swapped.
+	_, err = opened.Decrypt("alice/carol.txt", encrypted)
+	if err == nil {
+		t.Errorf("entry is decrypted under another name")
+	}
+
+	_, err = OpenArchiveCipher(c.header, []byte("wrong"))
+	if !errors.Is(err, ErrWrongPassphrase) {
+		t.Errorf("cipher is opened with wrong passphrase: %v", err)
+	}
+}
+
+// passphrase returns PassphraseFunc of the passphrase.
+func passphrase(p string) PassphraseFunc {
+	return func(confirm bool) ([]byte, error) {
+		return []byte(p), nil
+	}
+}
+
+func TestEncryptedArchive(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "sl_chat_logs.zip")
+
+	archive, err := ReadChatLogsArchive(fileName, ArchiveOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archive.writeCipher, err = NewArchiveCipher([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archive.accountWriteCiphers["carol"], err = NewArchiveCipher([]byte("carol's secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, accountName := range []string{"alice", "carol"} {
+		err = archive.WriteChatLog(accountName, "bob.txt", mustReadMessages(t, "[2023/06/30 12:00]  Bob: secret message\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = archive.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Chat logs are not stored in plain text.
+	r, err := zip.OpenReader(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range r.File {
+		entry, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(entry)
+		_ = entry.Close()
+
+		if strings.Contains(string(data), "secret message") {
+			t.Errorf("%s is not encrypted", f.Name)
+		}
+	}
+	_ = r.Close()
+
+	_, err = OpenChatLogsArchive(fileName, ArchiveOptions{Passphrase: passphrase("wrong")})
+	if !errors.Is(err, ErrWrongPassphrase) {
+		t.Errorf("archive is opened with wrong passphrase: %v", err)
+	}
+
+	_, err = OpenChatLogsArchive(fileName, ArchiveOptions{})
+	if err == nil {
+		t.Errorf("archive is opened without passphrase")
+	}
+
+	// Account encrypted with its own key is locked without its passphrase, and it's kept as is.
+	archive, err = ReadChatLogsArchive(fileName, ArchiveOptions{Passphrase: passphrase("secret")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if locked := archive.LockedAccounts(); len(locked) != 1 || locked[0] != "carol" {
+		t.Errorf("locked accounts are %v", locked)
+	}
+
+	messages, err := archive.ReadChatLog("alice", "bob.txt")
+	if err != nil || len(messages) != 1 {
+		t.Errorf("chat log is read as %d messages (%v)", len(messages), err)
+	}
+
+	err = archive.CopyAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = archive.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archive, err = OpenChatLogsArchive(fileName, ArchiveOptions{
+		Passphrase: passphrase("secret"),
+		AccountPassphrase: func(accountName string) ([]byte, error) {
+			return []byte("carol's secret"), nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archive.Close()
+
+	messages, err = archive.ReadChatLog("carol", "bob.txt")
+	if err != nil || len(messages) != 1 {
+		t.Errorf("chat log of locked account is read as %d messages (%v)", len(messages), err)
+	}
+}
+
+func TestEncryptArchiveLeavesNoPlainHistory(t *testing.T) {
+	setHistoryRoot(t)
+
+	fileName := filepath.Join(t.TempDir(), "sl_chat_logs.zip")
+	for _, message := range []string{"first", "second"} {
+		writeHistoryChatLog(t, fileName, 10, message)
+	}
+
+	archive, err := ReadChatLogsArchive(fileName, ArchiveOptions{KeepGenerations: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archive.writeCipher, err = NewArchiveCipher([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = convertArchive(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Plain archive replaced by the encrypted one is not saved into history.
+	snapshots, err := ListSnapshots(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 1 {
+		t.Fatalf("%d previous versions are kept, 1 expected", len(snapshots))
+	}
+
+	err = removeOldHistory(fileName, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = filepath.WalkDir(*HistoryRoot, func(fileName string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+
+		data, err := os.ReadFile(fileName)
+		if err != nil {
+			return err
+		}
+
+		if bytes.Contains(data, []byte("Bob")) || bytes.Contains(data, []byte("alice/")) {
+			t.Errorf("plain version %s is kept in history", fileName)
+		}
+
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		t.Fatal(err)
+	}
+}
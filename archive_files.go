@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ErrVersionMismatch is returned by ArchiveFiles.Write if the file is changed by another device since it was read.
+var ErrVersionMismatch = errors.New("file is changed by another device")
+
+// AnyVersion makes ArchiveFiles.Write overwrite the file regardless of its version.
+const AnyVersion = "*"
+
+// ArchiveFiles is local or remote file system holding the archive as separate files.
+// Paths are slash separated and relative to the root of the archive.
+type ArchiveFiles interface {
+	// List returns paths of all files, recursively.
+	List() ([]string, error)
+	// Read returns content of the file and its version, nil if there's no such file.
+	Read(name string) ([]byte, string, error)
+	// Write writes the file if its version is still the same, empty version means the file must not exist.
+	Write(name string, data []byte, version string) error
+	String() string
+}
+
+// ChatLogChange is chat log changed by the archive storage.
+type ChatLogChange struct {
+	AccountName string
+	FileName    string
+	// Added is count of messages added, it's negative if chat log has less messages than before.
+	Added   int
+	Created bool
+}
+
+// FileArchive is archive stored as separate files: "<account>/<chat_log>.txt",
+// and application's files inside of ArchiveMetadataDirectory.
+// Changed files are written on close, each of them is merged again if it's changed by another device meanwhile.
+type FileArchive struct {
+	files ArchiveFiles
+	names []string
+
+	// read are contents and versions of files read, by name.
+	read     map[string][]byte
+	versions map[string]string
+	// pending are files to be written on close, by name.
+	pending map[string]*pendingFile
+
+	// changes are chat logs changed by the last close, written are names of all files written.
+	changes []ChatLogChange
+	written []string
+}
+
+type pendingFile struct {
+	accountName string
+	fileName    string
+	data        []byte
+	// messages are nil for application's files, which are overwritten regardless of changes.
+	messages Messages
+}
+
+// OpenFileArchive lists files of the archive.
+func OpenFileArchive(files ArchiveFiles) (*FileArchive, error) {
+	names, err := files.List()
+	if err != nil {
+		return nil, fmt.Errorf("unable to list files of %s: %w", files, err)
+	}
+
+	sort.Strings(names)
+
+	return &FileArchive{
+		files:    files,
+		names:    names,
+		read:     make(map[string][]byte),
+		versions: make(map[string]string),
+		pending:  make(map[string]*pendingFile),
+	}, nil
+}
+
+// chatLogName returns account and file name of the chat log, or false if the file is not chat log.
+func chatLogName(name string) (accountName string, fileName string, ok bool) {
+	accountName, fileName, ok = strings.Cut(name, "/")
+	if !ok || accountName == ArchiveMetadataDirectory || strings.Contains(fileName, "/") ||
+		path.Ext(fileName) != ".txt" || IsReservedFileName(fileName) {
+		return "", "", false
+	}
+
+	return accountName, fileName, true
+}
+
+// GetAccountNames returns names of accounts having chat logs.
+func (a *FileArchive) GetAccountNames() ([]string, error) {
+	var accountNames []string
+	for _, name := range a.names {
+		if accountName, _, ok := chatLogName(name); ok {
+			accountNames = append(accountNames, accountName)
+		}
+	}
+
+	return Unique(accountNames), nil
+}
+
+// ListChatLogFileNames returns chat logs of the account.
+func (a *FileArchive) ListChatLogFileNames(accountName string) (absolutePaths []string, relativePaths []string, err error) {
+	for _, name := range a.names {
+		if chatLogAccountName, fileName, ok := chatLogName(name); ok && chatLogAccountName == accountName {
+			absolutePaths = append(absolutePaths, name)
+			relativePaths = append(relativePaths, fileName)
+		}
+	}
+
+	return
+}
+
+// readFile reads the file and remembers its version.
+func (a *FileArchive) readFile(name string) ([]byte, error) {
+	if data, ok := a.read[name]; ok {
+		return data, nil
+	}
+
+	data, version, err := a.files.Read(name)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %s from %s: %w", name, a.files, err)
+	}
+
+	a.read[name] = data
+	a.versions[name] = version
+
+	return data, nil
+}
+
+// ReadChatLog reads chat log of the account.
+func (a *FileArchive) ReadChatLog(accountName string, fileName string) (Messages, error) {
+	name := path.Join(accountName, fileName)
+
+	data, err := a.readFile(name)
+	if err != nil || data == nil {
+		return nil, err
+	}
+
+	messages, err := ReadMessages(bytes.NewReader(data))
+	if err != nil {
+		return messages, fmt.Errorf("unable to read chat log %s: %w", name, err)
+	}
+
+	return messages, nil
+}
+
+// WriteChatLog stages the chat log for writing on close, if its content is changed.
+func (a *FileArchive) WriteChatLog(accountName string, fileName string, messages Messages) error {
+	name := path.Join(accountName, fileName)
+
+	var buf bytes.Buffer
+	err := messages.Write(&buf)
+	if err != nil {
+		return fmt.Errorf("error writing file %s: %w", name, err)
+	}
+
+	return a.stage(name, &pendingFile{accountName: accountName, fileName: fileName, data: buf.Bytes(), messages: messages})
+}
+
+// stage stages the file for writing on close, if its content is changed.
+func (a *FileArchive) stage(name string, file *pendingFile) error {
+	data, err := a.readFile(name)
+	if err != nil {
+		return err
+	}
+
+	if data != nil && bytes.Equal(data, file.data) {
+		delete(a.pending, name)
+		return nil
+	}
+
+	a.pending[name] = file
+
+	return nil
+}
+
+// KeepsUnwritten returns true, only changed files are written.
+func (a *FileArchive) KeepsUnwritten() bool {
+	return true
+}
+
+// LockedAccounts returns nothing, the archive is not encrypted.
+func (a *FileArchive) LockedAccounts() []string {
+	return nil
+}
+
+func contactsFileName(accountName string) string {
+	return path.Join(ArchiveMetadataDirectory, "accounts", accountName, contactsMetadataName)
+}
+
+// ReadContacts reads contacts index of the account.
+// Returns nil if there's no index for the account.
+func (a *FileArchive) ReadContacts(accountName string) ([]Contact, error) {
+	data, err := a.readFile(contactsFileName(accountName))
+	if err != nil || data == nil {
+		return nil, err
+	}
+
+	var contacts []Contact
+	err = json.Unmarshal(data, &contacts)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse contacts index of %s: %w", accountName, err)
+	}
+
+	return contacts, nil
+}
+
+// WriteContacts stages contacts index of the account for writing on close.
+func (a *FileArchive) WriteContacts(accountName string, contacts []Contact) error {
+	data, err := json.MarshalIndent(contacts, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to encode contacts index of %s: %w", accountName, err)
+	}
+
+	return a.stage(contactsFileName(accountName), &pendingFile{accountName: accountName, data: data})
+}
+
+// Close writes changed files.
+// Chat log changed by another device since it was read is merged with the changed one.
+func (a *FileArchive) Close() error {
+	a.changes = nil
+	a.written = nil
+
+	defer closeArchiveFiles(a.files)
+
+	var names []string
+	for name := range a.pending {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		err := a.writePending(name, a.pending[name])
+		if err != nil {
+			return err
+		}
+
+		a.written = append(a.written, name)
+		delete(a.pending, name)
+	}
+
+	return nil
+}
+
+func (a *FileArchive) writePending(name string, file *pendingFile) error {
+	if file.messages == nil {
+		return a.files.Write(name, file.data, AnyVersion)
+	}
+
+	previous := a.read[name]
+	version := a.versions[name]
+
+	for attempt := 0; ; attempt++ {
+		err := a.files.Write(name, file.data, version)
+		if err == nil {
+			break
+		}
+
+		if !errors.Is(err, ErrVersionMismatch) {
+			return fmt.Errorf("unable to write %s into %s: %w", name, a.files, err)
+		}
+
+		if attempt >= maxArchiveMergeAttempts {
+			return fmt.Errorf("%s keeps changing by other devices: %w", name, err)
+		}
+
+		fmt.Printf("%s was changed by another device, merging with it...\n", name)
+
+		previous, version, err = a.files.Read(name)
+		if err != nil {
+			return fmt.Errorf("unable to read %s from %s: %w", name, a.files, err)
+		}
+
+		changed, err := ReadMessages(bytes.NewReader(previous))
+		if err != nil {
+			return fmt.Errorf("unable to read chat log %s: %w", name, err)
+		}
+
+		file.messages = Merge(changed, file.messages)
+
+		var buf bytes.Buffer
+		err = file.messages.Write(&buf)
+		if err != nil {
+			return fmt.Errorf("error writing file %s: %w", name, err)
+		}
+		file.data = buf.Bytes()
+	}
+
+	var before Messages
+	if previous != nil {
+		before, _ = ReadMessages(bytes.NewReader(previous))
+	}
+
+	a.changes = append(a.changes, ChatLogChange{
+		AccountName: file.accountName,
+		FileName:    file.fileName,
+		Added:       len(file.messages) - len(before),
+		Created:     previous == nil,
+	})
+
+	return nil
+}
+
+// Abort discards staged files.
+func (a *FileArchive) Abort() {
+	a.pending = make(map[string]*pendingFile)
+	closeArchiveFiles(a.files)
+}
+
+// closeArchiveFiles closes connection of remote file system, if there's any.
+func closeArchiveFiles(files ArchiveFiles) {
+	if closer, ok := files.(io.Closer); ok {
+		_ = closer.Close()
+	}
+}
+
+func (a *FileArchive) String() string {
+	return a.files.String()
+}
+
+// LocalFiles is local directory holding the archive as separate files.
+// Version of the file is hash of its content.
+type LocalFiles string
+
+// List returns paths of all files inside of the directory, except for hidden directories, e.g. ".git".
+func (d LocalFiles) List() ([]string, error) {
+	var names []string
+
+	err := filepath.WalkDir(string(d), func(p string, entry fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) && p == string(d) {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+
+		if entry.IsDir() {
+			if p != string(d) && strings.HasPrefix(entry.Name(), ".") && entry.Name() != ArchiveMetadataDirectory {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		name, err := filepath.Rel(string(d), p)
+		if err != nil {
+			return err
+		}
+
+		names = append(names, filepath.ToSlash(name))
+
+		return nil
+	})
+
+	return names, err
+}
+
+// Read reads the file.
+func (d LocalFiles) Read(name string) ([]byte, string, error) {
+	data, err := os.ReadFile(filepath.Join(string(d), filepath.FromSlash(name)))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	hash := sha256.Sum256(data)
+
+	return data, hex.EncodeToString(hash[:]), nil
+}
+
+// Write writes the file into temp file first, and then replaces the file with it.
+func (d LocalFiles) Write(name string, data []byte, version string) error {
+	if version != AnyVersion {
+		_, current, err := d.Read(name)
+		if err != nil {
+			return err
+		}
+		if current != version {
+			return ErrVersionMismatch
+		}
+	}
+
+	fileName := filepath.Join(string(d), filepath.FromSlash(name))
+
+	err := os.MkdirAll(filepath.Dir(fileName), 0755)
+	if err != nil {
+		return fmt.Errorf("unable to create directory %s: %w", filepath.Dir(fileName), err)
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(fileName), "."+filepath.Base(fileName)+".*")
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), fileName)
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+
+	return nil
+}
+
+func (d LocalFiles) String() string {
+	return string(d)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"archive/zip"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// ArchiveFormatVersion is version of the archive layout written by this application.
+// Version 0 is archive without manifest: "<account>/<chat_log>.txt" files and application's files only.
+const ArchiveFormatVersion = 1
+
+// ErrNewerArchiveFormat is returned when archive is written by newer version of the application.
+var ErrNewerArchiveFormat = errors.New("archive format is not supported")
+
+// ArchiveMigration upgrades archive from the format version to the next one.
+type ArchiveMigration struct {
+	From        int
+	Description string
+	// Migrate writes all entries of the archive into new archive in the next format.
+	Migrate func(a *ChatLogsArchive) error
+}
+
+// archiveMigrations are migrations of all format versions, in order.
+var archiveMigrations = []ArchiveMigration{
+	{
+		From:        0,
+		Description: "add manifest and contacts index",
+		Migrate:     migrateToManifest,
+	},
+}
+
+// readFormatVersion reads format version of the archive from its manifest.
+// Archive written by newer version of the application is refused.
+func (a *ChatLogsArchive) readFormatVersion() error {
+	manifest, err := a.ReadManifest()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case manifest != nil:
+		a.formatVersion = manifest.FormatVersion
+	case a.r != nil:
+		a.formatVersion = 0
+	default:
+		// New archive.
+		a.formatVersion = ArchiveFormatVersion
+	}
+
+	if a.formatVersion > ArchiveFormatVersion {
+		return fmt.Errorf("%s has format version %d, but this version of the application supports format version %d at most, please update the application: %w",
+			a.fileName, a.formatVersion, ArchiveFormatVersion, ErrNewerArchiveFormat)
+	}
+
+	return nil
+}
+
+// ReadArchiveFormatVersion reads format version of the archive file from its manifest, without opening the archive.
+// Manifest is never encrypted, so no passphrase is needed. There's no archive yet, it has the current format version.
+func ReadArchiveFormatVersion(fileName string) (int, error) {
+	r, err := zip.OpenReader(fileName)
+	if errors.Is(err, os.ErrNotExist) {
+		return ArchiveFormatVersion, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	a := &ChatLogsArchive{fileName: fileName, r: r}
+
+	err = a.readFormatVersion()
+	if err != nil {
+		return 0, err
+	}
+
+	return a.formatVersion, nil
+}
+
+// FormatVersion returns format version of the archive.
+func (a *ChatLogsArchive) FormatVersion() int {
+	return a.formatVersion
+}
+
+// MigrateArchive upgrades archive to the current format version in place, one version at a time.
+// Each version is written as usual, so previous versions are kept in the archive history.
+// Archive of the current format version is not opened at all.
+func MigrateArchive(fileName string, options ArchiveOptions) error {
+	version, err := ReadArchiveFormatVersion(fileName)
+	if err != nil || version == ArchiveFormatVersion {
+		return err
+	}
+
+	for {
+		archive, err := ReadChatLogsArchive(fileName, options)
+		if err != nil {
+			return err
+		}
+
+		migration := findArchiveMigration(archive.formatVersion)
+		if archive.formatVersion == ArchiveFormatVersion || migration == nil {
+			archive.Abort()
+
+			if archive.formatVersion != ArchiveFormatVersion {
+				return fmt.Errorf("%s has format version %d, which can't be upgraded", fileName, archive.formatVersion)
+			}
+
+			return nil
+		}
+
+		fmt.Printf("Upgrading %s from format version %d to %d: %s...\n", fileName, migration.From, migration.From+1, migration.Description)
+
+		for _, accountName := range archive.LockedAccounts() {
+			fmt.Printf("%s is encrypted with its own key, which is not available, it's copied as is\n", accountName)
+		}
+
+		archive.writeFormatVersion = migration.From + 1
+
+		err = migration.Migrate(archive)
+		if err != nil {
+			archive.Abort()
+			return fmt.Errorf("unable to upgrade %s to format version %d: %w", fileName, migration.From+1, err)
+		}
+
+		err = archive.Close()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func findArchiveMigration(version int) *ArchiveMigration {
+	for i := range archiveMigrations {
+		if archiveMigrations[i].From == version {
+			return &archiveMigrations[i]
+		}
+	}
+
+	return nil
+}
+
+// migrateToManifest copies all entries, so manifests are written on close, and builds missing contacts indexes.
+func migrateToManifest(a *ChatLogsArchive) error {
+	err := a.CopyAll()
+	if err != nil {
+		return err
+	}
+
+	accountNames, err := a.GetAccountNames()
+	if err != nil {
+		return err
+	}
+
+	for _, accountName := range accountNames {
+		contacts, err := a.ReadContacts(accountName)
+		if err != nil || contacts != nil {
+			continue
+		}
+
+		_, fileNames, err := a.ListChatLogFileNames(accountName)
+		if err != nil {
+			return err
+		}
+
+		for _, fileName := range fileNames {
+			messages, err := a.ReadChatLog(accountName, fileName)
+			if err != nil {
+				return err
+			}
+
+			contacts = append(contacts, BuildContact(accountName, fileName, messages))
+		}
+
+		err = a.WriteContacts(accountName, contacts)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// runMigrate upgrades the archive to the current format version.
+func runMigrate(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	_ = flags.Parse(args)
+
+	version, err := ReadArchiveFormatVersion(*ArchiveFileName)
+	if err != nil {
+		return err
+	}
+
+	if version == ArchiveFormatVersion {
+		fmt.Printf("%s has the current format version %d\n", *ArchiveFileName, version)
+		return nil
+	}
+
+	err = MigrateArchive(*ArchiveFileName, archiveOptions())
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s is upgraded to format version %d\n", *ArchiveFileName, ArchiveFormatVersion)
+
+	return nil
+}
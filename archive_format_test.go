@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadArchiveFormatVersion(t *testing.T) {
+	directory := t.TempDir()
+
+	version, err := ReadArchiveFormatVersion(filepath.Join(directory, "missing.zip"))
+	if err != nil || version != ArchiveFormatVersion {
+		t.Errorf("missing archive has version %d (%v), %d expected", version, err, ArchiveFormatVersion)
+	}
+
+	newer := filepath.Join(directory, "newer.zip")
+	writeTestZip(t, newer, map[string]string{
+		".sl-chat-log-sync/manifest.json": `{"format_version": 99}`,
+	})
+
+	_, err = ReadArchiveFormatVersion(newer)
+	if !errors.Is(err, ErrNewerArchiveFormat) {
+		t.Errorf("archive of newer format is not refused: %v", err)
+	}
+}
+
+func TestMigrateArchive(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "sl_chat_logs.zip")
+
+	writeTestZip(t, fileName, map[string]string{
+		"alice/bob.txt": "[2023/06/30 12:00]  Bob: hi alice\n",
+	})
+
+	version, err := ReadArchiveFormatVersion(fileName)
+	if err != nil || version != 0 {
+		t.Fatalf("archive without manifest has version %d (%v), 0 expected", version, err)
+	}
+
+	err = MigrateArchive(fileName, ArchiveOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	version, err = ReadArchiveFormatVersion(fileName)
+	if err != nil || version != ArchiveFormatVersion {
+		t.Fatalf("migrated archive has version %d (%v), %d expected", version, err, ArchiveFormatVersion)
+	}
+
+	archive, err := OpenChatLogsArchive(fileName, ArchiveOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archive.Close()
+
+	messages, err := archive.ReadChatLog("alice", "bob.txt")
+	if err != nil || len(messages) != 1 {
+		t.Errorf("chat log is not kept by migration: %d messages (%v)", len(messages), err)
+	}
+
+	contacts, err := archive.ReadContacts("alice")
+	if err != nil || len(contacts) != 1 {
+		t.Errorf("contacts index is not built by migration: %v (%v)", contacts, err)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// GitArchive is local git repository holding chat logs as separate files, see FileArchive.
+// Each sync is committed with the device name as the author, so git log and blame show which device contributed which messages.
+type GitArchive struct {
+	*FileArchive
+	directory string
+	readOnly  bool
+}
+
+// ReadGitArchive opens git repository for reading and writing, new repository is created if there's no such one.
+func ReadGitArchive(directory string) (*GitArchive, error) {
+	g := &GitArchive{directory: directory}
+
+	exists, err := IsDirectoryExists(filepath.Join(directory, ".git"))
+	if err != nil {
+		return nil, err
+	}
+
+	if !exists {
+		err = os.MkdirAll(directory, 0755)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create directory %s: %w", directory, err)
+		}
+
+		_, err = g.git(nil, "init", "--quiet")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	g.FileArchive, err = OpenFileArchive(LocalFiles(directory))
+	if err != nil {
+		return nil, err
+	}
+
+	return g, nil
+}
+
+// OpenGitArchive opens git repository for reading only.
+func OpenGitArchive(directory string) (*GitArchive, error) {
+	files, err := OpenFileArchive(LocalFiles(directory))
+	if err != nil {
+		return nil, err
+	}
+
+	return &GitArchive{FileArchive: files, directory: directory, readOnly: true}, nil
+}
+
+// Close writes changed files and commits them.
+func (g *GitArchive) Close() error {
+	if g.readOnly {
+		return nil
+	}
+
+	err := g.FileArchive.Close()
+	if err != nil {
+		return err
+	}
+
+	if len(g.written) == 0 {
+		return nil
+	}
+
+	_, err = g.git(strings.NewReader(strings.Join(g.written, "\x00")), "add", "--pathspec-from-file=-", "--pathspec-file-nul")
+	if err != nil {
+		return err
+	}
+
+	// Contacts index may be changed without any new messages, e.g. if it's written for the first time.
+	_, err = g.git(nil, "diff", "--cached", "--quiet")
+	if err == nil {
+		return nil
+	}
+
+	_, err = g.git(strings.NewReader(g.commitMessage()), "commit", "--quiet", "--file=-")
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%d chat logs committed into %s\n", len(g.changes), g.directory)
+
+	return nil
+}
+
+// commitMessage describes changed chat logs.
+func (g *GitArchive) commitMessage() string {
+	var added int
+	for _, change := range g.changes {
+		added += change.Added
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Sync from %s: %d messages in %d chat logs\n\n", DeviceName(), added, len(g.changes))
+
+	for _, change := range g.changes {
+		fmt.Fprintf(&b, "%s/%s: %+d", change.AccountName, change.FileName, change.Added)
+		if change.Created {
+			b.WriteString(" (new)")
+		}
+		b.WriteString("\n")
+	}
+
+	return b.String()
+}
+
+// git runs git command inside of the repository.
+// Commits are authored by the device, so they can be made without git configured.
+func (g *GitArchive) git(stdin *strings.Reader, args ...string) ([]byte, error) {
+	cmd := exec.Command("git", append([]string{"-C", g.directory}, args...)...)
+	if stdin != nil {
+		cmd.Stdin = stdin
+	}
+
+	device := DeviceName()
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME="+device, "GIT_AUTHOR_EMAIL="+device+"@sl-chat-log-sync",
+		"GIT_COMMITTER_NAME="+device, "GIT_COMMITTER_EMAIL="+device+"@sl-chat-log-sync")
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	output, err := cmd.Output()
+	if err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return output, fmt.Errorf("git %s: %w: %s", args[0], err, message)
+		}
+		return output, fmt.Errorf("git %s: %w", args[0], err)
+	}
+
+	return output, nil
+}
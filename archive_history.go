@@ -0,0 +1,430 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// snapshotTimeFormat is format of the time in snapshot file names.
+const snapshotTimeFormat = "20060102-150405.000"
+
+// Snapshot is previous version of the archive kept in its history.
+type Snapshot struct {
+	FileName string
+	// Time is when the archive was written.
+	Time time.Time
+	// Host is name of the device which replaced the archive.
+	Host string
+	Size int64
+}
+
+// DefaultHistoryDirectory returns directory of archives' histories inside of the user's configuration directory.
+func DefaultHistoryDirectory() (string, error) {
+	directory, err := StateDirectory()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(directory, "history"), nil
+}
+
+// HistoryDirectory returns directory containing previous versions of the archive: "<archive>-<hash of archive path>"
+// inside of -history-dir, so histories are kept on this device only, and they aren't uploaded by cloud sync client.
+func HistoryDirectory(fileName string) (string, error) {
+	root := *HistoryRoot
+	if root == "" {
+		var err error
+		root, err = DefaultHistoryDirectory()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	absolute, err := filepath.Abs(fileName)
+	if err != nil {
+		return "", fmt.Errorf("unable to resolve path %s: %w", fileName, err)
+	}
+
+	hash := sha256.Sum256([]byte(absolute))
+	directory := filepath.Join(root, fmt.Sprintf("%s-%x", strings.TrimSuffix(filepath.Base(fileName), filepath.Ext(fileName)), hash[:4]))
+
+	return directory, nil
+}
+
+// ListSnapshots returns previous versions of the archive, the newest first.
+func ListSnapshots(fileName string) ([]Snapshot, error) {
+	directory, err := HistoryDirectory(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(directory)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read directory %s: %w", directory, err)
+	}
+
+	var snapshots []Snapshot
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != filepath.Ext(fileName) {
+			continue
+		}
+
+		// Snapshot file name is "<time>_<host>.zip".
+		timestamp, host, ok := strings.Cut(strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name())), "_")
+		if !ok {
+			continue
+		}
+
+		t, err := time.Parse(snapshotTimeFormat, timestamp)
+		if err != nil {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return nil, fmt.Errorf("unable to stat %s: %w", entry.Name(), err)
+		}
+
+		snapshots = append(snapshots, Snapshot{
+			FileName: filepath.Join(directory, entry.Name()),
+			Time:     t,
+			Host:     host,
+			Size:     info.Size(),
+		})
+	}
+
+	sort.SliceStable(snapshots, func(i, j int) bool {
+		return snapshots[i].Time.After(snapshots[j].Time)
+	})
+
+	return snapshots, nil
+}
+
+// SaveSnapshot copies the archive written at modTime into its history, and removes the oldest versions over keep.
+// All versions are kept if keep is 0.
+func SaveSnapshot(fileName string, modTime time.Time, keep int) error {
+	directory, err := HistoryDirectory(fileName)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(directory, 0755)
+	if err != nil {
+		return fmt.Errorf("unable to create directory %s: %w", directory, err)
+	}
+
+	host := strings.NewReplacer("/", "-", "\\", "-", "_", "-").Replace(DeviceName())
+
+	identity, err := ReadArchiveIdentity(fileName)
+	if err != nil {
+		return err
+	}
+
+	var snapshotFileName string
+	for {
+		snapshotFileName = filepath.Join(directory, modTime.UTC().Format(snapshotTimeFormat)+"_"+host+filepath.Ext(fileName))
+
+		saved, err := ReadArchiveIdentity(snapshotFileName)
+		if err != nil {
+			return err
+		}
+
+		// The same version is already saved.
+		if saved.SameContent(identity) {
+			return nil
+		}
+
+		if !saved.Exists {
+			break
+		}
+
+		// Another version written at the same time.
+		modTime = modTime.Add(time.Millisecond)
+	}
+
+	err = CopyFile(fileName, snapshotFileName)
+	if err != nil {
+		_ = os.Remove(snapshotFileName)
+		return fmt.Errorf("unable to save %s into history: %w", fileName, err)
+	}
+
+	if keep <= 0 {
+		return nil
+	}
+
+	snapshots, err := ListSnapshots(fileName)
+	if err != nil {
+		return err
+	}
+
+	for len(snapshots) > keep {
+		oldest := snapshots[len(snapshots)-1]
+		snapshots = snapshots[:len(snapshots)-1]
+
+		err = os.Remove(oldest.FileName)
+		if err != nil {
+			return fmt.Errorf("unable to remove old version %s: %w", oldest.FileName, err)
+		}
+	}
+
+	return nil
+}
+
+// RemoveHistory removes all previous versions of the archive.
+func RemoveHistory(fileName string) error {
+	directory, err := HistoryDirectory(fileName)
+	if err != nil {
+		return err
+	}
+
+	err = os.RemoveAll(directory)
+	if err != nil {
+		return fmt.Errorf("unable to remove %s: %w", directory, err)
+	}
+
+	return nil
+}
+
+// FindSnapshot returns previous version of the archive by its generation number shown by history command, or by file name.
+func FindSnapshot(fileName string, generation string) (Snapshot, error) {
+	snapshots, err := ListSnapshots(fileName)
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	if n, err := strconv.Atoi(generation); err == nil {
+		if n < 1 || n > len(snapshots) {
+			return Snapshot{}, fmt.Errorf("there's no generation %d in history of %s", n, fileName)
+		}
+
+		return snapshots[n-1], nil
+	}
+
+	for _, snapshot := range snapshots {
+		if filepath.Base(snapshot.FileName) == filepath.Base(generation) {
+			return snapshot, nil
+		}
+	}
+
+	return Snapshot{}, fmt.Errorf("there's no %s in history of %s", generation, fileName)
+}
+
+// isChanged returns true if content of new archive differs from the old one.
+// Encryption doesn't matter, only plain content of the entries is compared.
+// Entries of locked accounts are copied as is, so they're not compared.
+func (a *ChatLogsArchive) isChanged() bool {
+	if a.r == nil {
+		return true
+	}
+
+	digests := make(map[string][sha256.Size]byte)
+	for _, f := range a.r.File {
+		if strings.HasSuffix(f.Name, "/") {
+			continue
+		}
+
+		accountName := entryAccountName(f.Name)
+		if a.lockedAccounts[accountName] != nil || f.Name == strings.Join([]string{ArchiveMetadataDirectory, manifestMetadataName}, "/") {
+			continue
+		}
+
+		var c *ArchiveCipher
+		if f.Name != strings.Join([]string{ArchiveMetadataDirectory, encryptionMetadataName}, "/") {
+			var err error
+			c, err = a.readCipherFor(accountName)
+			if err != nil {
+				return true
+			}
+		}
+
+		data, err := a.readEntry(f.Name, c)
+		if err != nil {
+			return true
+		}
+
+		digests[f.Name] = sha256.Sum256(data)
+	}
+
+	if len(digests) != len(a.writtenDigests) {
+		return true
+	}
+
+	for name, digest := range digests {
+		if written, ok := a.writtenDigests[name]; !ok || written != digest {
+			return true
+		}
+	}
+
+	return false
+}
+
+// runHistory lists previous versions of the archive.
+func runHistory(args []string) error {
+	flags := flag.NewFlagSet("history", flag.ExitOnError)
+	_ = flags.Parse(args)
+
+	snapshots, err := ListSnapshots(*ArchiveFileName)
+	if err != nil {
+		return err
+	}
+
+	if len(snapshots) == 0 {
+		fmt.Printf("There are no previous versions of %s.\n", *ArchiveFileName)
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "GENERATION\tWRITTEN\tREPLACED BY\tSIZE\tFILE\n")
+	for i, snapshot := range snapshots {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", i+1, snapshot.Time.Local().Format(time.DateTime), snapshot.Host,
+			FormatSize(uint64(snapshot.Size)), filepath.Base(snapshot.FileName))
+	}
+
+	return tw.Flush()
+}
+
+// runRollback restores previous version of the archive. Current archive is saved into the history, so rollback can be undone.
+// With -push, chat logs of the restored archive overwrite chat logs of SecondLife clients.
+func runRollback(args []string) error {
+	flags := flag.NewFlagSet("rollback", flag.ExitOnError)
+	push := flags.Bool("push", false, "overwrite chat logs of SecondLife clients with the restored ones, so damaged chat logs are not merged back on next sync")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s [options] rollback [-push] <generation>\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	snapshot, err := FindSnapshot(*ArchiveFileName, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	// Chat logs of SecondLife clients are pushed only if the viewer is not running, check it before the archive is restored.
+	if *push {
+		err = awaitViewersExited()
+		if err != nil {
+			return fmt.Errorf("%w; rollback -push writes its chat logs, exit it first", err)
+		}
+	}
+
+	options := archiveOptions()
+
+	// Make sure the version can be read before replacing the archive with it.
+	restored, err := OpenChatLogsArchive(snapshot.FileName, options)
+	if err != nil {
+		return fmt.Errorf("unable to open %s: %w", snapshot.FileName, err)
+	}
+	_ = restored.Close()
+
+	identity, err := ReadArchiveIdentity(*ArchiveFileName)
+	if err != nil {
+		return err
+	}
+
+	// Old versions are removed on next sync, so the restored one is not removed before it's copied.
+	if identity.Exists {
+		err = SaveSnapshot(*ArchiveFileName, identity.ModTime, 0)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The archive is replaced at once, unless it's changed by another device after it's saved into the history.
+	replaced, _, err := replaceFileIfUnchanged(*ArchiveFileName, identity, snapshot.FileName)
+	if err != nil {
+		return fmt.Errorf("unable to restore %s from %s: %w", *ArchiveFileName, snapshot.FileName, err)
+	}
+	if !replaced {
+		return fmt.Errorf("%s was changed by another device while restoring it, run rollback again", *ArchiveFileName)
+	}
+
+	fmt.Printf("%s restored from %s\n", *ArchiveFileName, snapshot.FileName)
+
+	if !*push {
+		return nil
+	}
+
+	return pushArchive(*ArchiveFileName, options)
+}
+
+// pushArchive overwrites chat logs of all found SecondLife clients with the archived ones.
+// Chat logs which are not in the archive are left untouched, overwritten ones are saved into the backup.
+func pushArchive(fileName string, options ArchiveOptions) (err error) {
+	clients := DetectSecondLifeClients()
+	if len(clients) == 0 {
+		fmt.Printf("No SecondLife clients found.\n")
+		return nil
+	}
+
+	backupOptions, err := backupOptions()
+	if err != nil {
+		return err
+	}
+
+	backup := NewChatLogsBackup(backupOptions)
+	defer func() {
+		backupErr := backup.Close()
+		if err == nil {
+			err = backupErr
+		}
+	}()
+
+	archive, err := OpenChatLogsArchive(fileName, options)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	for _, accountName := range archive.LockedAccounts() {
+		fmt.Printf("%s is encrypted with its own key, which is not available, skipping it\n", accountName)
+	}
+
+	accountNames, err := archive.GetAccountNames()
+	if err != nil {
+		return err
+	}
+
+	sort.Strings(accountNames)
+
+	for _, accountName := range accountNames {
+		_, fileNames, err := archive.ListChatLogFileNames(accountName)
+		if err != nil {
+			return err
+		}
+
+		for _, fileName := range fileNames {
+			messages, err := archive.ReadChatLog(accountName, fileName)
+			if err != nil {
+				return err
+			}
+
+			for _, client := range clients {
+				err = BackedUpClient{SecondLifeClient: client, backup: backup}.WriteChatLog(accountName, fileName, messages)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		fmt.Printf("%d chat logs of %s written into %d SecondLife clients\n", len(fileNames), accountName, len(clients))
+	}
+
+	return nil
+}
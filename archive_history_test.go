@@ -0,0 +1,132 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeHistoryChatLog replaces chat log of the archive with the message, so new version of the archive is written.
+func writeHistoryChatLog(t *testing.T, fileName string, keep int, message string) {
+	t.Helper()
+
+	archive, err := ReadChatLogsArchive(fileName, ArchiveOptions{KeepGenerations: keep})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = archive.WriteChatLog("alice", "bob.txt", mustReadMessages(t, "[2023/06/30 12:00]  Bob: "+message+"\n"))
+	if err != nil {
+		archive.Abort()
+		t.Fatal(err)
+	}
+
+	err = archive.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readHistoryChatLog returns the message of chat log written by writeHistoryChatLog.
+func readHistoryChatLog(t *testing.T, fileName string) string {
+	t.Helper()
+
+	archive, err := OpenChatLogsArchive(fileName, ArchiveOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archive.Close()
+
+	messages, err := archive.ReadChatLog("alice", "bob.txt")
+	if err != nil || len(messages) != 1 {
+		t.Fatalf("chat log is read as %d messages (%v)", len(messages), err)
+	}
+
+	return strings.TrimSuffix(strings.TrimPrefix(messages[0].Message, "[2023/06/30 12:00]  Bob: "), "\n")
+}
+
+// setHistoryRoot keeps histories of the test in its temp directory.
+func setHistoryRoot(t *testing.T) {
+	root := *HistoryRoot
+	*HistoryRoot = filepath.Join(t.TempDir(), "history")
+	t.Cleanup(func() { *HistoryRoot = root })
+}
+
+func TestSaveSnapshotKeepsGenerations(t *testing.T) {
+	setHistoryRoot(t)
+
+	fileName := filepath.Join(t.TempDir(), "sl_chat_logs.zip")
+	for _, message := range []string{"first", "second", "third", "fourth"} {
+		writeHistoryChatLog(t, fileName, 2, message)
+	}
+
+	snapshots, err := ListSnapshots(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(snapshots) != 2 {
+		t.Fatalf("%d versions are kept, 2 expected", len(snapshots))
+	}
+
+	for i, message := range []string{"third", "second"} {
+		if text := readHistoryChatLog(t, snapshots[i].FileName); text != message {
+			t.Errorf("generation %d has message %q, %q expected", i+1, text, message)
+		}
+	}
+
+	directory, err := HistoryDirectory(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if filepath.Dir(directory) != *HistoryRoot || filepath.Dir(snapshots[0].FileName) != directory {
+		t.Errorf("versions are kept in %s, not in %s", filepath.Dir(snapshots[0].FileName), *HistoryRoot)
+	}
+
+	// Unchanged archive is not saved into history.
+	writeHistoryChatLog(t, fileName, 2, "fourth")
+
+	unchanged, err := ListSnapshots(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(unchanged) != 2 || unchanged[0].FileName != snapshots[0].FileName {
+		t.Errorf("unchanged archive is saved into history: %+v", unchanged)
+	}
+}
+
+func TestRollback(t *testing.T) {
+	setHistoryRoot(t)
+
+	fileName := filepath.Join(t.TempDir(), "sl_chat_logs.zip")
+	archiveFileName := *ArchiveFileName
+	*ArchiveFileName = fileName
+	defer func() { *ArchiveFileName = archiveFileName }()
+
+	for _, message := range []string{"good", "bad"} {
+		writeHistoryChatLog(t, fileName, 10, message)
+	}
+
+	err := runRollback([]string{"1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if text := readHistoryChatLog(t, fileName); text != "good" {
+		t.Errorf("rolled back archive has message %q", text)
+	}
+
+	// Replaced archive is saved into history, so rollback can be undone.
+	err = runRollback([]string{"1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if text := readHistoryChatLog(t, fileName); text != "bad" {
+		t.Errorf("rollback is undone with message %q", text)
+	}
+
+	assertNoTempFiles(t, fileName)
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// maxArchiveMergeAttempts limits how many times written archive is merged with the archive changed by other devices.
+const maxArchiveMergeAttempts = 5
+
+// ArchiveIdentity identifies content of the archive file.
+type ArchiveIdentity struct {
+	Exists  bool
+	Size    int64
+	ModTime time.Time
+	Hash    [sha256.Size]byte
+}
+
+// ReadArchiveIdentity reads size, modification time and content hash of the archive file.
+func ReadArchiveIdentity(fileName string) (ArchiveIdentity, error) {
+	f, err := os.Open(fileName)
+	if errors.Is(err, os.ErrNotExist) {
+		return ArchiveIdentity{}, nil
+	}
+	if err != nil {
+		return ArchiveIdentity{}, fmt.Errorf("unable to open %s: %w", fileName, err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return ArchiveIdentity{}, fmt.Errorf("unable to stat %s: %w", fileName, err)
+	}
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return ArchiveIdentity{}, fmt.Errorf("unable to read %s: %w", fileName, err)
+	}
+
+	identity := ArchiveIdentity{
+		Exists:  true,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}
+	copy(identity.Hash[:], h.Sum(nil))
+
+	return identity, nil
+}
+
+// SameContent returns true if both identities are of the same archive content.
+// Modification time is ignored, because cloud sync clients may touch files without changing them.
+func (i ArchiveIdentity) SameContent(other ArchiveIdentity) bool {
+	return i.Exists == other.Exists && i.Size == other.Size && i.Hash == other.Hash
+}
+
+// replace replaces archive file with the written one, if archive wasn't changed since it was opened.
+// Otherwise, written archive is merged with the changed one, so changes of other devices are not lost.
+// Old archive is saved into the history if content of the written one is changed.
+func (a *ChatLogsArchive) replace(writtenFileName string, changed bool) error {
+	identity, err := ReadArchiveIdentity(a.fileName)
+	if err != nil {
+		_ = os.Remove(writtenFileName)
+		return err
+	}
+
+	if identity.SameContent(a.identity) {
+		if changed && identity.Exists && a.options.KeepGenerations > 0 {
+			err = SaveSnapshot(a.fileName, identity.ModTime, a.options.KeepGenerations)
+			if err != nil {
+				return fmt.Errorf("%w, merged chat logs are left in %s", err, writtenFileName)
+			}
+		}
+
+		var replaced bool
+		replaced, identity, err = a.replaceIfUnchanged(writtenFileName)
+		if err != nil {
+			return fmt.Errorf("error overwriting file %s, merged chat logs are left in %s: %w", a.fileName, writtenFileName, err)
+		}
+
+		if replaced {
+			_ = os.Remove(writtenFileName)
+			return nil
+		}
+	}
+
+	if a.attempt >= maxArchiveMergeAttempts {
+		return fmt.Errorf("%s keeps changing by other devices, merged chat logs are left in %s", a.fileName, writtenFileName)
+	}
+
+	fmt.Printf("%s was changed by another device (modified at %s), merging with it...\n", a.fileName, identity.ModTime.Format(time.DateTime))
+
+	err = mergeChangedArchive(a.fileName, writtenFileName, a.options, a.attempt+1)
+	if err != nil {
+		return fmt.Errorf("error merging with changed %s, merged chat logs are left in %s: %w", a.fileName, writtenFileName, err)
+	}
+
+	_ = os.Remove(writtenFileName)
+
+	return nil
+}
+
+// replaceIfUnchanged copies the written archive into temp file next to the archive file,
+// and renames it over the archive file if the archive is still not changed right before that,
+// so the archive is replaced at once, and it's never replaced with incomplete copy.
+// Returns identity of the archive if it's changed meanwhile, and not replaced.
+func (a *ChatLogsArchive) replaceIfUnchanged(writtenFileName string) (bool, ArchiveIdentity, error) {
+	return replaceFileIfUnchanged(a.fileName, a.identity, writtenFileName)
+}
+
+// replaceFileIfUnchanged replaces the file with copy of the written one, as replaceIfUnchanged does,
+// if content of the file is still of the expected identity.
+func replaceFileIfUnchanged(fileName string, expected ArchiveIdentity, writtenFileName string) (bool, ArchiveIdentity, error) {
+	f, err := os.CreateTemp(filepath.Dir(fileName), "."+filepath.Base(fileName)+".*")
+	if err != nil {
+		return false, ArchiveIdentity{}, fmt.Errorf("unable to create temp file next to %s: %w", fileName, err)
+	}
+	tempFileName := f.Name()
+
+	err = copyFileInto(f, writtenFileName)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tempFileName)
+		return false, ArchiveIdentity{}, fmt.Errorf("unable to write %s: %w", tempFileName, err)
+	}
+
+	identity, err := ReadArchiveIdentity(fileName)
+	if err != nil || !identity.SameContent(expected) {
+		_ = os.Remove(tempFileName)
+		return false, identity, err
+	}
+
+	err = os.Rename(tempFileName, fileName)
+	if err != nil {
+		_ = os.Remove(tempFileName)
+		return false, ArchiveIdentity{}, err
+	}
+
+	return true, identity, nil
+}
+
+// copyFileInto copies content of the file into f, and flushes it to disk.
+func copyFileInto(f *os.File, fileName string) error {
+	source, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	_, err = io.Copy(f, source)
+	if err != nil {
+		return err
+	}
+
+	return f.Sync()
+}
+
+// mergeChangedArchive merges the written archive into the archive changed by other devices.
+func mergeChangedArchive(fileName string, writtenFileName string, options ArchiveOptions, attempt int) error {
+	written, err := OpenChatLogsArchive(writtenFileName, options)
+	if err != nil {
+		return err
+	}
+	defer written.Close()
+
+	changed, err := ReadChatLogsArchive(fileName, options)
+	if err != nil {
+		return err
+	}
+
+	changed.attempt = attempt
+
+	storages := []ChatLogsStorage{written, changed}
+
+	accountNames, err := GetAllAccountNames(storages)
+	if err != nil {
+		changed.Abort()
+		return err
+	}
+
+	// Locked accounts are copied by the changed archive as is.
+	accountNames = Subtract(accountNames, changed.LockedAccounts())
+
+	for _, accountName := range accountNames {
+		fileNames, err := ListAllChatLogFileNames(storages, accountName)
+		if err != nil {
+			changed.Abort()
+			return err
+		}
+
+		var contacts []Contact
+		for _, fileName := range fileNames {
+			merged, err := ReadMergedChatLog(storages, accountName, fileName)
+			if err != nil {
+				changed.Abort()
+				return err
+			}
+
+			err = changed.WriteChatLog(accountName, fileName, merged)
+			if err != nil {
+				changed.Abort()
+				return err
+			}
+
+			contacts = append(contacts, BuildContact(accountName, fileName, merged))
+		}
+
+		err = changed.WriteContacts(accountName, contacts)
+		if err != nil {
+			changed.Abort()
+			return err
+		}
+	}
+
+	return changed.Close()
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// assertNoTempFiles checks nothing but the archive is left in its directory.
+func assertNoTempFiles(t *testing.T, fileName string) {
+	t.Helper()
+
+	entries, err := os.ReadDir(filepath.Dir(fileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, entry := range entries {
+		if entry.Name() != filepath.Base(fileName) {
+			t.Errorf("%s is left next to the archive", entry.Name())
+		}
+	}
+}
+
+func TestChatLogsArchiveMergesChangedArchive(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "sl_chat_logs.zip")
+
+	archive, err := ReadChatLogsArchive(fileName, ArchiveOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = archive.WriteChatLog("alice", "bob.txt", mustReadMessages(t, "[2023/06/30 12:00]  Bob: from this device\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Another device writes the archive meanwhile.
+	other, err := ReadChatLogsArchive(fileName, ArchiveOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = other.WriteChatLog("alice", "bob.txt", mustReadMessages(t, "[2023/06/30 12:01]  Bob: from other device\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = other.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = archive.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	merged, err := OpenChatLogsArchive(fileName, ArchiveOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages, err := merged.ReadChatLog("alice", "bob.txt")
+	_ = merged.Close()
+	if err != nil || len(messages) != 2 {
+		t.Errorf("merged chat log has %d messages (%v), 2 expected", len(messages), err)
+	}
+
+	assertNoTempFiles(t, fileName)
+}
+
+func TestReplaceIfUnchangedKeepsChangedArchive(t *testing.T) {
+	directory := t.TempDir()
+	fileName := filepath.Join(directory, "sl_chat_logs.zip")
+	writtenFileName := filepath.Join(t.TempDir(), "written.zip")
+
+	err := os.WriteFile(fileName, []byte("opened"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(writtenFileName, []byte("written"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	identity, err := ReadArchiveIdentity(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := &ChatLogsArchive{fileName: fileName, identity: identity}
+
+	err = os.WriteFile(fileName, []byte("changed"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replaced, _, err := a.replaceIfUnchanged(writtenFileName)
+	if err != nil || replaced {
+		t.Fatalf("changed archive is replaced: %v", err)
+	}
+
+	data, _ := os.ReadFile(fileName)
+	if string(data) != "changed" {
+		t.Errorf("archive is %q", data)
+	}
+
+	assertNoTempFiles(t, fileName)
+
+	a.identity, err = ReadArchiveIdentity(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replaced, _, err = a.replaceIfUnchanged(writtenFileName)
+	if err != nil || !replaced {
+		t.Fatalf("unchanged archive is not replaced: %v", err)
+	}
+
+	data, _ = os.ReadFile(fileName)
+	if string(data) != "written" {
+		t.Errorf("archive is %q", data)
+	}
+
+	assertNoTempFiles(t, fileName)
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+)
+
+// PluginProtocolVersion is version of the protocol spoken with storage plugins, it's sent in "open" request.
+const PluginProtocolVersion = 1
+
+// pluginExecutablePrefix is prefix of plugin executables looked up in PATH, e.g. "sl-chat-log-sync-dropbox".
+const pluginExecutablePrefix = "sl-chat-log-sync-"
+
+// Capabilities of storage plugin, returned in response to "open" request.
+const (
+	// PluginCapabilityContacts means the plugin stores contacts indexes, otherwise they're rebuilt from chat logs.
+	PluginCapabilityContacts = "contacts"
+)
+
+// storageRequest is request of storage operation sent to storage plugin or peer, as JSON.
+type storageRequest struct {
+	Command     string    `json:"command"`
+	Session     string    `json:"session,omitempty"`
+	Version     int       `json:"version,omitempty"`
+	Location    string    `json:"location,omitempty"`
+	ReadOnly    bool      `json:"read_only,omitempty"`
+	AccountName string    `json:"account_name,omitempty"`
+	FileName    string    `json:"file_name,omitempty"`
+	ChatLog     *string   `json:"chat_log,omitempty"`
+	Days        []string  `json:"days,omitempty"`
+	Contacts    []Contact `json:"contacts,omitempty"`
+}
+
+// storageResponse is response of storage plugin or peer, as JSON.
+type storageResponse struct {
+	Error        string          `json:"error,omitempty"`
+	Session      string          `json:"session,omitempty"`
+	Capabilities []string        `json:"capabilities,omitempty"`
+	AccountNames []string        `json:"account_names,omitempty"`
+	FileNames    []string        `json:"file_names,omitempty"`
+	ChatLog      *string         `json:"chat_log,omitempty"`
+	Summary      *ChatLogSummary `json:"summary,omitempty"`
+	Contacts     []Contact       `json:"contacts,omitempty"`
+}
+
+// PluginStorage is archive storage implemented by external executable, in the spirit of git remote helpers.
+// Storage operations are forwarded to the plugin as JSON requests over its stdin, one per line,
+// and the plugin answers each of them with JSON response on its stdout. See README for the protocol.
+type PluginStorage struct {
+	name     string
+	location string
+
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+
+	capabilities map[string]bool
+	// mutex serializes requests, the plugin handles them one by one.
+	mutex sync.Mutex
+	done  bool
+}
+
+// ParsePluginSpec splits location of plugin storage "<plugin>:<location>" into plugin name and its own location.
+func ParsePluginSpec(spec string) (name string, location string) {
+	name, location, _ = strings.Cut(spec, ":")
+	return
+}
+
+// pluginExecutable returns executable of the plugin: "sl-chat-log-sync-<name>" from PATH, or the path itself.
+func pluginExecutable(name string) (string, error) {
+	if strings.ContainsAny(name, `/\`) {
+		return name, nil
+	}
+
+	executable, err := exec.LookPath(pluginExecutablePrefix + name)
+	if err != nil {
+		return "", fmt.Errorf("storage plugin %s is not found, %s%s executable is expected in PATH: %w", name, pluginExecutablePrefix, name, err)
+	}
+
+	return executable, nil
+}
+
+// StartPluginStorage starts the plugin by spec "<plugin>:<location>", and opens the storage.
+func StartPluginStorage(spec string, readOnly bool) (*PluginStorage, error) {
+	name, location := ParsePluginSpec(spec)
+	if name == "" {
+		return nil, fmt.Errorf("invalid plugin storage %s, plugin:<name>:<location> expected", spec)
+	}
+
+	executable, err := pluginExecutable(name)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &PluginStorage{name: name, location: location, cmd: exec.Command(executable, location)}
+	p.cmd.Stderr = os.Stderr
+
+	p.stdin, err = p.cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	stdout, err := p.cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	p.stdout = bufio.NewReader(stdout)
+
+	err = p.cmd.Start()
+	if err != nil {
+		return nil, fmt.Errorf("unable to start storage plugin %s: %w", executable, err)
+	}
+
+	resp, err := p.call(storageRequest{Command: "open", Version: PluginProtocolVersion, Location: location, ReadOnly: readOnly})
+	if err != nil {
+		_ = p.stop()
+		return nil, err
+	}
+
+	p.capabilities = make(map[string]bool)
+	for _, capability := range resp.Capabilities {
+		p.capabilities[capability] = true
+	}
+
+	return p, nil
+}
+
+// call sends request to the plugin and reads its response.
+func (p *PluginStorage) call(req storageRequest) (*storageResponse, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.done {
+		return nil, fmt.Errorf("storage plugin %s is already closed", p.name)
+	}
+
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = p.stdin.Write(append(data, '\n'))
+	if err != nil {
+		return nil, fmt.Errorf("unable to send %s request to storage plugin %s: %w", req.Command, p.name, err)
+	}
+
+	line, err := p.stdout.ReadBytes('\n')
+	if errors.Is(err, io.EOF) && len(bytes.TrimSpace(line)) == 0 {
+		return nil, fmt.Errorf("storage plugin %s exited without response to %s request", p.name, req.Command)
+	}
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("unable to read response of storage plugin %s: %w", p.name, err)
+	}
+
+	var resp storageResponse
+	err = json.Unmarshal(line, &resp)
+	if err != nil {
+		return nil, fmt.Errorf("invalid response of storage plugin %s to %s request: %w", p.name, req.Command, err)
+	}
+
+	if resp.Error != "" {
+		return nil, fmt.Errorf("storage plugin %s: %s", p.name, resp.Error)
+	}
+
+	return &resp, nil
+}
+
+// GetAccountNames returns names of accounts having chat logs.
+func (p *PluginStorage) GetAccountNames() ([]string, error) {
+	resp, err := p.call(storageRequest{Command: "get_account_names"})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.AccountNames, nil
+}
+
+// ListChatLogFileNames returns chat logs of the account.
+func (p *PluginStorage) ListChatLogFileNames(accountName string) (absolutePaths []string, relativePaths []string, err error) {
+	resp, err := p.call(storageRequest{Command: "list_chat_logs", AccountName: accountName})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, fileName := range resp.FileNames {
+		absolutePaths = append(absolutePaths, path.Join(accountName, fileName))
+		relativePaths = append(relativePaths, fileName)
+	}
+
+	return
+}
+
+// ReadChatLog reads chat log of the account, it's sent by the plugin as text of chat log file.
+func (p *PluginStorage) ReadChatLog(accountName string, fileName string) (Messages, error) {
+	resp, err := p.call(storageRequest{Command: "read_chat_log", AccountName: accountName, FileName: fileName})
+	if err != nil || resp.ChatLog == nil {
+		return nil, err
+	}
+
+	messages, err := ReadMessages(strings.NewReader(*resp.ChatLog))
+	if err != nil {
+		return messages, fmt.Errorf("unable to read chat log %s/%s: %w", accountName, fileName, err)
+	}
+
+	return messages, nil
+}
+
+// WriteChatLog sends chat log of the account to the plugin as text of chat log file.
+func (p *PluginStorage) WriteChatLog(accountName string, fileName string, messages Messages) error {
+	var buf bytes.Buffer
+	err := messages.Write(&buf)
+	if err != nil {
+		return fmt.Errorf("error writing file %s/%s: %w", accountName, fileName, err)
+	}
+
+	chatLog := buf.String()
+
+	_, err = p.call(storageRequest{Command: "write_chat_log", AccountName: accountName, FileName: fileName, ChatLog: &chatLog})
+
+	return err
+}
+
+// KeepsUnwritten returns true, the plugin is expected to keep chat logs which are not written.
+func (p *PluginStorage) KeepsUnwritten() bool {
+	return true
+}
+
+// LockedAccounts returns nothing, encryption is up to the plugin.
+func (p *PluginStorage) LockedAccounts() []string {
+	return nil
+}
+
+// ReadContacts reads contacts index of the account, if the plugin stores them.
+func (p *PluginStorage) ReadContacts(accountName string) ([]Contact, error) {
+	if !p.capabilities[PluginCapabilityContacts] {
+		return nil, nil
+	}
+
+	resp, err := p.call(storageRequest{Command: "read_contacts", AccountName: accountName})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Contacts, nil
+}
+
+// WriteContacts writes contacts index of the account, if the plugin stores them.
+func (p *PluginStorage) WriteContacts(accountName string, contacts []Contact) error {
+	if !p.capabilities[PluginCapabilityContacts] {
+		return nil
+	}
+
+	_, err := p.call(storageRequest{Command: "write_contacts", AccountName: accountName, Contacts: contacts})
+
+	return err
+}
+
+// Close asks the plugin to commit written chat logs, and waits for it to exit.
+func (p *PluginStorage) Close() error {
+	_, err := p.call(storageRequest{Command: "close"})
+
+	waitErr := p.stop()
+	if err == nil && waitErr != nil {
+		err = fmt.Errorf("storage plugin %s failed: %w", p.name, waitErr)
+	}
+
+	return err
+}
+
+// Abort asks the plugin to discard written chat logs, and waits for it to exit.
+func (p *PluginStorage) Abort() {
+	_, _ = p.call(storageRequest{Command: "abort"})
+	_ = p.stop()
+}
+
+// stop closes stdin of the plugin, so it exits, and waits for it.
+func (p *PluginStorage) stop() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.done {
+		return nil
+	}
+	p.done = true
+
+	_ = p.stdin.Close()
+
+	return p.cmd.Wait()
+}
+
+func (p *PluginStorage) String() string {
+	return fmt.Sprintf("%s:%s:%s", ArchiveKindPlugin, p.name, p.location)
+}
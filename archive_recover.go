@@ -0,0 +1,445 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	zipLocalHeaderSignature    = "PK\x03\x04"
+	zipDataDescriptorSignature = "PK\x07\x08"
+	zipLocalHeaderLength       = 30
+	zipDataDescriptorLength    = 16
+	// zipFlagDataDescriptor is set if sizes and CRC-32 of the entry follow its data.
+	zipFlagDataDescriptor = 0x8
+)
+
+// SalvageReport describes what was salvaged from the damaged archive.
+type SalvageReport struct {
+	// Salvaged are entries which were read successfully.
+	Salvaged []string
+	// Damaged are entries which were found, but can't be read.
+	Damaged []string
+	// Lost are entries of the previous version of the archive, which were not found.
+	Lost []string
+	// PreviousVersion is file name of the previous version of the archive, which Lost are taken from.
+	PreviousVersion string
+}
+
+// salvagedEntry is archive entry read from its local file header.
+type salvagedEntry struct {
+	header zip.FileHeader
+	raw    []byte
+}
+
+// IsArchiveDamaged returns true if the archive can't be opened, or any of its entries can't be read.
+// Missing archive is not damaged.
+func IsArchiveDamaged(fileName string) bool {
+	r, err := zip.OpenReader(fileName)
+	if errors.Is(err, os.ErrNotExist) {
+		return false
+	}
+	if err != nil {
+		return true
+	}
+	defer r.Close()
+
+	for _, f := range r.File {
+		rc, err := f.Open()
+		if err != nil {
+			return true
+		}
+
+		// Reader checks CRC-32 of the entry when it's read till the end.
+		_, err = io.Copy(io.Discard, rc)
+		rc.Close()
+		if err != nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// RecoverArchive salvages readable entries of the damaged archive, and replaces the archive with them.
+// Damaged archive is kept aside as "<archive>.damaged-<time>.zip".
+func RecoverArchive(fileName string) error {
+	if !IsArchiveDamaged(fileName) {
+		return nil
+	}
+
+	fmt.Printf("%s is damaged, salvaging readable chat logs...\n", fileName)
+
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return fmt.Errorf("unable to read %s: %w", fileName, err)
+	}
+
+	entries, damaged := scanLocalEntries(data)
+
+	if len(entries) == 0 {
+		return fmt.Errorf("nothing can be salvaged from %s", fileName)
+	}
+
+	report := SalvageReport{Damaged: damaged}
+	for _, entry := range entries {
+		report.Salvaged = append(report.Salvaged, entry.header.Name)
+	}
+
+	report.PreviousVersion, report.Lost = findLostEntries(fileName, append(report.Salvaged, report.Damaged...))
+
+	// Encrypted entries can't be read without encryption header, it's taken from the previous version if it's lost.
+	encryptionHeaderName := strings.Join([]string{ArchiveMetadataDirectory, encryptionMetadataName}, "/")
+	if !Contains(report.Salvaged, encryptionHeaderName) {
+		for _, entry := range entries {
+			if entry.header.Method != zip.Store {
+				continue
+			}
+
+			header, err := readPreviousEntry(report.PreviousVersion, encryptionHeaderName)
+			if err != nil || header == nil {
+				return fmt.Errorf("encryption header of %s is lost, so its chat logs can't be decrypted, restore previous version with rollback command", fileName)
+			}
+
+			fmt.Printf("Encryption header of %s is lost, it's taken from %s\n", fileName, report.PreviousVersion)
+
+			entries = append([]salvagedEntry{*header}, entries...)
+			report.Lost = Subtract(report.Lost, []string{encryptionHeaderName})
+			break
+		}
+	}
+
+	salvagedFileName, err := writeSalvagedArchive(fileName, entries)
+	if err != nil {
+		return err
+	}
+
+	// Damaged archive is kept on this device only, next to previous versions of the archive, so it's not uploaded by cloud sync client.
+	historyDirectory, err := HistoryDirectory(fileName)
+	if err == nil {
+		err = os.MkdirAll(historyDirectory, 0755)
+	}
+	if err != nil {
+		_ = os.Remove(salvagedFileName)
+		return err
+	}
+
+	damagedFileName := filepath.Join(historyDirectory, "damaged-"+time.Now().Format("20060102-150405")+filepath.Ext(fileName))
+
+	err = CopyFile(fileName, damagedFileName)
+	if err != nil {
+		_ = os.Remove(damagedFileName)
+		_ = os.Remove(salvagedFileName)
+		return fmt.Errorf("unable to keep damaged %s in %s: %w", fileName, historyDirectory, err)
+	}
+
+	err = MoveFile(salvagedFileName, fileName)
+	if err != nil {
+		return fmt.Errorf("error overwriting file %s with %s: %w", fileName, salvagedFileName, err)
+	}
+
+	report.Print(os.Stdout)
+	fmt.Printf("Damaged archive is kept in %s\n", damagedFileName)
+
+	return nil
+}
+
+// Print prints the report.
+func (r SalvageReport) Print(w io.Writer) {
+	fmt.Fprintf(w, "%d files salvaged\n", len(r.Salvaged))
+
+	if len(r.Damaged) != 0 {
+		fmt.Fprintf(w, "%d files are damaged and can't be read:\n", len(r.Damaged))
+		for _, name := range r.Damaged {
+			fmt.Fprintf(w, " - %s\n", name)
+		}
+	}
+
+	if len(r.Lost) != 0 {
+		fmt.Fprintf(w, "%d files of previous version %s are lost:\n", len(r.Lost), r.PreviousVersion)
+		for _, name := range r.Lost {
+			fmt.Fprintf(w, " - %s\n", name)
+		}
+	} else if r.PreviousVersion == "" {
+		fmt.Fprintf(w, "There's no previous version of the archive to find out which files are lost\n")
+	}
+}
+
+// findLostEntries returns entries of the latest previous version of the archive, which are not found.
+func findLostEntries(fileName string, found []string) (previousVersion string, lost []string) {
+	snapshots, err := ListSnapshots(fileName)
+	if err != nil || len(snapshots) == 0 {
+		return "", nil
+	}
+
+	r, err := zip.OpenReader(snapshots[0].FileName)
+	if err != nil {
+		return "", nil
+	}
+	defer r.Close()
+
+	for _, f := range r.File {
+		if !Contains(found, f.Name) {
+			lost = append(lost, f.Name)
+		}
+	}
+
+	sort.Strings(lost)
+
+	return snapshots[0].FileName, lost
+}
+
+// readPreviousEntry reads raw entry of the previous version of the archive.
+// Returns nil if there's no previous version or no such entry.
+func readPreviousEntry(previousVersion string, name string) (*salvagedEntry, error) {
+	if previousVersion == "" {
+		return nil, nil
+	}
+
+	r, err := zip.OpenReader(previousVersion)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	for _, f := range r.File {
+		if f.Name != name {
+			continue
+		}
+
+		rc, err := f.OpenRaw()
+		if err != nil {
+			return nil, err
+		}
+
+		raw, err := io.ReadAll(rc)
+		if err != nil {
+			return nil, err
+		}
+
+		return &salvagedEntry{header: f.FileHeader, raw: raw}, nil
+	}
+
+	return nil, nil
+}
+
+// scanLocalEntries reads entries by their local file headers, so they're read even if central directory is lost.
+// Returns names of entries which were found, but can't be read.
+func scanLocalEntries(data []byte) (entries []salvagedEntry, damaged []string) {
+	names := make(map[string]bool)
+
+	for offset := 0; ; {
+		index := bytes.Index(data[offset:], []byte(zipLocalHeaderSignature))
+		if index < 0 || offset+index+zipLocalHeaderLength > len(data) {
+			break
+		}
+
+		offset += index
+
+		entry, end, name, ok := readLocalEntry(data, offset)
+		if !ok {
+			// Signature may be found inside of damaged data, so names of garbage entries are skipped.
+			if name != "" && utf8.ValidString(name) && strings.IndexFunc(name, unicode.IsControl) < 0 {
+				damaged = append(damaged, name)
+			}
+
+			offset += len(zipLocalHeaderSignature)
+			continue
+		}
+
+		if !names[entry.header.Name] {
+			names[entry.header.Name] = true
+			entries = append(entries, entry)
+		}
+
+		offset = end
+	}
+
+	// Entry can be damaged in one place and read in another.
+	var stillDamaged []string
+	for _, name := range Unique(damaged) {
+		if !names[name] {
+			stillDamaged = append(stillDamaged, name)
+		}
+	}
+
+	sort.Strings(stillDamaged)
+
+	return entries, stillDamaged
+}
+
+// readLocalEntry reads entry starting with local file header at the offset, and checks its CRC-32.
+// Returns offset after the entry data.
+func readLocalEntry(data []byte, offset int) (entry salvagedEntry, end int, name string, ok bool) {
+	header := data[offset : offset+zipLocalHeaderLength]
+
+	flags := binary.LittleEndian.Uint16(header[6:])
+	method := binary.LittleEndian.Uint16(header[8:])
+	modifiedTime := binary.LittleEndian.Uint16(header[10:])
+	modifiedDate := binary.LittleEndian.Uint16(header[12:])
+	crc := binary.LittleEndian.Uint32(header[14:])
+	compressedSize := int(binary.LittleEndian.Uint32(header[18:]))
+	uncompressedSize := int(binary.LittleEndian.Uint32(header[22:]))
+	nameLength := int(binary.LittleEndian.Uint16(header[26:]))
+	extraLength := int(binary.LittleEndian.Uint16(header[28:]))
+
+	nameStart := offset + zipLocalHeaderLength
+	dataStart := nameStart + nameLength + extraLength
+	if dataStart > len(data) {
+		return entry, 0, "", false
+	}
+
+	name = string(data[nameStart : nameStart+nameLength])
+
+	var raw, plain []byte
+	var err error
+
+	switch {
+	case flags&zipFlagDataDescriptor == 0:
+		if dataStart+compressedSize > len(data) {
+			return entry, 0, name, false
+		}
+
+		raw = data[dataStart : dataStart+compressedSize]
+		plain, err = decompressEntry(method, raw)
+		end = dataStart + compressedSize
+
+	case method == zip.Deflate:
+		// Compressed data ends by itself, data descriptor follows it.
+		r := bytes.NewReader(data[dataStart:])
+		plain, err = io.ReadAll(flate.NewReader(r))
+
+		raw = data[dataStart : len(data)-r.Len()]
+		end, crc, uncompressedSize, ok = readDataDescriptor(data, len(data)-r.Len(), len(raw))
+		if !ok {
+			return entry, 0, name, false
+		}
+
+	case method == zip.Store:
+		// Stored data has no end, so it ends where valid data descriptor is found.
+		for position := dataStart; ; position++ {
+			index := bytes.Index(data[position:], []byte(zipDataDescriptorSignature))
+			if index < 0 {
+				return entry, 0, name, false
+			}
+
+			position += index
+			raw = data[dataStart:position]
+
+			end, crc, uncompressedSize, ok = readDataDescriptor(data, position, len(raw))
+			if ok && crc32.ChecksumIEEE(raw) == crc {
+				plain = raw
+				break
+			}
+		}
+
+	default:
+		return entry, 0, name, false
+	}
+
+	if err != nil || len(plain) != uncompressedSize || crc32.ChecksumIEEE(plain) != crc {
+		return entry, 0, name, false
+	}
+
+	entry = salvagedEntry{
+		header: zip.FileHeader{
+			Name:               name,
+			Method:             method,
+			Modified:           msDosTimeToTime(modifiedDate, modifiedTime),
+			CRC32:              crc,
+			CompressedSize64:   uint64(len(raw)),
+			UncompressedSize64: uint64(len(plain)),
+		},
+		raw: raw,
+	}
+
+	return entry, end, name, true
+}
+
+// readDataDescriptor reads data descriptor at the offset, and checks that it describes data of the compressed size.
+func readDataDescriptor(data []byte, offset int, compressedSize int) (end int, crc uint32, uncompressedSize int, ok bool) {
+	if offset+zipDataDescriptorLength > len(data) || string(data[offset:offset+4]) != zipDataDescriptorSignature {
+		return 0, 0, 0, false
+	}
+
+	descriptor := data[offset+4 : offset+zipDataDescriptorLength]
+	if int(binary.LittleEndian.Uint32(descriptor[4:])) != compressedSize {
+		return 0, 0, 0, false
+	}
+
+	return offset + zipDataDescriptorLength, binary.LittleEndian.Uint32(descriptor), int(binary.LittleEndian.Uint32(descriptor[8:])), true
+}
+
+// decompressEntry decompresses entry data.
+func decompressEntry(method uint16, raw []byte) ([]byte, error) {
+	switch method {
+	case zip.Store:
+		return raw, nil
+	case zip.Deflate:
+		return io.ReadAll(flate.NewReader(bytes.NewReader(raw)))
+	}
+
+	return nil, zip.ErrAlgorithm
+}
+
+// msDosTimeToTime converts MS-DOS date and time of zip entry into time.
+func msDosTimeToTime(dosDate uint16, dosTime uint16) time.Time {
+	return time.Date(
+		int(dosDate>>9+1980),
+		time.Month(dosDate>>5&0xf),
+		int(dosDate&0x1f),
+		int(dosTime>>11),
+		int(dosTime>>5&0x3f),
+		int(dosTime&0x1f*2),
+		0,
+		time.UTC,
+	)
+}
+
+// writeSalvagedArchive writes salvaged entries as is into new temp archive.
+func writeSalvagedArchive(fileName string, entries []salvagedEntry) (string, error) {
+	wf, err := os.CreateTemp(os.TempDir(), filepath.Base(fileName)+".*")
+	if err != nil {
+		return "", err
+	}
+
+	w := zip.NewWriter(wf)
+
+	for _, entry := range entries {
+		header := entry.header
+
+		f, err := w.CreateRaw(&header)
+		if err == nil {
+			_, err = f.Write(entry.raw)
+		}
+		if err != nil {
+			wf.Close()
+			_ = os.Remove(wf.Name())
+			return "", fmt.Errorf("error writing file %s into %s: %w", entry.header.Name, wf.Name(), err)
+		}
+	}
+
+	err = w.Close()
+	if err == nil {
+		err = wf.Close()
+	}
+	if err != nil {
+		_ = os.Remove(wf.Name())
+		return "", fmt.Errorf("error writing file %s: %w", wf.Name(), err)
+	}
+
+	return wf.Name(), nil
+}
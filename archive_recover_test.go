@@ -0,0 +1,133 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// zipEntries returns zip archive with the entries in order, stored ones are not compressed.
+func zipEntries(t *testing.T, entries [][2]string, stored map[string]bool) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+
+	for _, entry := range entries {
+		header := &zip.FileHeader{Name: entry[0], Method: zip.Deflate}
+		if stored[entry[0]] {
+			header.Method = zip.Store
+		}
+
+		f, err := w.CreateHeader(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = f.Write([]byte(entry[1]))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestScanLocalEntries(t *testing.T) {
+	data := zipEntries(t, [][2]string{
+		{"alice/bob.txt", "[2023/06/30 12:00]  Bob: hi alice\n"},
+		{"alice/carol.txt", "[2023/06/30 12:00]  Carol: damaged message\n"},
+		{"alice/dave.txt", "[2023/06/30 12:00]  Dave: hi alice\n"},
+	}, map[string]bool{"alice/carol.txt": true})
+
+	// Central directory is lost, and data of one entry is damaged.
+	data = data[:bytes.Index(data, []byte("PK\x01\x02"))]
+	data[bytes.Index(data, []byte("damaged message"))] = 'X'
+
+	entries, damaged := scanLocalEntries(data)
+
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.header.Name)
+	}
+
+	if strings.Join(names, ",") != "alice/bob.txt,alice/dave.txt" {
+		t.Errorf("salvaged entries are %v", names)
+	}
+
+	if strings.Join(damaged, ",") != "alice/carol.txt" {
+		t.Errorf("damaged entries are %v", damaged)
+	}
+}
+
+func TestRecoverArchive(t *testing.T) {
+	root := *HistoryRoot
+	*HistoryRoot = t.TempDir()
+	defer func() { *HistoryRoot = root }()
+
+	directory := t.TempDir()
+	fileName := filepath.Join(directory, "sl_chat_logs.zip")
+
+	data := zipEntries(t, [][2]string{
+		{"alice/bob.txt", "[2023/06/30 12:00]  Bob: hi alice\n"},
+		{"alice/dave.txt", "[2023/06/30 12:00]  Dave: hi alice\n"},
+	}, nil)
+
+	// Upload of the archive is interrupted.
+	err := os.WriteFile(fileName, data[:len(data)-10], 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !IsArchiveDamaged(fileName) {
+		t.Fatal("truncated archive is not damaged")
+	}
+
+	err = RecoverArchive(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if IsArchiveDamaged(fileName) {
+		t.Error("recovered archive is damaged")
+	}
+
+	archive, err := OpenChatLogsArchive(fileName, ArchiveOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archive.Close()
+
+	for _, chatLog := range []string{"bob.txt", "dave.txt"} {
+		messages, err := archive.ReadChatLog("alice", chatLog)
+		if err != nil || len(messages) != 1 {
+			t.Errorf("%s is recovered with %d messages (%v)", chatLog, len(messages), err)
+		}
+	}
+
+	historyDirectory, err := HistoryDirectory(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	damaged, err := filepath.Glob(filepath.Join(historyDirectory, "damaged-*.zip"))
+	if err != nil || len(damaged) != 1 {
+		t.Errorf("damaged archive is not kept in history: %v (%v)", damaged, err)
+	}
+
+	// Damaged archive is not left in the cloud folder, and it's not listed as previous version.
+	assertNoTempFiles(t, fileName)
+
+	snapshots, err := ListSnapshots(fileName)
+	if err != nil || len(snapshots) != 0 {
+		t.Errorf("damaged archive is listed as previous version: %+v (%v)", snapshots, err)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// RemoteArchive is .zip archive stored in remote file system.
+// It's downloaded into temp directory, and uploaded back on close if it's changed.
+// If remote archive is changed by another device meanwhile, it's downloaded again and merged.
+type RemoteArchive struct {
+	*ChatLogsArchive
+	files   ArchiveFiles
+	name    string
+	options ArchiveOptions
+
+	// data and version are content and version of the downloaded archive.
+	data    []byte
+	version string
+	// directory is temp directory of the downloaded archive.
+	directory string
+	readOnly  bool
+}
+
+// ReadRemoteArchive downloads remote archive and opens it for reading and writing.
+func ReadRemoteArchive(files ArchiveFiles, name string, options ArchiveOptions) (*RemoteArchive, error) {
+	// History is not kept for temp file, and unchanged archive is not uploaded.
+	options.KeepGenerations = 0
+	options.SkipUnchanged = true
+
+	return openRemoteArchive(files, name, options, false)
+}
+
+// OpenRemoteArchive downloads remote archive and opens it for reading only.
+func OpenRemoteArchive(files ArchiveFiles, name string, options ArchiveOptions) (*RemoteArchive, error) {
+	return openRemoteArchive(files, name, options, true)
+}
+
+func openRemoteArchive(files ArchiveFiles, name string, options ArchiveOptions, readOnly bool) (*RemoteArchive, error) {
+	r := &RemoteArchive{files: files, name: name, options: options, readOnly: readOnly}
+
+	err := r.download()
+	if err != nil {
+		return nil, err
+	}
+
+	if readOnly {
+		r.ChatLogsArchive, err = OpenChatLogsArchive(r.localFileName(), options)
+	} else {
+		r.ChatLogsArchive, err = ReadChatLogsArchive(r.localFileName(), options)
+	}
+	if err != nil {
+		_ = os.RemoveAll(r.directory)
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *RemoteArchive) localFileName() string {
+	return filepath.Join(r.directory, path.Base(r.name))
+}
+
+// download downloads remote archive into new temp directory.
+func (r *RemoteArchive) download() error {
+	data, version, err := r.files.Read(r.name)
+	if err != nil {
+		return fmt.Errorf("unable to download %s from %s: %w", r.name, r.files, err)
+	}
+
+	r.directory, err = os.MkdirTemp("", "sl-chat-log-sync-*")
+	if err != nil {
+		return err
+	}
+
+	r.data = data
+	r.version = version
+
+	if data != nil {
+		err = os.WriteFile(r.localFileName(), data, 0600)
+		if err != nil {
+			_ = os.RemoveAll(r.directory)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Close writes the archive, and uploads it if it's changed.
+func (r *RemoteArchive) Close() error {
+	defer func() {
+		_ = os.RemoveAll(r.directory)
+		closeArchiveFiles(r.files)
+	}()
+
+	err := r.ChatLogsArchive.Close()
+	if err != nil || r.readOnly {
+		return err
+	}
+
+	fileName := r.localFileName()
+
+	for attempt := 1; ; attempt++ {
+		data, err := os.ReadFile(fileName)
+		if err != nil {
+			return err
+		}
+
+		if r.data != nil && bytes.Equal(data, r.data) {
+			return nil
+		}
+
+		err = r.files.Write(r.name, data, r.version)
+		if err == nil {
+			return nil
+		}
+
+		if !errors.Is(err, ErrVersionMismatch) {
+			return fmt.Errorf("unable to upload %s into %s: %w", r.name, r.files, err)
+		}
+
+		if attempt > maxArchiveMergeAttempts {
+			return fmt.Errorf("%s keeps changing by other devices: %w", r.name, err)
+		}
+
+		fmt.Printf("%s was changed by another device, merging with it...\n", r.name)
+
+		// Written archive is kept aside, and merged into the changed one.
+		writtenFileName := fileName + ".written"
+		err = os.Rename(fileName, writtenFileName)
+		if err != nil {
+			return err
+		}
+
+		previousDirectory := r.directory
+
+		err = r.download()
+		if err != nil {
+			return err
+		}
+		fileName = r.localFileName()
+
+		err = os.Rename(writtenFileName, filepath.Join(r.directory, filepath.Base(writtenFileName)))
+		_ = os.RemoveAll(previousDirectory)
+		if err != nil {
+			return err
+		}
+
+		err = mergeChangedArchive(fileName, filepath.Join(r.directory, filepath.Base(writtenFileName)), r.options, attempt)
+		if err != nil {
+			return fmt.Errorf("error merging with changed %s: %w", r.name, err)
+		}
+	}
+}
+
+// Abort removes the downloaded archive, remote archive is left untouched.
+func (r *RemoteArchive) Abort() {
+	r.ChatLogsArchive.Abort()
+	_ = os.RemoveAll(r.directory)
+	closeArchiveFiles(r.files)
+}
+
+func (r *RemoteArchive) String() string {
+	return fmt.Sprintf("%s/%s", r.files, r.name)
+}
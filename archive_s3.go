@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3 endpoint, region and credentials are taken from environment variables.
+// Endpoint of S3-compatible storage is set by SL_CHAT_LOGS_S3_ENDPOINT (e.g. "http://localhost:9000" for MinIO),
+// otherwise Amazon S3 of the region is used.
+const (
+	S3EndpointEnvironmentVariable = "SL_CHAT_LOGS_S3_ENDPOINT"
+	s3DefaultRegion               = "us-east-1"
+)
+
+// S3Files is bucket of S3-compatible object storage holding the archive under the prefix, one object per file.
+// Versions of objects are their ETags, and objects are written with "If-Match" or "If-None-Match" conditions.
+// Requests are signed with AWS Signature Version 4, path-style addressing is used.
+type S3Files struct {
+	endpoint     *url.URL
+	region       string
+	bucket       string
+	prefix       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	client       *http.Client
+}
+
+// NewS3Files returns S3 bucket by location "<bucket>/<prefix>", e.g. "team-chat-logs/alice".
+func NewS3Files(location string) (*S3Files, error) {
+	bucket, prefix, _ := strings.Cut(strings.Trim(location, "/"), "/")
+	if bucket == "" {
+		return nil, fmt.Errorf("invalid S3 location %s: bucket name expected", location)
+	}
+
+	s := &S3Files{
+		region:       os.Getenv("AWS_REGION"),
+		bucket:       bucket,
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		client:       &http.Client{Timeout: 5 * time.Minute},
+	}
+
+	if prefix != "" {
+		s.prefix = strings.TrimSuffix(prefix, "/") + "/"
+	}
+
+	if s.region == "" {
+		s.region = s3DefaultRegion
+	}
+
+	if s.accessKey == "" || s.secretKey == "" {
+		return nil, fmt.Errorf("S3 credentials are not set, set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables")
+	}
+
+	endpoint := os.Getenv(S3EndpointEnvironmentVariable)
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", s.region)
+	}
+
+	var err error
+	s.endpoint, err = url.Parse(strings.TrimSuffix(endpoint, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid S3 endpoint %s: %w", endpoint, err)
+	}
+
+	return s, nil
+}
+
+// NewS3Storage returns archive storage keeping chat logs in S3 bucket, one object per conversation.
+func NewS3Storage(location string) (*FileArchive, error) {
+	files, err := NewS3Files(location)
+	if err != nil {
+		return nil, err
+	}
+
+	return OpenFileArchive(files)
+}
+
+// objectPath returns path of the object, or of the bucket if key is empty.
+func (s *S3Files) objectPath(key string) string {
+	if key == "" {
+		return s.endpoint.Path + "/" + s.bucket
+	}
+
+	return s.endpoint.Path + "/" + s.bucket + "/" + key
+}
+
+func (s *S3Files) do(method string, key string, query url.Values, body []byte, header http.Header) (*http.Response, error) {
+	target := *s.endpoint
+	target.Path = s.objectPath(key)
+	target.RawPath = s3EscapePath(target.Path)
+	target.RawQuery = s3CanonicalQuery(query)
+
+	req, err := http.NewRequest(method, target.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	s.sign(req, body, time.Now())
+
+	return s.client.Do(req)
+}
+
+// sign signs the request with AWS Signature Version 4, all headers of the request are signed.
+func (s *S3Files) sign(req *http.Request, body []byte, now time.Time) {
+	payloadHash := sha256.Sum256(body)
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for key, values := range req.Header {
+		headers[strings.ToLower(key)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalRequestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Escape escapes the string as required by AWS Signature Version 4: everything except unreserved characters.
+func s3Escape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '.', c == '_', c == '~':
+			b.WriteByte(c)
+		case c == '/' && keepSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
+
+func s3EscapePath(p string) string {
+	return s3Escape(p, true)
+}
+
+// s3CanonicalQuery encodes query parameters sorted by name.
+func s3CanonicalQuery(query url.Values) string {
+	var parts []string
+	for name, values := range query {
+		for _, value := range values {
+			parts = append(parts, s3Escape(name, false)+"="+s3Escape(value, false))
+		}
+	}
+	sort.Strings(parts)
+
+	return strings.Join(parts, "&")
+}
+
+// s3Error reads error response of S3.
+func s3Error(operation string, resp *http.Response) error {
+	var result struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+
+	data, _ := io.ReadAll(resp.Body)
+	if xml.Unmarshal(data, &result) == nil && result.Code != "" {
+		return fmt.Errorf("%s: %s: %s (%s)", operation, resp.Status, result.Message, result.Code)
+	}
+
+	return fmt.Errorf("%s: %s", operation, resp.Status)
+}
+
+// List returns paths of all objects under the prefix.
+func (s *S3Files) List() ([]string, error) {
+	var names []string
+	var continuationToken string
+
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {s.prefix}}
+		if continuationToken != "" {
+			query.Set("continuation-token", continuationToken)
+		}
+
+		resp, err := s.do(http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			err = s3Error("ListObjectsV2 "+s.bucket, resp)
+			resp.Body.Close()
+			return nil, err
+		}
+
+		var result struct {
+			Contents []struct {
+				Key string `xml:"Key"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("ListObjectsV2 %s: %w", s.bucket, err)
+		}
+
+		for _, object := range result.Contents {
+			if !strings.HasSuffix(object.Key, "/") {
+				names = append(names, strings.TrimPrefix(object.Key, s.prefix))
+			}
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return names, nil
+		}
+
+		continuationToken = result.NextContinuationToken
+	}
+}
+
+// Read downloads the object, its version is ETag.
+func (s *S3Files) Read(name string) ([]byte, string, error) {
+	resp, err := s.do(http.MethodGet, s.prefix+name, nil, nil, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, "", nil
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", s3Error("GetObject "+name, resp)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", fmt.Errorf("GetObject %s: %w", name, err)
+	}
+
+	return data, resp.Header.Get("ETag"), nil
+}
+
+// Write uploads the object with "If-Match" or "If-None-Match" condition.
+func (s *S3Files) Write(name string, data []byte, version string) error {
+	header := http.Header{}
+	switch version {
+	case AnyVersion:
+	case "":
+		header.Set("If-None-Match", "*")
+	default:
+		header.Set("If-Match", version)
+	}
+
+	resp, err := s.do(http.MethodPut, s.prefix+name, nil, data, header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	// Conflict is returned if the object is being written by another device at the same time.
+	case http.StatusPreconditionFailed, http.StatusConflict:
+		return ErrVersionMismatch
+	}
+
+	return s3Error("PutObject "+name, resp)
+}
+
+func (s *S3Files) String() string {
+	return "s3://" + s.bucket + "/" + strings.TrimSuffix(s.prefix, "/")
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/term"
+)
+
+// SSH private key and known hosts file are taken from these environment variables,
+// by default keys of SSH agent and "~/.ssh/id_*" are used, and host keys are checked against "~/.ssh/known_hosts".
+const (
+	SSHKeyEnvironmentVariable        = "SL_CHAT_LOGS_SSH_KEY"
+	SSHKnownHostsEnvironmentVariable = "SL_CHAT_LOGS_SSH_KNOWN_HOSTS"
+)
+
+// SFTPFiles is directory on SSH server holding the archive.
+// Version of the file is hash of its content, files are written into temp file first, and then renamed.
+type SFTPFiles struct {
+	conn   *ssh.Client
+	client *sftp.Client
+	root   string
+	target string
+}
+
+// DialSFTP connects to SSH server by URL "sftp://user@host[:port]/path".
+func DialSFTP(rawURL string) (*SFTPFiles, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "sftp" || u.Host == "" {
+		return nil, fmt.Errorf("invalid SFTP URL %s, sftp://user@host/path expected", rawURL)
+	}
+
+	config, err := sshClientConfig(u)
+	if err != nil {
+		return nil, err
+	}
+
+	address := u.Host
+	if u.Port() == "" {
+		address = net.JoinHostPort(u.Hostname(), "22")
+	}
+
+	conn, err := ssh.Dial("tcp", address, config)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to %s: %w", address, err)
+	}
+
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("unable to start SFTP session with %s: %w", address, err)
+	}
+
+	// Path is relative to the home directory, unless it starts with "//".
+	root := strings.TrimPrefix(u.Path, "/")
+	if strings.HasPrefix(root, "/") {
+		root = path.Clean(root)
+	} else if root == "" {
+		root = "."
+	}
+
+	u.User = url.User(config.User)
+
+	return &SFTPFiles{conn: conn, client: client, root: root, target: u.String()}, nil
+}
+
+// sshClientConfig returns SSH client configuration: user, keys of SSH agent and private key files, and known hosts.
+func sshClientConfig(u *url.URL) (*ssh.ClientConfig, error) {
+	home, _ := os.UserHomeDir()
+
+	knownHostsFileName := os.Getenv(SSHKnownHostsEnvironmentVariable)
+	if knownHostsFileName == "" {
+		knownHostsFileName = filepath.Join(home, ".ssh", "known_hosts")
+	}
+
+	hostKeyCallback, err := knownhosts.New(knownHostsFileName)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read known hosts %s, connect to the server with ssh first: %w", knownHostsFileName, err)
+	}
+
+	var signers []ssh.Signer
+
+	if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" {
+		if conn, err := net.Dial("unix", socket); err == nil {
+			agentSigners, err := agent.NewClient(conn).Signers()
+			if err == nil {
+				signers = append(signers, agentSigners...)
+			}
+		}
+	}
+
+	if keyFileName := os.Getenv(SSHKeyEnvironmentVariable); keyFileName != "" {
+		signer, err := readSSHKey(keyFileName, true)
+		if err != nil {
+			return nil, err
+		}
+
+		signers = append(signers, signer)
+	} else {
+		// Default keys are optional: missing and unreadable ones are skipped,
+		// and passphrase of encrypted one is asked only if there are no other keys, e.g. of SSH agent.
+		for _, keyFileName := range []string{
+			filepath.Join(home, ".ssh", "id_ed25519"),
+			filepath.Join(home, ".ssh", "id_ecdsa"),
+			filepath.Join(home, ".ssh", "id_rsa"),
+		} {
+			signer, err := readSSHKey(keyFileName, len(signers) == 0)
+
+			var missing *ssh.PassphraseMissingError
+			if errors.Is(err, os.ErrNotExist) || (errors.As(err, &missing) && len(signers) != 0) {
+				continue
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s, skipping it\n", err)
+				continue
+			}
+
+			signers = append(signers, signer)
+		}
+	}
+
+	if len(signers) == 0 {
+		return nil, fmt.Errorf("no SSH keys found, start SSH agent or set %s environment variable", SSHKeyEnvironmentVariable)
+	}
+
+	user := u.User.Username()
+	if user == "" {
+		user = os.Getenv("USER")
+	}
+
+	return &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signers...)},
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         30 * time.Second,
+	}, nil
+}
+
+// readSSHKey reads private key file. If ask is set, passphrase of encrypted key is asked in terminal.
+func readSSHKey(keyFileName string, ask bool) (ssh.Signer, error) {
+	data, err := os.ReadFile(keyFileName)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := ssh.ParsePrivateKey(data)
+
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) && ask && term.IsTerminal(int(os.Stdin.Fd())) {
+		var p []byte
+		p, err = askPassphrase(fmt.Sprintf("Passphrase of %s: ", keyFileName), false)
+		if err != nil {
+			return nil, err
+		}
+
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(data, p)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("unable to read SSH key %s: %w", keyFileName, err)
+	}
+
+	return signer, nil
+}
+
+// NewSFTPStorage returns archive storage by SFTP URL.
+// URL of .zip file is single archive, otherwise chat logs are stored in the directory as separate files.
+func NewSFTPStorage(rawURL string, options ArchiveOptions, readOnly bool) (ArchiveStorage, error) {
+	if path.Ext(strings.TrimSuffix(rawURL, "/")) == ".zip" {
+		directory, name := path.Split(strings.TrimSuffix(rawURL, "/"))
+
+		files, err := DialSFTP(directory)
+		if err != nil {
+			return nil, err
+		}
+
+		var archive *RemoteArchive
+		if readOnly {
+			archive, err = OpenRemoteArchive(files, name, options)
+		} else {
+			archive, err = ReadRemoteArchive(files, name, options)
+		}
+		if err != nil {
+			_ = files.Close()
+			return nil, err
+		}
+
+		return archive, nil
+	}
+
+	files, err := DialSFTP(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	archive, err := OpenFileArchive(files)
+	if err != nil {
+		_ = files.Close()
+		return nil, err
+	}
+
+	return archive, nil
+}
+
+func (s *SFTPFiles) remotePath(name string) string {
+	return path.Join(s.root, name)
+}
+
+// List returns paths of all files inside of the directory, except for hidden directories.
+func (s *SFTPFiles) List() ([]string, error) {
+	var names []string
+
+	walker := s.client.Walk(s.root)
+	for walker.Step() {
+		err := walker.Err()
+		if errors.Is(err, os.ErrNotExist) && walker.Path() == s.root {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		info := walker.Stat()
+		if info.IsDir() {
+			if walker.Path() != s.root && strings.HasPrefix(info.Name(), ".") && info.Name() != ArchiveMetadataDirectory {
+				walker.SkipDir()
+			}
+			continue
+		}
+
+		name := strings.TrimPrefix(strings.TrimPrefix(walker.Path(), s.root), "/")
+		names = append(names, name)
+	}
+
+	return names, nil
+}
+
+// Read downloads the file.
+func (s *SFTPFiles) Read(name string) ([]byte, string, error) {
+	f, err := s.client.Open(s.remotePath(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+
+	var buf bytes.Buffer
+	_, err = f.WriteTo(&buf)
+	if err != nil {
+		return nil, "", err
+	}
+
+	hash := sha256.Sum256(buf.Bytes())
+
+	return buf.Bytes(), hex.EncodeToString(hash[:]), nil
+}
+
+// Write uploads the file into temp file, and then replaces the file with it, if it's not changed meanwhile.
+// Version check and replacing are not atomic: SFTP has no conditional rename, so file written by another device
+// between them is overwritten. Syncs of the same archive are rare enough for this window to be acceptable,
+// and the chat logs overwritten this way are merged back from that device on its next sync.
+func (s *SFTPFiles) Write(name string, data []byte, version string) error {
+	fileName := s.remotePath(name)
+
+	err := s.client.MkdirAll(path.Dir(fileName))
+	if err != nil {
+		return fmt.Errorf("unable to create directory %s: %w", path.Dir(fileName), err)
+	}
+
+	tempFileName := s.tempFileName(fileName)
+
+	f, err := s.client.OpenFile(tempFileName, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, bytes.NewReader(data))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = s.client.Remove(tempFileName)
+		return err
+	}
+
+	if version != AnyVersion {
+		_, current, err := s.Read(name)
+		if err == nil && current != version {
+			err = ErrVersionMismatch
+		}
+		if err != nil {
+			_ = s.client.Remove(tempFileName)
+			return err
+		}
+	}
+
+	err = s.client.PosixRename(tempFileName, fileName)
+
+	var statusErr *sftp.StatusError
+	if errors.As(err, &statusErr) && statusErr.FxCode() == sftp.ErrSSHFxOpUnsupported {
+		// Server doesn't support atomic replacing.
+		err = s.replace(tempFileName, fileName)
+	}
+	if err != nil {
+		_ = s.client.Remove(tempFileName)
+		return err
+	}
+
+	return nil
+}
+
+// tempFileName returns name of hidden temp file next to the file.
+func (s *SFTPFiles) tempFileName(fileName string) string {
+	return path.Join(path.Dir(fileName), fmt.Sprintf(".%s.%d", path.Base(fileName), time.Now().UnixNano()))
+}
+
+// replace replaces the file with the temp file by plain renames, which fail if the target exists.
+// Old file is moved aside first, and moved back if the temp file can't take its place, so one of them is always there.
+func (s *SFTPFiles) replace(tempFileName string, fileName string) error {
+	oldFileName := s.tempFileName(fileName) + ".old"
+
+	err := s.client.Rename(fileName, oldFileName)
+	if errors.Is(err, os.ErrNotExist) {
+		return s.client.Rename(tempFileName, fileName)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to move %s aside: %w", fileName, err)
+	}
+
+	err = s.client.Rename(tempFileName, fileName)
+	if err != nil {
+		if restoreErr := s.client.Rename(oldFileName, fileName); restoreErr != nil {
+			return fmt.Errorf("unable to replace %s: %w, its previous content is left in %s", fileName, err, oldFileName)
+		}
+
+		return err
+	}
+
+	_ = s.client.Remove(oldFileName)
+
+	return nil
+}
+
+// Close closes SSH connection and SFTP session.
+// Connection is closed first, otherwise SFTP session waits for the server to close it.
+func (s *SFTPFiles) Close() error {
+	err := s.conn.Close()
+	_ = s.client.Close()
+	return err
+}
+
+func (s *SFTPFiles) String() string {
+	return s.target
+}
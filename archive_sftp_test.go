@@ -0,0 +1,257 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// unsupportedPosixRename is SFTP handler of server not supporting "posix-rename@openssh.com" extension.
+type unsupportedPosixRename struct {
+	sftp.FileCmder
+}
+
+func (h unsupportedPosixRename) PosixRename(r *sftp.Request) error {
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+// dialTestSFTP connects to in-process SSH server, its SFTP subsystem is served by serve.
+func dialTestSFTP(t *testing.T, root string, serve func(channel ssh.Channel)) *SFTPFiles {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverConfig := &ssh.ServerConfig{NoClientAuth: true}
+	serverConfig.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		serverSide, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		_, channels, requests, err := ssh.NewServerConn(serverSide, serverConfig)
+		if err != nil {
+			return
+		}
+		go ssh.DiscardRequests(requests)
+
+		for newChannel := range channels {
+			channel, channelRequests, err := newChannel.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				for req := range channelRequests {
+					_ = req.Reply(req.Type == "subsystem" && strings.HasSuffix(string(req.Payload), "sftp"), nil)
+					if req.Type == "subsystem" {
+						go serve(channel)
+					}
+				}
+			}()
+		}
+	}()
+
+	sshClient, err := ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{
+		User:            "test",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := sftp.NewClient(sshClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := &SFTPFiles{conn: sshClient, client: client, root: root, target: "sftp://test@test" + root}
+	t.Cleanup(func() { _ = files.Close() })
+
+	return files
+}
+
+func serveSFTP(channel ssh.Channel) {
+	server, err := sftp.NewServer(channel)
+	if err != nil {
+		return
+	}
+	_ = server.Serve()
+	_ = server.Close()
+}
+
+func testSFTPFiles(t *testing.T, files *SFTPFiles) {
+	data, version, err := files.Read("alice/bob.txt")
+	if err != nil || data != nil || version != "" {
+		t.Fatalf("missing file is read as %q, version %q (%v)", data, version, err)
+	}
+
+	err = files.Write("alice/bob.txt", []byte("hi\n"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = files.Write("alice/bob.txt", []byte("hello\n"), "")
+	if err != ErrVersionMismatch {
+		t.Errorf("existing file is overwritten as new one: %v", err)
+	}
+
+	data, version, err = files.Read("alice/bob.txt")
+	if err != nil || string(data) != "hi\n" {
+		t.Fatalf("file is read as %q (%v)", data, err)
+	}
+
+	err = files.Write("alice/bob.txt", []byte("hello\n"), version)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = files.Write("alice/bob.txt", []byte("hey\n"), version)
+	if err != ErrVersionMismatch {
+		t.Errorf("file changed since it was read is overwritten: %v", err)
+	}
+
+	data, _, err = files.Read("alice/bob.txt")
+	if err != nil || string(data) != "hello\n" {
+		t.Errorf("file is read as %q (%v)", data, err)
+	}
+
+	// Temp files and files moved aside are removed.
+	names, err := files.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(names, ",") != "alice/bob.txt" {
+		t.Errorf("files are %v", names)
+	}
+}
+
+func TestSFTPFiles(t *testing.T) {
+	root := t.TempDir()
+	files := dialTestSFTP(t, filepath.ToSlash(root), serveSFTP)
+
+	testSFTPFiles(t, files)
+
+	data, err := os.ReadFile(filepath.Join(root, "alice", "bob.txt"))
+	if err != nil || string(data) != "hello\n" {
+		t.Errorf("file is written as %q (%v)", data, err)
+	}
+}
+
+func TestSFTPFilesWithoutPosixRename(t *testing.T) {
+	handlers := sftp.InMemHandler()
+	handlers.FileCmd = unsupportedPosixRename{handlers.FileCmd}
+
+	files := dialTestSFTP(t, "/archive", func(channel ssh.Channel) {
+		server := sftp.NewRequestServer(channel, handlers)
+		_ = server.Serve()
+		_ = server.Close()
+	})
+
+	testSFTPFiles(t, files)
+}
+
+func TestSSHClientConfigSkipsEncryptedDefaultKey(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv(SSHKeyEnvironmentVariable, "")
+
+	knownHostsFileName := filepath.Join(home, "known_hosts")
+	err := os.WriteFile(knownHostsFileName, nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(SSHKnownHostsEnvironmentVariable, knownHostsFileName)
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block, err := ssh.MarshalPrivateKeyWithPassphrase(key, "", []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyFileName := filepath.Join(home, ".ssh", "id_ed25519")
+	err = os.MkdirAll(filepath.Dir(keyFileName), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(keyFileName, pem.EncodeToMemory(block), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyring := agent.NewKeyring()
+	err = keyring.Add(agent.AddedKey{PrivateKey: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	socket := filepath.Join(home, "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_ = agent.ServeAgent(keyring, conn)
+				_ = conn.Close()
+			}()
+		}
+	}()
+
+	u := &url.URL{Scheme: "sftp", User: url.User("alice"), Host: "example.com"}
+
+	// Passphrase of the default key is not asked, key of SSH agent is used.
+	t.Setenv("SSH_AUTH_SOCK", socket)
+	_, err = sshClientConfig(u)
+	if err != nil {
+		t.Errorf("encrypted default key is not skipped: %v", err)
+	}
+
+	// Explicitly set key must be readable.
+	t.Setenv(SSHKeyEnvironmentVariable, keyFileName)
+	_, err = sshClientConfig(u)
+	if err == nil {
+		t.Errorf("encrypted key is read without passphrase")
+	}
+
+	t.Setenv(SSHKeyEnvironmentVariable, "")
+	t.Setenv("SSH_AUTH_SOCK", "")
+	_, err = sshClientConfig(u)
+	if err == nil {
+		t.Errorf("config without keys is returned")
+	}
+}
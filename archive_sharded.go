@@ -0,0 +1,411 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Layouts of new shards of sharded archive, see -shard-by.
+const (
+	ShardByAccount = "account"
+	ShardByYear    = "year"
+)
+
+const (
+	// shardIndexName is name of the shard containing contacts index of the account sharded by year.
+	shardIndexName = "index"
+	// undatedShardName is name of the year shard containing chat logs without timestamps.
+	undatedShardName = "undated"
+)
+
+// ShardedArchive is directory of .zip archives (shards) instead of the single one.
+// Shards are "<directory>/<account>.zip", or "<directory>/<account>/<year>.zip" if sharded by year,
+// and only shards which content is changed are rewritten, so cloud sync clients upload only them.
+// Shards of both layouts are read, so layout can be changed at any time.
+type ShardedArchive struct {
+	directory string
+	byYear    bool
+	options   ArchiveOptions
+	readOnly  bool
+
+	// shards are opened shards by file name, names are their sorted file names.
+	shards map[string]*ChatLogsArchive
+	names  []string
+	// written are file names of written shards, writtenAccounts are names of written accounts.
+	written         map[string]bool
+	writtenAccounts map[string]bool
+}
+
+// ReadShardedArchive opens sharded archive for reading and writing.
+// New shards are written in layout by year if byYear is set, or by account otherwise.
+func ReadShardedArchive(directory string, byYear bool, options ArchiveOptions) (*ShardedArchive, error) {
+	options.SkipUnchanged = true
+
+	s := &ShardedArchive{
+		directory:       directory,
+		byYear:          byYear,
+		options:         options,
+		shards:          make(map[string]*ChatLogsArchive),
+		written:         make(map[string]bool),
+		writtenAccounts: make(map[string]bool),
+	}
+
+	err := s.openShards(ReadChatLogsArchive)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// OpenShardedArchive opens sharded archive for reading only.
+func OpenShardedArchive(directory string, options ArchiveOptions) (*ShardedArchive, error) {
+	s := &ShardedArchive{
+		directory: directory,
+		options:   options,
+		readOnly:  true,
+		shards:    make(map[string]*ChatLogsArchive),
+	}
+
+	err := s.openShards(OpenChatLogsArchive)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// openShards opens all shards found in the directory.
+func (s *ShardedArchive) openShards(open func(fileName string, options ArchiveOptions) (*ChatLogsArchive, error)) error {
+	var fileNames []string
+	for _, pattern := range []string{"*.zip", filepath.Join("*", "*.zip")} {
+		matches, err := filepath.Glob(filepath.Join(s.directory, pattern))
+		if err != nil {
+			return err
+		}
+
+		fileNames = append(fileNames, matches...)
+	}
+
+	for _, fileName := range fileNames {
+		shard, err := open(fileName, s.options)
+		if err != nil {
+			s.Abort()
+			return fmt.Errorf("unable to open shard %s: %w", fileName, err)
+		}
+
+		s.add(fileName, shard)
+	}
+
+	return nil
+}
+
+func (s *ShardedArchive) add(fileName string, shard *ChatLogsArchive) {
+	s.shards[fileName] = shard
+	s.names = append(s.names, fileName)
+	sort.Strings(s.names)
+}
+
+// shard returns shard opened for writing, new shard is created if there's no such shard yet.
+func (s *ShardedArchive) shard(fileName string) (*ChatLogsArchive, error) {
+	if s.readOnly {
+		return nil, fmt.Errorf("%s is opened for reading only", s.directory)
+	}
+
+	if shard := s.shards[fileName]; shard != nil {
+		return shard, nil
+	}
+
+	err := os.MkdirAll(filepath.Dir(fileName), 0755)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create directory %s: %w", filepath.Dir(fileName), err)
+	}
+
+	shard, err := ReadChatLogsArchive(fileName, s.options)
+	if err != nil {
+		return nil, err
+	}
+
+	s.inheritEncryption(shard)
+	s.add(fileName, shard)
+
+	return shard, nil
+}
+
+// inheritEncryption encrypts new shard the same way as existing ones.
+func (s *ShardedArchive) inheritEncryption(shard *ChatLogsArchive) {
+	for _, existing := range s.shards {
+		if shard.writeCipher == nil {
+			shard.writeCipher = existing.writeCipher
+		}
+
+		for accountName, c := range existing.accountWriteCiphers {
+			if shard.accountWriteCiphers[accountName] == nil {
+				shard.accountWriteCiphers[accountName] = c
+			}
+		}
+	}
+}
+
+// shardFileName returns file name of the shard, year is ignored if archive is sharded by account.
+func (s *ShardedArchive) shardFileName(accountName string, year string) string {
+	if !s.byYear {
+		return filepath.Join(s.directory, accountName+".zip")
+	}
+
+	return filepath.Join(s.directory, accountName, year+".zip")
+}
+
+// shardAccountName returns name of the account the shard belongs to by its file name.
+func (s *ShardedArchive) shardAccountName(fileName string) string {
+	if filepath.Dir(fileName) == filepath.Clean(s.directory) {
+		return strings.TrimSuffix(filepath.Base(fileName), ".zip")
+	}
+
+	return filepath.Base(filepath.Dir(fileName))
+}
+
+// isYearShard returns true if the shard contains chat logs of the account for one year.
+func (s *ShardedArchive) isYearShard(fileName string, accountName string) bool {
+	return filepath.Dir(fileName) == filepath.Join(s.directory, accountName)
+}
+
+// GetAccountNames returns names of accounts found in all shards.
+func (s *ShardedArchive) GetAccountNames() ([]string, error) {
+	var accountNames []string
+	for _, name := range s.names {
+		shardAccountNames, err := s.shards[name].GetAccountNames()
+		if err != nil {
+			return nil, err
+		}
+
+		accountNames = append(accountNames, shardAccountNames...)
+	}
+
+	accountNames = Unique(accountNames)
+	sort.Strings(accountNames)
+
+	return accountNames, nil
+}
+
+// ListChatLogFileNames returns chat log files of the account found in all shards.
+// Absolute paths are prefixed with file names of the shards.
+func (s *ShardedArchive) ListChatLogFileNames(accountName string) (absolutePaths []string, relativePaths []string, err error) {
+	for _, name := range s.names {
+		shardAbsolutePaths, shardRelativePaths, err := s.shards[name].ListChatLogFileNames(accountName)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for i := range shardRelativePaths {
+			if !Contains(relativePaths, shardRelativePaths[i]) {
+				absolutePaths = append(absolutePaths, filepath.Join(name, shardAbsolutePaths[i]))
+				relativePaths = append(relativePaths, shardRelativePaths[i])
+			}
+		}
+	}
+
+	return absolutePaths, relativePaths, nil
+}
+
+// ReadChatLog reads chat log from all shards.
+// Year shards are joined in order of years, and merged with shards of other layout.
+func (s *ShardedArchive) ReadChatLog(accountName string, fileName string) (Messages, error) {
+	var chatLogs []Messages
+	var years Messages
+
+	for _, name := range s.names {
+		messages, err := s.shards[name].ReadChatLog(accountName, fileName)
+		if err != nil {
+			return nil, err
+		}
+
+		if s.isYearShard(name, accountName) {
+			years = append(years, messages...)
+		} else {
+			chatLogs = append(chatLogs, messages)
+		}
+	}
+
+	if len(chatLogs) == 0 {
+		return years, nil
+	}
+
+	return Merge(append(chatLogs, years)...), nil
+}
+
+// WriteChatLog writes chat log into shard of the account, or splits it into shards of years.
+// Lines preceding the first timestamp are written into shard of the first message's year.
+func (s *ShardedArchive) WriteChatLog(accountName string, fileName string, messages Messages) error {
+	parts := make(map[string]Messages)
+
+	if !s.byYear {
+		parts[s.shardFileName(accountName, "")] = messages
+	} else {
+		var undated Messages
+		for _, message := range messages {
+			if message.Timestamp == 0 {
+				undated = append(undated, message)
+				continue
+			}
+
+			year := s.shardFileName(accountName, strconv.Itoa(time.Unix(message.Timestamp, 0).UTC().Year()))
+			parts[year] = append(parts[year], append(undated, message)...)
+			undated = nil
+		}
+
+		if len(undated) != 0 {
+			parts[s.shardFileName(accountName, undatedShardName)] = undated
+		}
+	}
+
+	for shardFileName, part := range parts {
+		shard, err := s.shard(shardFileName)
+		if err != nil {
+			return err
+		}
+
+		err = shard.WriteChatLog(accountName, fileName, part)
+		if err != nil {
+			return err
+		}
+
+		s.written[shardFileName] = true
+	}
+
+	s.writtenAccounts[accountName] = true
+
+	return nil
+}
+
+// LockedAccounts returns accounts locked in any of shards.
+func (s *ShardedArchive) LockedAccounts() []string {
+	var accountNames []string
+	for _, name := range s.names {
+		accountNames = append(accountNames, s.shards[name].LockedAccounts()...)
+	}
+
+	accountNames = Unique(accountNames)
+	sort.Strings(accountNames)
+
+	return accountNames
+}
+
+// contactsShardFileName returns file name of the shard containing contacts index of the account.
+func (s *ShardedArchive) contactsShardFileName(accountName string) string {
+	return s.shardFileName(accountName, shardIndexName)
+}
+
+// ReadContacts reads contacts index of the account, from the shard of current layout first.
+func (s *ShardedArchive) ReadContacts(accountName string) ([]Contact, error) {
+	names := append([]string{s.contactsShardFileName(accountName)}, s.names...)
+
+	for _, name := range names {
+		shard := s.shards[name]
+		if shard == nil {
+			continue
+		}
+
+		contacts, err := shard.ReadContacts(accountName)
+		if err != nil || contacts != nil {
+			return contacts, err
+		}
+	}
+
+	return nil, nil
+}
+
+// WriteContacts writes contacts index of the account into its shard, or into index shard if sharded by year.
+func (s *ShardedArchive) WriteContacts(accountName string, contacts []Contact) error {
+	shardFileName := s.contactsShardFileName(accountName)
+
+	shard, err := s.shard(shardFileName)
+	if err != nil {
+		return err
+	}
+
+	err = shard.WriteContacts(accountName, contacts)
+	if err != nil {
+		return err
+	}
+
+	s.written[shardFileName] = true
+
+	return nil
+}
+
+// ChatLogSize returns total compressed and uncompressed size of chat log in all shards.
+func (s *ShardedArchive) ChatLogSize(accountName string, fileName string) (compressed uint64, uncompressed uint64, ok bool) {
+	for _, name := range s.names {
+		c, u, found := s.shards[name].ChatLogSize(accountName, fileName)
+		if found {
+			compressed += c
+			uncompressed += u
+			ok = true
+		}
+	}
+
+	return compressed, uncompressed, ok
+}
+
+// Close writes changed shards.
+// Shards of written accounts which have nothing written into them anymore, e.g. after layout change, are removed.
+func (s *ShardedArchive) Close() error {
+	var err error
+	var obsolete []string
+
+	for _, name := range s.names {
+		shard := s.shards[name]
+
+		switch {
+		case s.readOnly:
+			_ = shard.Close()
+		case err != nil:
+			shard.Abort()
+		case s.written[name]:
+			err = shard.Close()
+		default:
+			shard.Abort()
+
+			if s.writtenAccounts[s.shardAccountName(name)] {
+				obsolete = append(obsolete, name)
+			}
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	for _, name := range obsolete {
+		err = os.Remove(name)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("unable to remove obsolete shard %s: %w", name, err)
+		}
+
+		if filepath.Dir(name) != filepath.Clean(s.directory) {
+			// Directory of year shards is removed if it's empty.
+			_ = os.Remove(filepath.Dir(name))
+		}
+	}
+
+	return nil
+}
+
+// Abort leaves all shards untouched.
+func (s *ShardedArchive) Abort() {
+	for _, name := range s.names {
+		s.shards[name].Abort()
+	}
+}
+
+// String returns the archive storage spec.
+func (s *ShardedArchive) String() string {
+	return ArchiveKindSharded + ":" + s.directory
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeShardedChatLogs writes the chat logs into sharded archive, by account and file name.
+func writeShardedChatLogs(t *testing.T, directory string, byYear bool, chatLogs map[string]map[string]Messages) {
+	t.Helper()
+
+	archive, err := ReadShardedArchive(directory, byYear, ArchiveOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for accountName, files := range chatLogs {
+		for fileName, messages := range files {
+			err = archive.WriteChatLog(accountName, fileName, messages)
+			if err != nil {
+				archive.Abort()
+				t.Fatal(err)
+			}
+		}
+	}
+
+	err = archive.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestShardedArchive(t *testing.T) {
+	directory := t.TempDir()
+
+	bob := mustReadMessages(t, "[2022/12/31 23:00]  Bob: last year\n[2023/01/01 01:00]  Bob: this year\n")
+	carol := mustReadMessages(t, "[2023/06/30 12:00]  Carol: hi\n")
+
+	writeShardedChatLogs(t, directory, true, map[string]map[string]Messages{
+		"alice": {"bob.txt": bob},
+		"dave":  {"carol.txt": carol},
+	})
+
+	for _, shard := range []string{"alice/2022.zip", "alice/2023.zip", "dave/2023.zip"} {
+		if _, err := os.Stat(filepath.Join(directory, shard)); err != nil {
+			t.Errorf("shard %s is not written: %v", shard, err)
+		}
+	}
+
+	archive, err := OpenShardedArchive(directory, ArchiveOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages, err := archive.ReadChatLog("alice", "bob.txt")
+	_ = archive.Close()
+	if err != nil || len(messages) != 2 || messages[0].Timestamp > messages[1].Timestamp {
+		t.Fatalf("chat log is read from year shards as %d messages (%v)", len(messages), err)
+	}
+
+	// Layout is changed: chat logs of written account are moved into shard of the account.
+	writeShardedChatLogs(t, directory, false, map[string]map[string]Messages{
+		"alice": {"bob.txt": bob},
+	})
+
+	if _, err := os.Stat(filepath.Join(directory, "alice.zip")); err != nil {
+		t.Errorf("shard of the account is not written: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(directory, "alice")); !os.IsNotExist(err) {
+		t.Errorf("obsolete year shards are kept: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(directory, "dave", "2023.zip")); err != nil {
+		t.Errorf("shard of another account is removed: %v", err)
+	}
+
+	archive, err = OpenShardedArchive(directory, ArchiveOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages, err = archive.ReadChatLog("alice", "bob.txt")
+	_ = archive.Close()
+	if err != nil || len(messages) != 2 {
+		t.Errorf("chat log is read from account shard as %d messages (%v)", len(messages), err)
+	}
+}
+
+func TestShardedArchiveSkipsUnchangedShards(t *testing.T) {
+	directory := t.TempDir()
+
+	bob := mustReadMessages(t, "[2023/06/30 12:00]  Bob: hi\n")
+	carol := mustReadMessages(t, "[2023/06/30 12:00]  Carol: hi\n")
+
+	writeShardedChatLogs(t, directory, false, map[string]map[string]Messages{
+		"alice": {"bob.txt": bob},
+		"dave":  {"carol.txt": carol},
+	})
+
+	past := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, shard := range []string{"alice.zip", "dave.zip"} {
+		err := os.Chtimes(filepath.Join(directory, shard), past, past)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeShardedChatLogs(t, directory, false, map[string]map[string]Messages{
+		"alice": {"bob.txt": Merge(bob, mustReadMessages(t, "[2023/06/30 12:01]  Bob: new message\n"))},
+		"dave":  {"carol.txt": carol},
+	})
+
+	info, err := os.Stat(filepath.Join(directory, "alice.zip"))
+	if err != nil || info.ModTime().Equal(past) {
+		t.Errorf("changed shard is not written: %v", err)
+	}
+
+	info, err = os.Stat(filepath.Join(directory, "dave.zip"))
+	if err != nil || !info.ModTime().Equal(past) {
+		t.Errorf("unchanged shard is written: %v", err)
+	}
+}
+
+func TestCheckFlagsShardBy(t *testing.T) {
+	shardBy := *ShardBy
+	defer func() { *ShardBy = shardBy }()
+
+	for value, valid := range map[string]bool{ShardByAccount: true, ShardByYear: true, "month": false, "": false} {
+		*ShardBy = value
+		if err := checkFlags(); (err == nil) != valid {
+			t.Errorf("-shard-by %q: %v", value, err)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ArchiveStorage is storage of the archive, where merged chat logs of all devices are kept.
+// Chat logs written into it are committed all together by Close, or discarded by Abort.
+type ArchiveStorage interface {
+	ChatLogsStorage
+	// LockedAccounts returns accounts which can't be read or written, because their keys are not available.
+	LockedAccounts() []string
+	ReadContacts(accountName string) ([]Contact, error)
+	WriteContacts(accountName string, contacts []Contact) error
+	Close() error
+	Abort()
+	String() string
+}
+
+// UnwrittenKeeper is implemented by archive storages which keep chat logs not written by the sync as they are,
+// rather than writing new archive containing written chat logs only.
+type UnwrittenKeeper interface {
+	KeepsUnwritten() bool
+}
+
+// Archive storage kinds set by prefix of -archive flag value, e.g. "sharded:chat_logs" or "s3://bucket/prefix".
+// Value without known prefix is file name of .zip archive.
+const (
+	ArchiveKindZip     = "zip"
+	ArchiveKindSharded = "sharded"
+	ArchiveKindGit     = "git"
+	ArchiveKindWebDAV  = "webdav"
+	ArchiveKindS3      = "s3"
+	ArchiveKindSFTP    = "sftp"
+	ArchiveKindPlugin  = "plugin"
+)
+
+// ParseArchiveSpec splits -archive flag value into storage kind and its location.
+func ParseArchiveSpec(spec string) (kind string, location string) {
+	if prefix, rest, ok := strings.Cut(spec, ":"); ok {
+		switch prefix {
+		case ArchiveKindSharded, ArchiveKindGit, ArchiveKindWebDAV, ArchiveKindPlugin:
+			return prefix, rest
+		case ArchiveKindS3:
+			return prefix, strings.TrimPrefix(rest, "//")
+		case ArchiveKindSFTP:
+			return prefix, spec
+		}
+	}
+
+	return ArchiveKindZip, spec
+}
+
+// ReadArchiveStorage opens archive storage for reading and writing.
+// .zip archive is opened as is, its recovery and migration are up to the caller.
+func ReadArchiveStorage(spec string, options ArchiveOptions) (ArchiveStorage, error) {
+	kind, location := ParseArchiveSpec(spec)
+
+	switch kind {
+	case ArchiveKindSharded:
+		return ReadShardedArchive(location, *ShardBy == ShardByYear, options)
+	case ArchiveKindGit:
+		return ReadGitArchive(location)
+	case ArchiveKindWebDAV:
+		return NewWebDAVStorage(location, options, false)
+	case ArchiveKindS3:
+		return NewS3Storage(location)
+	case ArchiveKindSFTP:
+		return NewSFTPStorage(location, options, false)
+	case ArchiveKindPlugin:
+		return StartPluginStorage(location, false)
+	}
+
+	return ReadChatLogsArchive(location, options)
+}
+
+// OpenArchiveStorage opens archive storage for reading only.
+func OpenArchiveStorage(spec string, options ArchiveOptions) (ArchiveStorage, error) {
+	kind, location := ParseArchiveSpec(spec)
+
+	switch kind {
+	case ArchiveKindSharded:
+		return OpenShardedArchive(location, options)
+	case ArchiveKindGit:
+		return OpenGitArchive(location)
+	case ArchiveKindWebDAV:
+		return NewWebDAVStorage(location, options, true)
+	case ArchiveKindS3:
+		return NewS3Storage(location)
+	case ArchiveKindSFTP:
+		return NewSFTPStorage(location, options, true)
+	case ArchiveKindPlugin:
+		return StartPluginStorage(location, true)
+	}
+
+	return OpenChatLogsArchive(location, options)
+}
+
+// requireZipArchive returns error if the command can't work with the archive storage.
+func requireZipArchive(command string, spec string) error {
+	if kind, _ := ParseArchiveSpec(spec); kind != ArchiveKindZip {
+		return fmt.Errorf("%s command supports .zip archive only, %s is %s storage", command, spec, kind)
+	}
+
+	return nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// webdavServer is minimal WebDAV server keeping files in memory.
+type webdavServer struct {
+	// etags are "strong", "weak" or "none".
+	etags string
+
+	mutex       sync.Mutex
+	files       map[string][]byte
+	collections map[string]bool
+}
+
+func newWebDAVServer(t *testing.T, etags string) (*webdavServer, *WebDAVFiles) {
+	s := &webdavServer{
+		etags:       etags,
+		files:       make(map[string][]byte),
+		collections: map[string]bool{"/": true},
+	}
+
+	server := httptest.NewServer(s)
+	t.Cleanup(server.Close)
+
+	files, err := NewWebDAVFiles(server.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s, files
+}
+
+func (s *webdavServer) etag(data []byte) string {
+	tag := fmt.Sprintf(`"%x"`, sha256.Sum256(data))
+	if s.etags == "weak" {
+		tag = "W/" + tag
+	}
+
+	return tag
+}
+
+// webdavParent returns path of the parent collection, with trailing slash.
+func webdavParent(name string) string {
+	return strings.TrimSuffix(path.Dir(name), "/") + "/"
+}
+
+func (s *webdavServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	name := r.URL.Path
+	data, exists := s.files[name]
+
+	switch r.Method {
+	case http.MethodGet:
+		if !exists {
+			http.NotFound(w, r)
+			return
+		}
+		if s.etags != "none" {
+			w.Header().Set("ETag", s.etag(data))
+		}
+		_, _ = w.Write(data)
+
+	case http.MethodPut:
+		// If-Match uses strong comparison, so weak ETags never match.
+		if match := r.Header.Get("If-Match"); match != "" && (!exists || strings.HasPrefix(match, "W/") || match != s.etag(data)) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		if r.Header.Get("If-None-Match") == "*" && exists {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		if !s.collections[webdavParent(name)] {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		s.files[name], _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+
+	case "MKCOL":
+		if s.collections[name] {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		s.collections[name] = true
+		w.WriteHeader(http.StatusCreated)
+
+	case "PROPFIND":
+		if !s.collections[name] {
+			http.NotFound(w, r)
+			return
+		}
+
+		var responses []string
+		for collection := range s.collections {
+			if collection != "/" && webdavParent(strings.TrimSuffix(collection, "/")) == name {
+				responses = append(responses, fmt.Sprintf(`<d:response><d:href>%s</d:href><d:propstat><d:prop><d:resourcetype><d:collection/></d:resourcetype></d:prop></d:propstat></d:response>`, collection))
+			}
+		}
+		for fileName := range s.files {
+			if webdavParent(fileName) == name {
+				responses = append(responses, fmt.Sprintf(`<d:response><d:href>%s</d:href><d:propstat><d:prop><d:resourcetype/></d:prop></d:propstat></d:response>`, fileName))
+			}
+		}
+
+		w.WriteHeader(http.StatusMultiStatus)
+		fmt.Fprintf(w, `<?xml version="1.0"?><d:multistatus xmlns:d="DAV:">%s</d:multistatus>`, strings.Join(responses, ""))
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestWebDAVFiles(t *testing.T) {
+	_, files := newWebDAVServer(t, "strong")
+
+	data, version, err := files.Read("alice/bob.txt")
+	if err != nil || data != nil || version != "" {
+		t.Fatalf("missing file is read as %q, version %q (%v)", data, version, err)
+	}
+
+	err = files.Write("alice/bob.txt", []byte("hi\n"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = files.Write("alice/bob.txt", []byte("hello\n"), "")
+	if err != ErrVersionMismatch {
+		t.Errorf("existing file is overwritten as new one: %v", err)
+	}
+
+	names, err := files.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	if len(names) != 1 || names[0] != "alice/bob.txt" {
+		t.Errorf("files are %v", names)
+	}
+
+	data, version, err = files.Read("alice/bob.txt")
+	if err != nil || string(data) != "hi\n" {
+		t.Fatalf("file is read as %q (%v)", data, err)
+	}
+
+	err = files.Write("alice/bob.txt", []byte("hello\n"), version)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = files.Write("alice/bob.txt", []byte("hey\n"), version)
+	if err != ErrVersionMismatch {
+		t.Errorf("file changed since it was read is overwritten: %v", err)
+	}
+}
+
+func TestWebDAVArchiveMergesChangedChatLog(t *testing.T) {
+	for _, etags := range []string{"strong", "weak", "none"} {
+		t.Run(etags, func(t *testing.T) {
+			server, files := newWebDAVServer(t, etags)
+
+			err := files.Write("alice/bob.txt", []byte("[2023/06/30 12:00]  Bob: first\n"), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			archive, err := OpenFileArchive(files)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			messages, err := archive.ReadChatLog("alice", "bob.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Another device changes the chat log after it's read.
+			server.mutex.Lock()
+			server.files["/alice/bob.txt"] = []byte("[2023/06/30 12:00]  Bob: first\n[2023/06/30 12:02]  Bob: from other device\n")
+			server.mutex.Unlock()
+
+			messages = Merge(messages, mustReadMessages(t, "[2023/06/30 12:01]  Bob: from this device\n"))
+
+			err = archive.WriteChatLog("alice", "bob.txt", messages)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = archive.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expected := "[2023/06/30 12:00]  Bob: first\n[2023/06/30 12:01]  Bob: from this device\n[2023/06/30 12:02]  Bob: from other device\n"
+			if data := string(server.files["/alice/bob.txt"]); data != expected {
+				t.Errorf("chat log is %q, %q expected", data, expected)
+			}
+		})
+	}
+}
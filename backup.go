@@ -0,0 +1,512 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// backupTimeFormat is format of the time in backup file names.
+const backupTimeFormat = "20060102-150405.000"
+
+// backupManifestName is name of the backup manifest inside of the backup .zip file.
+const backupManifestName = "backup.json"
+
+// backupTempSuffix is suffix of backup files which are being written, they're renamed to "<time>.zip" when completed.
+const backupTempSuffix = ".zip.tmp"
+
+// backupTempMaxAge is how long backup file may be written, older temp files are left by interrupted runs.
+const backupTempMaxAge = 24 * time.Hour
+
+// BackupOptions are options of SecondLife clients' chat logs backups.
+type BackupOptions struct {
+	// Directory is where backups are stored.
+	Directory string
+	// Keep is how many backups are kept, 0 disables backups.
+	Keep int
+	// Days is how many days backups are kept, 0 keeps them regardless of age.
+	Days int
+}
+
+// DefaultBackupDirectory returns backups directory inside of the user's configuration directory.
+func DefaultBackupDirectory() (string, error) {
+	directory, err := StateDirectory()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(directory, "backups"), nil
+}
+
+// BackupManifest describes files saved into the backup.
+type BackupManifest struct {
+	Created time.Time    `json:"created"`
+	Files   []BackupFile `json:"files"`
+}
+
+// BackupFile is chat log file of SecondLife client as it was before it was changed.
+type BackupFile struct {
+	Client      SecondLifeClient `json:"client"`
+	AccountName string           `json:"account"`
+	FileName    string           `json:"file"`
+	// Path is absolute path of the chat log file.
+	Path string `json:"path"`
+	// Existed is false if the file was created, so it's removed on restore.
+	Existed bool `json:"existed"`
+	// Entry is name of the file content inside of the backup.
+	Entry string `json:"entry,omitempty"`
+}
+
+// ChatLogsBackup saves chat log files of SecondLife clients into dated .zip file before they're changed.
+// Backup file is created under temp name when the first file is saved, and it's renamed when it's completed.
+type ChatLogsBackup struct {
+	options BackupOptions
+	// fileName is name of the temp file while backup is written, and name of the backup once it's closed.
+	fileName string
+	f        *os.File
+	w        *zip.Writer
+	manifest BackupManifest
+	// saved are paths of the files which are already saved.
+	saved map[string]bool
+}
+
+// NewChatLogsBackup returns backup of the current run.
+func NewChatLogsBackup(options BackupOptions) *ChatLogsBackup {
+	return &ChatLogsBackup{
+		options: options,
+		saved:   make(map[string]bool),
+	}
+}
+
+// Save saves chat log file as it is now, before it's changed.
+// Only the first state of each file is saved.
+func (b *ChatLogsBackup) Save(client SecondLifeClient, accountName string, fileName string, path string) error {
+	if b.options.Keep <= 0 || b.saved[path] {
+		return nil
+	}
+
+	data, err := os.ReadFile(path)
+	existed := !errors.Is(err, os.ErrNotExist)
+	if err != nil && existed {
+		return fmt.Errorf("unable to read %s for backup: %w", path, err)
+	}
+
+	if b.w == nil {
+		err = b.create()
+		if err != nil {
+			return err
+		}
+	}
+
+	file := BackupFile{
+		Client:      client,
+		AccountName: accountName,
+		FileName:    fileName,
+		Path:        path,
+		Existed:     existed,
+	}
+
+	if existed {
+		file.Entry = fmt.Sprintf("%d/%s/%s/%s", len(b.manifest.Files), client, accountName, fileName)
+
+		header := &zip.FileHeader{Name: file.Entry, Method: zip.Deflate}
+		header.Modified = time.Now()
+
+		w, err := b.w.CreateHeader(header)
+		if err != nil {
+			return fmt.Errorf("error creating file %s in backup %s: %w", file.Entry, b.fileName, err)
+		}
+
+		_, err = w.Write(data)
+		if err != nil {
+			return fmt.Errorf("error writing file %s into backup %s: %w", file.Entry, b.fileName, err)
+		}
+	}
+
+	b.manifest.Files = append(b.manifest.Files, file)
+	b.saved[path] = true
+
+	return nil
+}
+
+// create creates temp file of the current run's backup.
+func (b *ChatLogsBackup) create() error {
+	err := os.MkdirAll(b.options.Directory, 0700)
+	if err != nil {
+		return fmt.Errorf("unable to create directory %s: %w", b.options.Directory, err)
+	}
+
+	b.manifest.Created = time.Now()
+
+	b.f, err = os.CreateTemp(b.options.Directory, b.manifest.Created.UTC().Format(backupTimeFormat)+"-*"+backupTempSuffix)
+	if err != nil {
+		return fmt.Errorf("unable to create backup in %s: %w", b.options.Directory, err)
+	}
+
+	b.fileName = b.f.Name()
+	b.w = zip.NewWriter(b.f)
+
+	return nil
+}
+
+// complete renames completed temp file into "<time>.zip", so backups of the same time don't overwrite each other.
+func (b *ChatLogsBackup) complete() error {
+	for created := b.manifest.Created; ; created = created.Add(time.Millisecond) {
+		fileName := filepath.Join(b.options.Directory, created.UTC().Format(backupTimeFormat)+".zip")
+
+		_, err := os.Lstat(fileName)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("unable to stat %s: %w", fileName, err)
+		}
+
+		err = os.Rename(b.fileName, fileName)
+		if err != nil {
+			return fmt.Errorf("unable to rename backup %s to %s: %w", b.fileName, fileName, err)
+		}
+
+		b.fileName = fileName
+
+		return nil
+	}
+}
+
+// Close writes backup manifest, closes backup file and removes old backups.
+func (b *ChatLogsBackup) Close() error {
+	if b.w == nil {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(b.manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to encode backup manifest: %w", err)
+	}
+
+	w, err := b.w.Create(backupManifestName)
+	if err == nil {
+		_, err = w.Write(data)
+	}
+	if err == nil {
+		err = b.w.Close()
+	}
+	if err != nil {
+		_ = b.f.Close()
+		return fmt.Errorf("error writing backup %s: %w", b.fileName, err)
+	}
+
+	err = b.f.Close()
+	if err != nil {
+		_ = os.Remove(b.fileName)
+		return fmt.Errorf("error closing backup %s: %w", b.fileName, err)
+	}
+
+	b.w = nil
+
+	err = b.complete()
+	if err != nil {
+		_ = os.Remove(b.fileName)
+		return err
+	}
+
+	fmt.Printf("%d changed chat logs of SecondLife clients are saved into %s\n", len(b.manifest.Files), b.fileName)
+
+	return PruneBackups(b.options)
+}
+
+// Abort closes and removes backup file, when saved chat logs are not changed.
+func (b *ChatLogsBackup) Abort() {
+	if b.w == nil {
+		return
+	}
+
+	_ = b.w.Close()
+	_ = b.f.Close()
+	_ = os.Remove(b.fileName)
+
+	b.w = nil
+}
+
+// Backup is backup file of a run.
+type Backup struct {
+	FileName string
+	Created  time.Time
+}
+
+// ListBackups returns backups, the newest first.
+func ListBackups(directory string) ([]Backup, error) {
+	entries, err := os.ReadDir(directory)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read directory %s: %w", directory, err)
+	}
+
+	var backups []Backup
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".zip")
+		if entry.IsDir() || !ok {
+			continue
+		}
+
+		created, err := time.Parse(backupTimeFormat, name)
+		if err != nil {
+			continue
+		}
+
+		backups = append(backups, Backup{FileName: filepath.Join(directory, entry.Name()), Created: created})
+	}
+
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].Created.After(backups[j].Created)
+	})
+
+	return backups, nil
+}
+
+// PruneBackups removes backups over the count and older than the days set by options,
+// and temp files of backups left by interrupted runs.
+func PruneBackups(options BackupOptions) error {
+	err := RemoveBackupTempFiles(options.Directory, backupTempMaxAge)
+	if err != nil {
+		return err
+	}
+
+	backups, err := ListBackups(options.Directory)
+	if err != nil {
+		return err
+	}
+
+	for i, backup := range backups {
+		if i < options.Keep && (options.Days <= 0 || time.Since(backup.Created) <= time.Duration(options.Days)*24*time.Hour) {
+			continue
+		}
+
+		err = os.Remove(backup.FileName)
+		if err != nil {
+			return fmt.Errorf("unable to remove old backup %s: %w", backup.FileName, err)
+		}
+	}
+
+	return nil
+}
+
+// RemoveBackupTempFiles removes temp files of backups which are not written for the age.
+func RemoveBackupTempFiles(directory string, age time.Duration) error {
+	entries, err := os.ReadDir(directory)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to read directory %s: %w", directory, err)
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), backupTempSuffix) {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < age {
+			continue
+		}
+
+		fileName := filepath.Join(directory, entry.Name())
+		err = os.Remove(fileName)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("unable to remove %s: %w", fileName, err)
+		}
+	}
+
+	return nil
+}
+
+// ReadBackupManifest reads manifest of the backup file.
+func ReadBackupManifest(r *zip.Reader) (BackupManifest, error) {
+	var manifest BackupManifest
+
+	f, err := r.Open(backupManifestName)
+	if err != nil {
+		return manifest, err
+	}
+	defer f.Close()
+
+	err = json.NewDecoder(f).Decode(&manifest)
+	if err != nil {
+		return manifest, fmt.Errorf("unable to parse backup manifest: %w", err)
+	}
+
+	return manifest, nil
+}
+
+// RestoreBackup puts chat log files saved into the backup back, and removes files created after it.
+// Current files are saved into the current backup, so restore can be undone.
+func RestoreBackup(fileName string, current *ChatLogsBackup) (restored int, err error) {
+	r, err := zip.OpenReader(fileName)
+	if err != nil {
+		return 0, fmt.Errorf("unable to open backup %s: %w", fileName, err)
+	}
+	defer r.Close()
+
+	manifest, err := ReadBackupManifest(&r.Reader)
+	if err != nil {
+		return 0, fmt.Errorf("unable to read backup %s: %w", fileName, err)
+	}
+
+	for _, file := range manifest.Files {
+		err = current.Save(file.Client, file.AccountName, file.FileName, file.Path)
+		if err != nil {
+			return restored, err
+		}
+
+		if !file.Existed {
+			err = os.Remove(file.Path)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return restored, fmt.Errorf("unable to remove %s: %w", file.Path, err)
+			}
+
+			restored++
+			continue
+		}
+
+		f, err := r.Open(file.Entry)
+		if err != nil {
+			return restored, fmt.Errorf("unable to open %s in backup %s: %w", file.Entry, fileName, err)
+		}
+
+		data, err := io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return restored, fmt.Errorf("unable to read %s in backup %s: %w", file.Entry, fileName, err)
+		}
+
+		err = os.MkdirAll(filepath.Dir(file.Path), 0755)
+		if err != nil {
+			return restored, fmt.Errorf("unable to create directory %s: %w", filepath.Dir(file.Path), err)
+		}
+
+		err = os.WriteFile(file.Path, data, 0644)
+		if err != nil {
+			return restored, fmt.Errorf("unable to restore %s: %w", file.Path, err)
+		}
+
+		restored++
+	}
+
+	return restored, nil
+}
+
+// BackedUpClient is SecondLife client which chat log files are saved into the backup before they're changed.
+// Chat log files which content is not changed are not written at all.
+type BackedUpClient struct {
+	SecondLifeClient
+	backup *ChatLogsBackup
+}
+
+// WriteChatLog saves chat log file into the backup and writes new chat log messages into it.
+func (c BackedUpClient) WriteChatLog(accountName string, fileName string, messages Messages) error {
+	path, err := c.ChatLogFilePath(accountName, fileName)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	err = messages.Write(&buf)
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(path)
+	if err == nil && bytes.Equal(data, buf.Bytes()) {
+		return nil
+	}
+
+	err = c.backup.Save(c.SecondLifeClient, accountName, fileName, path)
+	if err != nil {
+		return err
+	}
+
+	return c.SecondLifeClient.WriteChatLog(accountName, fileName, messages)
+}
+
+// runRestoreBackup lists backups of SecondLife clients' chat logs, or puts chat logs back as they were before the run.
+func runRestoreBackup(args []string) error {
+	flags := flag.NewFlagSet("restore-backup", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s [options] restore-backup [<backup>]\n\n", os.Args[0])
+		fmt.Fprintf(flags.Output(), "Lists backups, or puts chat logs of SecondLife clients back as they were before the backup was made.\n")
+		fmt.Fprintf(flags.Output(), "Backup is number shown in the list; all later backups are restored too.\n")
+	}
+	_ = flags.Parse(args)
+
+	options, err := backupOptions()
+	if err != nil {
+		return err
+	}
+
+	backups, err := ListBackups(options.Directory)
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() == 0 {
+		if len(backups) == 0 {
+			fmt.Printf("There are no backups in %s.\n", options.Directory)
+			return nil
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(tw, "BACKUP\tCREATED\tFILES\tFILE\n")
+		for i, backup := range backups {
+			files := "?"
+			if r, err := zip.OpenReader(backup.FileName); err == nil {
+				if manifest, err := ReadBackupManifest(&r.Reader); err == nil {
+					files = strconv.Itoa(len(manifest.Files))
+				}
+				_ = r.Close()
+			}
+
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", i+1, backup.Created.Local().Format(time.DateTime), files, filepath.Base(backup.FileName))
+		}
+
+		return tw.Flush()
+	}
+
+	n, err := strconv.Atoi(flags.Arg(0))
+	if err != nil || n < 1 || n > len(backups) {
+		return fmt.Errorf("there's no backup %s in %s", flags.Arg(0), options.Directory)
+	}
+
+	err = awaitViewersExited()
+	if err != nil {
+		return fmt.Errorf("%w; restore-backup writes its chat logs, exit it first", err)
+	}
+
+	current := NewChatLogsBackup(options)
+
+	// Backups are restored from the newest one, so files end up as they were before the selected one.
+	for _, backup := range backups[:n] {
+		restored, err := RestoreBackup(backup.FileName, current)
+		if err != nil {
+			_ = current.Close()
+			return err
+		}
+
+		fmt.Printf("%d chat logs restored from %s\n", restored, backup.FileName)
+	}
+
+	return current.Close()
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// ChatLogSummary is summary of chat log, which lets two storages find out which messages the other one lacks,
+// without transferring the chat log itself.
+type ChatLogSummary struct {
+	Messages int `json:"messages"`
+	// Last is unixtime of the last message.
+	Last int64        `json:"last"`
+	Days []DaySummary `json:"days,omitempty"`
+}
+
+// DaySummary is summary of chat log messages of single day.
+// Hash is sum of hashes of the messages, so it doesn't depend on order of messages with the same time,
+// and it's updated by adding hash of each new message.
+type DaySummary struct {
+	Day      string `json:"day"`
+	Messages int    `json:"messages"`
+	Hash     string `json:"hash"`
+}
+
+// ChatLogSummarizer is implemented by storages able to summarize chat logs and read them partially,
+// so only messages missing on either side are transferred over slow or metered connections.
+// It's implemented by PeerStorage only, archive storages are read as whole chat logs.
+type ChatLogSummarizer interface {
+	SummarizeChatLog(accountName string, fileName string) (ChatLogSummary, error)
+	// ReadChatLogDays reads messages of the days only, days are formatted as "2006-01-02".
+	ReadChatLogDays(accountName string, fileName string, days []string) (Messages, error)
+}
+
+// messageDay returns day of the message, timestamps are local times stored as UTC.
+func messageDay(message *Message) string {
+	return time.Unix(message.Timestamp, 0).UTC().Format(time.DateOnly)
+}
+
+func messageHash(message *Message) uint64 {
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%d\n%s", message.Timestamp, message.Message)))
+	return binary.BigEndian.Uint64(hash[:8])
+}
+
+// Summarize returns summary of the chat log.
+func (m Messages) Summarize() ChatLogSummary {
+	summary := ChatLogSummary{Messages: len(m)}
+
+	counts := make(map[string]int)
+	hashes := make(map[string]uint64)
+
+	for _, message := range m {
+		day := messageDay(message)
+		counts[day]++
+		hashes[day] += messageHash(message)
+
+		if message.Timestamp > summary.Last {
+			summary.Last = message.Timestamp
+		}
+	}
+
+	for day, count := range counts {
+		summary.Days = append(summary.Days, DaySummary{Day: day, Messages: count, Hash: fmt.Sprintf("%016x", hashes[day])})
+	}
+
+	sort.Slice(summary.Days, func(i, j int) bool {
+		return summary.Days[i].Day < summary.Days[j].Day
+	})
+
+	return summary
+}
+
+// OnDays returns messages of the days only.
+func (m Messages) OnDays(days []string) (result Messages) {
+	selected := make(map[string]bool)
+	for _, day := range days {
+		selected[day] = true
+	}
+
+	for _, message := range m {
+		if selected[messageDay(message)] {
+			result = append(result, message)
+		}
+	}
+
+	return
+}
+
+// DifferentDays returns days of the other summary which messages are not the same as of this one,
+// i.e. days having messages missing in this chat log.
+func (s ChatLogSummary) DifferentDays(other ChatLogSummary) []string {
+	hashes := make(map[string]string)
+	for _, day := range s.Days {
+		hashes[day.Day] = day.Hash
+	}
+
+	var days []string
+	for _, day := range other.Days {
+		if hashes[day.Day] != day.Hash {
+			days = append(days, day.Day)
+		}
+	}
+
+	return days
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// summarizingStorage is memory storage which is read by days only, like peer.
+type summarizingStorage struct {
+	memoryStorage
+	readDays []string
+}
+
+func (s *summarizingStorage) SummarizeChatLog(accountName string, fileName string) (ChatLogSummary, error) {
+	return s.memoryStorage[accountName][fileName].Summarize(), nil
+}
+
+func (s *summarizingStorage) ReadChatLogDays(accountName string, fileName string, days []string) (Messages, error) {
+	s.readDays = append(s.readDays, days...)
+	return s.memoryStorage[accountName][fileName].OnDays(days), nil
+}
+
+func TestSummarize(t *testing.T) {
+	messages := mustReadMessages(t, "[2023/06/30 12:00]  Bob: first\n[2023/06/30 12:01]  Bob: second\n[2023/07/01 09:00]  Bob: third\n")
+
+	summary := messages.Summarize()
+	if summary.Messages != 3 || len(summary.Days) != 2 {
+		t.Fatalf("summary is %+v", summary)
+	}
+	if summary.Days[0].Day != "2023-06-30" || summary.Days[0].Messages != 2 || summary.Days[1].Day != "2023-07-01" {
+		t.Errorf("days are %+v", summary.Days)
+	}
+	if summary.Last != messages[2].Timestamp {
+		t.Errorf("last message is %d, %d expected", summary.Last, messages[2].Timestamp)
+	}
+
+	// Hash of the day doesn't depend on order of messages.
+	reordered := Messages{messages[1], messages[0], messages[2]}
+	if !reflect.DeepEqual(reordered.Summarize(), summary) {
+		t.Errorf("summary depends on order of messages")
+	}
+}
+
+func TestDifferentDays(t *testing.T) {
+	local := mustReadMessages(t, "[2023/06/30 12:00]  Bob: first\n[2023/07/01 09:00]  Bob: third\n")
+	remote := mustReadMessages(t, "[2023/06/30 12:00]  Bob: first\n[2023/07/01 09:00]  Bob: changed\n[2023/07/02 10:00]  Bob: fourth\n")
+
+	days := local.Summarize().DifferentDays(remote.Summarize())
+	expected := []string{"2023-07-01", "2023-07-02"}
+	if !reflect.DeepEqual(days, expected) {
+		t.Errorf("different days are %v, %v expected", days, expected)
+	}
+
+	days = remote.Summarize().DifferentDays(remote.Summarize())
+	if len(days) != 0 {
+		t.Errorf("same chat logs differ on %v", days)
+	}
+}
+
+func TestReadMergedChatLogReadsDifferentDaysOnly(t *testing.T) {
+	local := memoryStorage{"alice": {"bob.txt": mustReadMessages(t, "[2023/06/30 12:00]  Bob: first\n")}}
+	peer := &summarizingStorage{memoryStorage: memoryStorage{"alice": {"bob.txt": mustReadMessages(t, "[2023/06/30 12:00]  Bob: first\n[2023/07/01 09:00]  Bob: second\n")}}}
+
+	messages, err := ReadMergedChatLog([]ChatLogsStorage{peer, local}, "alice", "bob.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(messages) != 2 {
+		t.Errorf("merged chat log has %d messages, 2 expected", len(messages))
+	}
+	if !reflect.DeepEqual(peer.readDays, []string{"2023-07-01"}) {
+		t.Errorf("days read from peer are %v", peer.readDays)
+	}
+}
@@ -1,8 +1,95 @@
 package main
 
+import (
+	"sort"
+)
+
 type ChatLogsStorage interface {
 	GetAccountNames() ([]string, error)
 	ListChatLogFileNames(accountName string) (absolutePaths []string, relativePaths []string, err error)
 	ReadChatLog(accountName string, fileName string) (Messages, error)
 	WriteChatLog(accountName string, fileName string, messages Messages) error
 }
+
+// GetAllAccountNames returns sorted unique account names from all storages.
+func GetAllAccountNames(storages []ChatLogsStorage) ([]string, error) {
+	var accountNames []string
+
+	for _, storage := range storages {
+		storageAccountNames, err := storage.GetAccountNames()
+		if err != nil {
+			return nil, err
+		}
+
+		accountNames = append(accountNames, storageAccountNames...)
+	}
+
+	accountNames = Unique(accountNames)
+	sort.Strings(accountNames)
+
+	return accountNames, nil
+}
+
+// ListAllChatLogFileNames returns sorted unique chat log file names for the account from all storages.
+// File names are relative to the account chat logs directory.
+func ListAllChatLogFileNames(storages []ChatLogsStorage, accountName string) ([]string, error) {
+	var chatLogsFileNames []string
+
+	for _, storage := range storages {
+		_, fileNames, err := storage.ListChatLogFileNames(accountName)
+		if err != nil {
+			return nil, err
+		}
+
+		chatLogsFileNames = append(chatLogsFileNames, fileNames...)
+	}
+
+	chatLogsFileNames = Unique(chatLogsFileNames)
+	sort.Strings(chatLogsFileNames)
+
+	return chatLogsFileNames, nil
+}
+
+// ReadMergedChatLog reads chat log from all storages and merges it.
+// Storages able to summarize chat logs are read last, and only messages of days missing in other storages are read from them.
+func ReadMergedChatLog(storages []ChatLogsStorage, accountName string, fileName string) (Messages, error) {
+	var chatLogs []Messages
+	var summarizers []ChatLogSummarizer
+
+	for _, storage := range storages {
+		if summarizer, ok := storage.(ChatLogSummarizer); ok {
+			summarizers = append(summarizers, summarizer)
+			continue
+		}
+
+		messages, err := storage.ReadChatLog(accountName, fileName)
+		if err != nil {
+			return nil, err
+		}
+
+		chatLogs = append(chatLogs, messages)
+	}
+
+	merged := Merge(chatLogs...)
+
+	for _, summarizer := range summarizers {
+		summary, err := summarizer.SummarizeChatLog(accountName, fileName)
+		if err != nil {
+			return nil, err
+		}
+
+		days := merged.Summarize().DifferentDays(summary)
+		if len(days) == 0 {
+			continue
+		}
+
+		messages, err := summarizer.ReadChatLogDays(accountName, fileName, days)
+		if err != nil {
+			return nil, err
+		}
+
+		merged = Merge(merged, messages)
+	}
+
+	return merged, nil
+}
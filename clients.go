@@ -15,6 +15,30 @@ type SecondLifeClient string
 // Usually can be taken from gDirUtilp->initAppDirs function call into indra/newview/llappviewer.cpp.
 var SecondLifeClients = []SecondLifeClient{"SecondLife", "Kokua", "Firestorm", "Firestorm_x64"}
 
+// DetectSecondLifeClients returns SecondLife clients which settings directories exist on this machine.
+// Clients which can't be detected are reported to stderr and skipped.
+func DetectSecondLifeClients() (clients []SecondLifeClient) {
+	for _, clientApp := range SecondLifeClients {
+		directory, err := clientApp.GetDirectory()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s detection error, skipping it: %s\n", clientApp, err)
+			continue
+		}
+
+		exists, err := IsDirectoryExists(directory)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s detection error, skipping it: %s\n", clientApp, err)
+			continue
+		}
+
+		if exists {
+			clients = append(clients, clientApp)
+		}
+	}
+
+	return
+}
+
 // GetAccountNames retrieves account names inside of the client settings directory.
 func (a SecondLifeClient) GetAccountNames() ([]string, error) {
 	directory, err := a.GetDirectory()
@@ -140,36 +164,47 @@ func (a SecondLifeClient) ReadChatLog(accountName string, fileName string) (Mess
 	return messages, nil
 }
 
-// WriteChatLog writes chat log messages into temp file and replaces existing chat logs file with the new one.
-func (a SecondLifeClient) WriteChatLog(accountName string, fileName string, messages Messages) error {
+// ChatLogFilePath returns path of chat log file for specified account, which may not exist yet.
+// If there's no account directory for current client, chat logs are saved into the client settings directory.
+func (a SecondLifeClient) ChatLogFilePath(accountName string, fileName string) (string, error) {
 	logsDirectory, err := a.GetAccountChatLogsDirectory(accountName)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	// If there's no account directory for current client, create it and save logs here.
 	if logsDirectory == "" {
 		directory, err := a.GetDirectory()
 		if err != nil {
-			return err
+			return "", err
 		}
 
 		logsDirectory = filepath.Join(directory, accountName)
+	}
 
-		exists, err := IsDirectoryExists(logsDirectory)
+	return filepath.Join(logsDirectory, fileName), nil
+}
+
+// WriteChatLog writes chat log messages into temp file and replaces existing chat logs file with the new one.
+func (a SecondLifeClient) WriteChatLog(accountName string, fileName string, messages Messages) error {
+	logFilePath, err := a.ChatLogFilePath(accountName, fileName)
+	if err != nil {
+		return err
+	}
+
+	// If there's no account directory for current client, create it and save logs here.
+	logsDirectory := filepath.Dir(logFilePath)
+
+	exists, err := IsDirectoryExists(logsDirectory)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		err = os.Mkdir(logsDirectory, 0755)
 		if err != nil {
-			return err
-		}
-		if !exists {
-			err = os.Mkdir(logsDirectory, 0755)
-			if err != nil {
-				return fmt.Errorf("unable to create directory %s: %w", logsDirectory, err)
-			}
+			return fmt.Errorf("unable to create directory %s: %w", logsDirectory, err)
 		}
 	}
 
-	logFilePath := filepath.Join(logsDirectory, fileName)
-
 	wf, err := os.Create(filepath.Join(os.TempDir(), fmt.Sprintf("%s_%s", accountName, fileName)))
 	if err != nil {
 		return fmt.Errorf("error creating temp file for chat log %s/%s: %w", accountName, fileName, err)
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"os"
 )
 
 // GetDirectory returns path for SL client settings directory for current OS.
@@ -9,6 +10,6 @@ import (
 // I tried to take directory detection from indra/llvfs/lldir_mac.cpp...
 // But unfortunately, I don't know how to call NSSearchPathForDirectoriesInDomains from Go,
 // so I made it in very dumb way instead.
-func (a ClientAppName) GetDirectory() (string, error) {
+func (a SecondLifeClient) GetDirectory() (string, error) {
 	return fmt.Sprintf("%s/Library/Application Support/%s", os.Getenv("HOME"), string(a)), nil
 }
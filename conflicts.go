@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// conflictCopyPatterns match suffixes which cloud sync clients add to file names of conflicting copies.
+// They're strict, so other files next to the archive, e.g. "sl_chat_logs-old.zip", are never merged and moved away.
+var conflictCopyPatterns = []string{
+	// Dropbox: "name (conflicted copy 2026-05-01).zip", "name (John's conflicted copy 2026-05-01).zip".
+	// Nextcloud: "name (conflicted copy 2026-05-01 120000).zip", "name (conflicted copy john 2026-05-01 120000).zip".
+	` \((?:[^()]+'s )?[Cc]onflicted copy (?:[^()]+ )?\d{4}-\d{2}-\d{2}(?: \d{6})?(?: \(\d+\))?\)`,
+	// Google Drive: "name (1).zip".
+	` \(\d+\)`,
+	// OneDrive: "name-DESKTOP-ABC1234.zip", suffix is Windows computer name. Only default names of Windows computers are matched,
+	// custom ones can't be told apart from names like "name-BACKUP.zip" or "name-2023.zip".
+	`-(?:DESKTOP|LAPTOP)-[A-Z0-9]{7}`,
+	// Syncthing: "name.sync-conflict-20260501-120000-ABCDEFG.zip".
+	`\.sync-conflict-\d{8}-\d{6}-[A-Z0-9]{7}`,
+}
+
+// FindConflictCopies returns conflicting copies of the archive created by cloud sync clients next to it.
+func FindConflictCopies(fileName string) ([]string, error) {
+	ext := filepath.Ext(fileName)
+	base := strings.TrimSuffix(filepath.Base(fileName), ext)
+
+	re, err := regexp.Compile(fmt.Sprintf("^%s(%s)%s$", regexp.QuoteMeta(base), strings.Join(conflictCopyPatterns, "|"), regexp.QuoteMeta(ext)))
+	if err != nil {
+		return nil, err
+	}
+
+	directory := filepath.Dir(fileName)
+	entries, err := os.ReadDir(directory)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read directory %s: %w", directory, err)
+	}
+
+	var copies []string
+	for _, entry := range entries {
+		if !entry.IsDir() && re.MatchString(entry.Name()) {
+			copies = append(copies, filepath.Join(directory, entry.Name()))
+		}
+	}
+
+	return copies, nil
+}
+
+// OpenConflictCopies opens conflicting copies of the archive for reading.
+// Copies which can't be opened are reported to stderr and skipped.
+func OpenConflictCopies(fileName string, options ArchiveOptions) []*ChatLogsArchive {
+	copies, err := FindConflictCopies(fileName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to find conflicted copies of %s, skipping them: %s\n", fileName, err)
+		return nil
+	}
+
+	var archives []*ChatLogsArchive
+	for _, copyFileName := range copies {
+		archive, err := OpenChatLogsArchive(copyFileName, options)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s error, skipping it: %s\n", copyFileName, err)
+			continue
+		}
+
+		archives = append(archives, archive)
+	}
+
+	return archives
+}
+
+// RetireConflictCopies closes merged conflicting copies and moves them into "<archive>.merged" directory,
+// so they're not merged again. Copies with locked accounts are left in place, because their chat logs are not merged.
+func RetireConflictCopies(fileName string, copies []*ChatLogsArchive) error {
+	directory := strings.TrimSuffix(fileName, filepath.Ext(fileName)) + ".merged"
+
+	for _, archive := range copies {
+		_ = archive.Close()
+
+		if locked := archive.LockedAccounts(); len(locked) != 0 {
+			fmt.Printf("%s contains accounts encrypted with unavailable keys (%s), leaving it in place\n", archive.fileName, strings.Join(locked, ", "))
+			continue
+		}
+
+		err := os.MkdirAll(directory, 0755)
+		if err != nil {
+			return fmt.Errorf("unable to create directory %s: %w", directory, err)
+		}
+
+		retiredFileName, err := retiredCopyFileName(directory, filepath.Base(archive.fileName))
+		if err != nil {
+			return fmt.Errorf("unable to move %s into %s: %w", archive.fileName, directory, err)
+		}
+
+		err = os.Rename(archive.fileName, retiredFileName)
+		if err != nil {
+			return fmt.Errorf("unable to move %s into %s: %w", archive.fileName, directory, err)
+		}
+
+		fmt.Printf("%s merged and moved to %s\n", archive.fileName, retiredFileName)
+	}
+
+	return nil
+}
+
+// retiredCopyFileName returns name of the merged copy inside of the directory.
+// If another copy with the same name was merged before, number is added to the name, so it's not lost.
+func retiredCopyFileName(directory string, name string) (string, error) {
+	ext := filepath.Ext(name)
+
+	for n := 1; ; n++ {
+		fileName := filepath.Join(directory, name)
+		if n > 1 {
+			fileName = filepath.Join(directory, fmt.Sprintf("%s.%d%s", strings.TrimSuffix(name, ext), n, ext))
+		}
+
+		_, err := os.Lstat(fileName)
+		if errors.Is(err, os.ErrNotExist) {
+			return fileName, nil
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFindConflictCopies(t *testing.T) {
+	tests := []struct {
+		name     string
+		conflict bool
+	}{
+		{"sl_chat_logs (conflicted copy 2026-05-01).zip", true},
+		{"sl_chat_logs (John's conflicted copy 2026-05-01).zip", true},
+		{"sl_chat_logs (John's conflicted copy 2026-05-01 (1)).zip", true},
+		{"sl_chat_logs (conflicted copy 2026-05-01 120000).zip", true},
+		{"sl_chat_logs (conflicted copy john 2026-05-01 120000).zip", true},
+		{"sl_chat_logs (1).zip", true},
+		{"sl_chat_logs (12).zip", true},
+		{"sl_chat_logs-DESKTOP-ABC1234.zip", true},
+		{"sl_chat_logs-LAPTOP-0A1B2C3.zip", true},
+		{"sl_chat_logs.sync-conflict-20260501-120000-ABCDEFG.zip", true},
+
+		{"sl_chat_logs.zip", false},
+		{"sl_chat_logs-old.zip", false},
+		{"sl_chat_logs-backup.zip", false},
+		{"sl_chat_logs-Backup.zip", false},
+		{"sl_chat_logs-BACKUP.zip", false},
+		{"sl_chat_logs-2023.zip", false},
+		{"sl_chat_logs-LAPTOP.zip", false},
+		{"sl_chat_logs-OLD-2023.zip", false},
+		{"sl_chat_logs-DESKTOP-ABC123.zip", false},
+		{"sl_chat_logs-DESKTOP-ABC1234-EXTRA.zip", false},
+		{"sl_chat_logs (old).zip", false},
+		{"sl_chat_logs (copy).zip", false},
+		{"sl_chat_logs (conflicted copy).zip", false},
+		{"sl_chat_logs (1).txt", false},
+		{"sl_chat_logs.sync-conflict-old.zip", false},
+		{"other (1).zip", false},
+		{"sl_chat_logs_2 (1).zip", false},
+	}
+
+	directory := t.TempDir()
+	fileName := filepath.Join(directory, "sl_chat_logs.zip")
+
+	for _, test := range tests {
+		err := os.WriteFile(filepath.Join(directory, test.name), nil, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	copies, err := FindConflictCopies(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := make(map[string]bool)
+	for _, copyFileName := range copies {
+		found[filepath.Base(copyFileName)] = true
+	}
+
+	for _, test := range tests {
+		if found[test.name] != test.conflict {
+			t.Errorf("%s: conflict copy is %v, expected %v", test.name, found[test.name], test.conflict)
+		}
+	}
+}
+
+func TestRetireConflictCopiesKeepsBothCopies(t *testing.T) {
+	directory := t.TempDir()
+	fileName := filepath.Join(directory, "sl_chat_logs.zip")
+	copyFileName := filepath.Join(directory, "sl_chat_logs (1).zip")
+	retiredFileName := filepath.Join(directory, "sl_chat_logs.merged", "sl_chat_logs (1).zip")
+
+	writeTestZip(t, copyFileName, map[string]string{"alice/bob.txt": "[2023/06/30 12:00]  Bob: new\n"})
+
+	err := os.MkdirAll(filepath.Dir(retiredFileName), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(retiredFileName, []byte("retired before"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archive, err := OpenChatLogsArchive(copyFileName, ArchiveOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = RetireConflictCopies(fileName, []*ChatLogsArchive{archive})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(retiredFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "retired before" {
+		t.Errorf("retired copy is changed: %q", data)
+	}
+
+	if _, err := os.Stat(copyFileName); !os.IsNotExist(err) {
+		t.Errorf("conflict copy is left in place: %v", err)
+	}
+
+	archive, err = OpenChatLogsArchive(filepath.Join(filepath.Dir(retiredFileName), "sl_chat_logs (1).2.zip"), ArchiveOptions{})
+	if err != nil {
+		t.Fatalf("conflict copy is not kept under another name: %s", err)
+	}
+	defer archive.Close()
+
+	messages, err := archive.ReadChatLog("alice", "bob.txt")
+	if err != nil || len(messages) != 1 {
+		t.Errorf("chat log of retired copy is read as %d messages (%v)", len(messages), err)
+	}
+}
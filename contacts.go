@@ -0,0 +1,355 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// ConversationType is type of conversation stored in chat log file.
+type ConversationType string
+
+const (
+	// ConversationIM is instant messages with single avatar.
+	ConversationIM ConversationType = "im"
+	// ConversationGroup is group chat or ad-hoc conference.
+	ConversationGroup ConversationType = "group"
+	// ConversationLocal is nearby chat.
+	ConversationLocal ConversationType = "local"
+)
+
+// Contact is entry of contacts index, built from chat log history.
+type Contact struct {
+	FileName     string           `json:"file_name"`
+	Type         ConversationType `json:"type"`
+	UserName     string           `json:"user_name,omitempty"`
+	DisplayNames []DisplayName    `json:"display_names,omitempty"`
+	FirstSeen    time.Time        `json:"first_seen"`
+	LastSeen     time.Time        `json:"last_seen"`
+	Messages     int              `json:"messages"`
+}
+
+// DisplayName is display name of the contact and period when it was used.
+type DisplayName struct {
+	Name      string    `json:"name"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// NormalizeUserName converts SecondLife legacy name or account directory name into username.
+// E.g. "John Doe", "john_doe" and "john.doe" are all "john.doe", and "Jane Resident" is "jane".
+func NormalizeUserName(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	name = strings.NewReplacer(" ", ".", "_", ".").Replace(name)
+
+	return strings.TrimSuffix(name, ".resident")
+}
+
+// SplitSpeaker splits speaker of chat log message into display name and username.
+// Speaker is either "Display Name (user.name)", legacy "First Last" name, or display name only.
+// Username is empty if it can't be detected.
+func SplitSpeaker(speaker string) (displayName string, userName string) {
+	if strings.HasSuffix(speaker, ")") {
+		if index := strings.LastIndex(speaker, " ("); index > 0 {
+			return speaker[:index], NormalizeUserName(speaker[index+2 : len(speaker)-1])
+		}
+	}
+
+	// Legacy names are two words of latin letters and digits.
+	words := strings.Fields(speaker)
+	if len(words) == 2 && isLegacyNamePart(words[0]) && isLegacyNamePart(words[1]) {
+		return speaker, NormalizeUserName(speaker)
+	}
+
+	return speaker, ""
+}
+
+func isLegacyNamePart(s string) bool {
+	for _, r := range s {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9') {
+			return false
+		}
+	}
+
+	return s != ""
+}
+
+// withoutContacts returns contacts except for contacts of the chat logs.
+func withoutContacts(contacts []Contact, fileNames []string) (result []Contact) {
+	for _, contact := range contacts {
+		if !Contains(fileNames, contact.FileName) {
+			result = append(result, contact)
+		}
+	}
+
+	return
+}
+
+// BuildContact builds contacts index entry from the merged chat log of the account.
+func BuildContact(accountName string, fileName string, messages Messages) Contact {
+	name := strings.TrimSuffix(fileName, ".txt")
+	self := NormalizeUserName(accountName)
+
+	contact := Contact{FileName: fileName}
+
+	switch {
+	case name == "chat":
+		contact.Type = ConversationLocal
+	case strings.HasSuffix(name, "(group)") || strings.Contains(strings.ToLower(name), "conference"):
+		contact.Type = ConversationGroup
+	default:
+		contact.Type = ConversationIM
+		contact.UserName = NormalizeUserName(name)
+	}
+
+	// Display names by the time they were first seen.
+	displayNames := make(map[string]*DisplayName)
+	// Other avatars taking part in the conversation.
+	speakers := make(map[string]interface{})
+
+	for _, message := range messages {
+		if message.Timestamp == 0 {
+			continue
+		}
+
+		t := time.Unix(message.Timestamp, 0).UTC()
+
+		contact.Messages++
+		if contact.FirstSeen.IsZero() || t.Before(contact.FirstSeen) {
+			contact.FirstSeen = t
+		}
+		if t.After(contact.LastSeen) {
+			contact.LastSeen = t
+		}
+
+		speaker, _, kind := message.Parse()
+		if kind == MessageKindSystem {
+			continue
+		}
+
+		displayName, userName := SplitSpeaker(speaker)
+		if userName == self || displayName == "You" {
+			continue
+		}
+
+		if userName != "" {
+			speakers[userName] = nil
+		} else {
+			speakers[displayName] = nil
+		}
+
+		// Without username we can only guess that the other speaker of IM is the contact.
+		if contact.Type != ConversationIM || userName != "" && userName != contact.UserName {
+			continue
+		}
+
+		if d, ok := displayNames[displayName]; ok {
+			if t.Before(d.FirstSeen) {
+				d.FirstSeen = t
+			}
+			if t.After(d.LastSeen) {
+				d.LastSeen = t
+			}
+		} else {
+			displayNames[displayName] = &DisplayName{Name: displayName, FirstSeen: t, LastSeen: t}
+		}
+	}
+
+	// Only group chats have many speakers.
+	if contact.Type == ConversationIM && len(speakers) > 1 && len(displayNames) != len(speakers) {
+		contact.Type = ConversationGroup
+		contact.UserName = ""
+		displayNames = nil
+	}
+
+	for _, d := range displayNames {
+		contact.DisplayNames = append(contact.DisplayNames, *d)
+	}
+
+	sort.Slice(contact.DisplayNames, func(a, b int) bool {
+		return contact.DisplayNames[a].FirstSeen.Before(contact.DisplayNames[b].FirstSeen)
+	})
+
+	return contact
+}
+
+// Matches returns true if contact's file name, username or any of display names contains the text.
+func (c Contact) Matches(text string) bool {
+	text = strings.ToLower(text)
+
+	if strings.Contains(strings.ToLower(c.FileName), text) || strings.Contains(c.UserName, text) {
+		return true
+	}
+
+	for _, d := range c.DisplayNames {
+		if strings.Contains(strings.ToLower(d.Name), text) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SeenIn returns true if the contact was seen in the year.
+func (c Contact) SeenIn(year int) bool {
+	return c.Messages > 0 && c.FirstSeen.Year() <= year && c.LastSeen.Year() >= year
+}
+
+// contactsMetadataName is name of the account's contacts index inside of the archive.
+const contactsMetadataName = "contacts.json"
+
+// ReadContacts reads contacts index of the account from the archive.
+// Returns nil if there's no index for the account.
+func (a *ChatLogsArchive) ReadContacts(accountName string) ([]Contact, error) {
+	data, err := a.ReadAccountMetadata(accountName, contactsMetadataName)
+	if err != nil || data == nil {
+		return nil, err
+	}
+
+	var contacts []Contact
+	err = json.Unmarshal(data, &contacts)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse contacts index of %s: %w", accountName, err)
+	}
+
+	return contacts, nil
+}
+
+// WriteContacts writes contacts index of the account into new archive.
+func (a *ChatLogsArchive) WriteContacts(accountName string, contacts []Contact) error {
+	data, err := json.Marshal(contacts)
+	if err != nil {
+		return fmt.Errorf("unable to encode contacts index of %s: %w", accountName, err)
+	}
+
+	return a.WriteAccountMetadata(accountName, contactsMetadataName, data)
+}
+
+// runContacts prints contacts index.
+func runContacts(args []string) error {
+	flags := flag.NewFlagSet("contacts", flag.ExitOnError)
+	accountName := flags.String("account", "", "account name (can be omitted if there's only one account)")
+	search := flags.String("search", "", "show contacts with file name, username or display name containing the text")
+	year := flags.Int("year", 0, "show contacts seen in the year")
+	conversationType := flags.String("type", "", "show contacts of the type only: im, group or local")
+	format := flags.String("format", "table", "output format: table, csv or json")
+	rebuild := flags.Bool("rebuild", false, "build index from chat logs instead of reading it from the archive")
+	_ = flags.Parse(args)
+
+	storages, archive, err := openReadOnlyStorages()
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	account, err := resolveAccountName(storages, *accountName)
+	if err != nil {
+		return err
+	}
+
+	contacts, err := loadContacts(storages, archive, account, *rebuild)
+	if err != nil {
+		return err
+	}
+
+	var filtered []Contact
+	for _, contact := range contacts {
+		if *search != "" && !contact.Matches(*search) {
+			continue
+		}
+		if *year != 0 && !contact.SeenIn(*year) {
+			continue
+		}
+		if *conversationType != "" && string(contact.Type) != *conversationType {
+			continue
+		}
+
+		filtered = append(filtered, contact)
+	}
+
+	return WriteContacts(os.Stdout, *format, filtered)
+}
+
+// loadContacts reads contacts index of the account from the archive.
+// Index is built from merged chat logs if it's not in the archive or rebuild is true.
+func loadContacts(storages []ChatLogsStorage, archive ArchiveStorage, accountName string, rebuild bool) ([]Contact, error) {
+	if !rebuild {
+		contacts, err := archive.ReadContacts(accountName)
+		if err != nil || contacts != nil {
+			return contacts, err
+		}
+	}
+
+	fileNames, err := ListAllChatLogFileNames(storages, accountName)
+	if err != nil {
+		return nil, err
+	}
+
+	var contacts []Contact
+	for _, fileName := range fileNames {
+		messages, err := ReadMergedChatLog(storages, accountName, fileName)
+		if err != nil {
+			return nil, err
+		}
+
+		contacts = append(contacts, BuildContact(accountName, fileName, messages))
+	}
+
+	return contacts, nil
+}
+
+// WriteContacts writes contacts in the format: table, csv or json.
+func WriteContacts(w io.Writer, format string, contacts []Contact) error {
+	switch format {
+	case "table":
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(tw, "FILE\tTYPE\tUSERNAME\tDISPLAY NAMES\tFIRST SEEN\tLAST SEEN\tMESSAGES\n")
+		for _, contact := range contacts {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%d\n", contact.FileName, contact.Type, contact.UserName,
+				strings.Join(contact.displayNamesList(), ", "), formatDate(contact.FirstSeen), formatDate(contact.LastSeen), contact.Messages)
+		}
+		return tw.Flush()
+
+	case "csv":
+		cw := csv.NewWriter(w)
+		_ = cw.Write([]string{"file", "type", "username", "display_names", "first_seen", "last_seen", "messages"})
+		for _, contact := range contacts {
+			_ = cw.Write([]string{contact.FileName, string(contact.Type), contact.UserName,
+				strings.Join(contact.displayNamesList(), "; "), formatDate(contact.FirstSeen), formatDate(contact.LastSeen), strconv.Itoa(contact.Messages)})
+		}
+		cw.Flush()
+		return cw.Error()
+
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(contacts)
+	}
+
+	return fmt.Errorf("unsupported output format: %s", format)
+}
+
+func (c Contact) displayNamesList() []string {
+	names := make([]string, len(c.DisplayNames))
+	for i, d := range c.DisplayNames {
+		names[i] = d.Name
+	}
+
+	return names
+}
+
+func formatDate(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+
+	return t.Format("2006/01/02")
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/sha1"
+	"fmt"
+	"html"
+	"io"
+	"strings"
+	"text/template"
+	"time"
+	"unicode/utf8"
+)
+
+// EpubChapter is single chapter of EPUB book with chat log messages.
+type EpubChapter struct {
+	Title    string
+	Messages Messages
+}
+
+// SplitMessagesByMonth splits chat log messages into chapters, one chapter per month.
+func SplitMessagesByMonth(messages Messages) []EpubChapter {
+	return splitMessagesByTimeFormat(messages, "January 2006")
+}
+
+// SplitMessagesByDay splits chat log messages into chapters, one chapter per day.
+func SplitMessagesByDay(messages Messages) []EpubChapter {
+	return splitMessagesByTimeFormat(messages, "Monday, 2006/01/02")
+}
+
+// splitMessagesByTimeFormat starts new chapter each time formatted message time changes.
+func splitMessagesByTimeFormat(messages Messages, layout string) (chapters []EpubChapter) {
+	var title string
+
+	for _, message := range messages {
+		messageTitle := time.Unix(message.Timestamp, 0).UTC().Format(layout)
+		if len(chapters) == 0 || messageTitle != title {
+			title = messageTitle
+			chapters = append(chapters, EpubChapter{Title: title})
+		}
+
+		chapter := &chapters[len(chapters)-1]
+		chapter.Messages = append(chapter.Messages, message)
+	}
+
+	return
+}
+
+// SplitMessagesBySessions splits chat log messages into chapters, one chapter per session.
+// New session starts when pause between two messages is longer than gap.
+func SplitMessagesBySessions(messages Messages, gap time.Duration) (chapters []EpubChapter) {
+	var lastTimestamp int64
+
+	for _, message := range messages {
+		if len(chapters) == 0 || time.Duration(message.Timestamp-lastTimestamp)*time.Second > gap {
+			title := time.Unix(message.Timestamp, 0).UTC().Format("2006/01/02 15:04")
+			chapters = append(chapters, EpubChapter{Title: title})
+		}
+
+		lastTimestamp = message.Timestamp
+
+		chapter := &chapters[len(chapters)-1]
+		chapter.Messages = append(chapter.Messages, message)
+	}
+
+	return
+}
+
+// WriteEpub writes chat log chapters into the writer as EPUB 3 book.
+// Table of contents is written both as EPUB 3 navigation document and as EPUB 2 NCX for older e-readers.
+func WriteEpub(w io.Writer, title string, chapters []EpubChapter) error {
+	zw := zip.NewWriter(w)
+
+	// The mimetype file must be the first one in the container, and it must not be compressed.
+	f, err := zw.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store})
+	if err != nil {
+		return fmt.Errorf("error creating mimetype: %w", err)
+	}
+
+	_, err = io.WriteString(f, "application/epub+zip")
+	if err != nil {
+		return fmt.Errorf("error writing mimetype: %w", err)
+	}
+
+	data := epubData{
+		Identifier: fmt.Sprintf("urn:uuid:%s", epubUUID(title)),
+		Title:      title,
+		Modified:   time.Now().UTC().Format("2006-01-02T15:04:05Z"),
+	}
+	for i, chapter := range chapters {
+		data.Chapters = append(data.Chapters, epubChapterData{
+			ID:       fmt.Sprintf("chapter-%04d", i+1),
+			FileName: fmt.Sprintf("chapter-%04d.xhtml", i+1),
+			Index:    i + 1,
+			Title:    chapter.Title,
+			Messages: chapter.Messages,
+		})
+	}
+
+	files := []struct {
+		name     string
+		template *template.Template
+		data     interface{}
+	}{
+		{"META-INF/container.xml", epubContainerTemplate, data},
+		{"OEBPS/content.opf", epubPackageTemplate, data},
+		{"OEBPS/nav.xhtml", epubNavTemplate, data},
+		{"OEBPS/toc.ncx", epubNcxTemplate, data},
+		{"OEBPS/style.css", epubStyleTemplate, data},
+	}
+	for _, chapter := range data.Chapters {
+		files = append(files, struct {
+			name     string
+			template *template.Template
+			data     interface{}
+		}{"OEBPS/" + chapter.FileName, epubChapterTemplate, chapter})
+	}
+
+	for _, file := range files {
+		f, err := zw.Create(file.name)
+		if err != nil {
+			return fmt.Errorf("error creating %s: %w", file.name, err)
+		}
+
+		err = file.template.Execute(f, file.data)
+		if err != nil {
+			return fmt.Errorf("error writing %s: %w", file.name, err)
+		}
+	}
+
+	err = zw.Close()
+	if err != nil {
+		return fmt.Errorf("error closing EPUB container: %w", err)
+	}
+
+	return nil
+}
+
+type epubData struct {
+	Identifier string
+	Title      string
+	Modified   string
+	Chapters   []epubChapterData
+}
+
+type epubChapterData struct {
+	ID       string
+	FileName string
+	Index    int
+	Title    string
+	Messages Messages
+}
+
+// epubUUID returns stable UUID for the book, so re-exported book replaces the old one in e-reader library.
+func epubUUID(title string) string {
+	h := sha1.Sum([]byte(title))
+	h[6] = (h[6] & 0x0f) | 0x50
+	h[8] = (h[8] & 0x3f) | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", h[0:4], h[4:6], h[6:8], h[8:10], h[10:16])
+}
+
+// xhtmlEscape escapes text for XHTML document.
+// Characters which are not allowed in XML are dropped, and newlines are replaced with line breaks.
+func xhtmlEscape(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r == '\t' || r == '\n' || r == '\r' || (r >= 0x20 && r != utf8.RuneError && r != 0xfffe && r != 0xffff) {
+			return r
+		}
+		return -1
+	}, s)
+
+	s = html.EscapeString(strings.TrimRight(s, "\r\n"))
+
+	return strings.ReplaceAll(s, "\n", "<br/>")
+}
+
+var epubFuncs = template.FuncMap{
+	"escape": xhtmlEscape,
+	"time": func(timestamp int64) string {
+		return time.Unix(timestamp, 0).UTC().Format("2006/01/02 15:04")
+	},
+	"text": func(message *Message) string {
+		return message.Body()
+	},
+}
+
+var epubContainerTemplate = template.Must(template.New("container").Funcs(epubFuncs).Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles>
+    <rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+  </rootfiles>
+</container>
+`))
+
+var epubPackageTemplate = template.Must(template.New("package").Funcs(epubFuncs).Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="book-id">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="book-id">{{.Identifier}}</dc:identifier>
+    <dc:title>{{escape .Title}}</dc:title>
+    <dc:language>en</dc:language>
+    <meta property="dcterms:modified">{{.Modified}}</meta>
+  </metadata>
+  <manifest>
+    <item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+    <item id="ncx" href="toc.ncx" media-type="application/x-dtbncx+xml"/>
+    <item id="style" href="style.css" media-type="text/css"/>
+{{- range .Chapters}}
+    <item id="{{.ID}}" href="{{.FileName}}" media-type="application/xhtml+xml"/>
+{{- end}}
+  </manifest>
+  <spine toc="ncx">
+{{- range .Chapters}}
+    <itemref idref="{{.ID}}"/>
+{{- end}}
+  </spine>
+</package>
+`))
+
+var epubNavTemplate = template.Must(template.New("nav").Funcs(epubFuncs).Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops">
+<head>
+  <title>{{escape .Title}}</title>
+</head>
+<body>
+  <nav epub:type="toc" id="toc">
+    <h1>{{escape .Title}}</h1>
+    <ol>
+{{- range .Chapters}}
+      <li><a href="{{.FileName}}">{{escape .Title}}</a></li>
+{{- end}}
+    </ol>
+  </nav>
+</body>
+</html>
+`))
+
+var epubNcxTemplate = template.Must(template.New("ncx").Funcs(epubFuncs).Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<ncx xmlns="http://www.daisy.org/z3986/2005/ncx/" version="2005-1">
+  <head>
+    <meta name="dtb:uid" content="{{.Identifier}}"/>
+  </head>
+  <docTitle><text>{{escape .Title}}</text></docTitle>
+  <navMap>
+{{- range .Chapters}}
+    <navPoint id="nav-{{.ID}}" playOrder="{{.Index}}">
+      <navLabel><text>{{escape .Title}}</text></navLabel>
+      <content src="{{.FileName}}"/>
+    </navPoint>
+{{- end}}
+  </navMap>
+</ncx>
+`))
+
+var epubStyleTemplate = template.Must(template.New("style").Parse(`p.message { margin: 0 0 0.5em 0; }
+span.time { color: #777; font-size: 0.8em; margin-right: 0.5em; }
+span.conversation { color: #369; font-size: 0.8em; margin-right: 0.5em; }
+`))
+
+var epubChapterTemplate = template.Must(template.New("chapter").Funcs(epubFuncs).Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml">
+<head>
+  <title>{{escape .Title}}</title>
+  <link rel="stylesheet" type="text/css" href="style.css"/>
+</head>
+<body>
+  <h2>{{escape .Title}}</h2>
+{{- range .Messages}}
+  <p class="message">{{if .Timestamp}}<span class="time">{{time .Timestamp}}</span>{{end}}{{if .Conversation}}<span class="conversation">{{escape .Conversation}}</span>{{end}}{{escape (text .)}}</p>
+{{- end}}
+</body>
+</html>
+`))
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// runExport exports merged conversation or contacts index from all storages into a file.
+func runExport(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	format := flags.String("format", "epub", "export format: epub, contacts-csv or contacts-json")
+	accountName := flags.String("account", "", "account name (can be omitted if there's only one account)")
+	conversation := flags.String("conversation", "", "conversation chat log file name for epub, e.g. \"john.doe.txt\"")
+	split := flags.String("split", "month", "how to split book into chapters: month or session")
+	sessionGap := flags.Duration("session-gap", 2*time.Hour, "pause between messages which starts new session")
+	output := flags.String("o", "", "output file name (default: <conversation>.epub or contacts.<format>)")
+	_ = flags.Parse(args)
+
+	storages, archive, err := openReadOnlyStorages()
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	account, err := resolveAccountName(storages, *accountName)
+	if err != nil {
+		return err
+	}
+
+	switch *format {
+	case "epub":
+		return exportEpub(storages, account, *conversation, *split, *sessionGap, *output)
+	case "contacts-csv", "contacts-json":
+		return exportContacts(storages, archive, account, strings.TrimPrefix(*format, "contacts-"), *output)
+	}
+
+	return fmt.Errorf("unsupported export format: %s", *format)
+}
+
+// exportEpub exports merged conversation as EPUB book.
+func exportEpub(storages []ChatLogsStorage, accountName string, conversation string, split string, sessionGap time.Duration, outputFileName string) error {
+	if conversation == "" {
+		return fmt.Errorf("conversation is not specified")
+	}
+
+	fileName := conversation
+	if !strings.HasSuffix(fileName, ".txt") {
+		fileName += ".txt"
+	}
+
+	messages, err := ReadMergedChatLog(storages, accountName, fileName)
+	if err != nil {
+		return err
+	}
+
+	if len(messages) == 0 {
+		return fmt.Errorf("conversation %s of %s not found", fileName, accountName)
+	}
+
+	var chapters []EpubChapter
+	switch split {
+	case "month":
+		chapters = SplitMessagesByMonth(messages)
+	case "session":
+		chapters = SplitMessagesBySessions(messages, sessionGap)
+	default:
+		return fmt.Errorf("unsupported split mode: %s", split)
+	}
+
+	if outputFileName == "" {
+		outputFileName = strings.TrimSuffix(fileName, ".txt") + ".epub"
+	}
+
+	title := fmt.Sprintf("%s: %s", accountName, strings.TrimSuffix(fileName, ".txt"))
+
+	err = writeExportFile(outputFileName, func(w io.Writer) error {
+		return WriteEpub(w, title, chapters)
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%d messages exported into %s\n", len(messages), outputFileName)
+
+	return nil
+}
+
+// exportContacts exports contacts index of the account as csv or json.
+func exportContacts(storages []ChatLogsStorage, archive ArchiveStorage, accountName string, format string, outputFileName string) error {
+	contacts, err := loadContacts(storages, archive, accountName, false)
+	if err != nil {
+		return err
+	}
+
+	if outputFileName == "" {
+		outputFileName = "contacts." + format
+	}
+
+	err = writeExportFile(outputFileName, func(w io.Writer) error {
+		return WriteContacts(w, format, contacts)
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%d contacts exported into %s\n", len(contacts), outputFileName)
+
+	return nil
+}
+
+// writeExportFile creates the file and writes it with write function.
+// The file is removed if it can't be written.
+func writeExportFile(fileName string, write func(w io.Writer) error) error {
+	f, err := os.Create(fileName)
+	if err != nil {
+		return fmt.Errorf("unable to create %s: %w", fileName, err)
+	}
+
+	err = write(f)
+	if err != nil {
+		_ = f.Close()
+		_ = os.Remove(fileName)
+		return fmt.Errorf("unable to write %s: %w", fileName, err)
+	}
+
+	err = f.Close()
+	if err != nil {
+		return fmt.Errorf("unable to close %s: %w", fileName, err)
+	}
+
+	return nil
+}
+
+// resolveAccountName checks that account exists in storages.
+// If account name is empty and there's only one account, it's returned.
+func resolveAccountName(storages []ChatLogsStorage, accountName string) (string, error) {
+	accountNames, err := GetAllAccountNames(storages)
+	if err != nil {
+		return "", err
+	}
+
+	if accountName == "" {
+		if len(accountNames) != 1 {
+			return "", fmt.Errorf("account is not specified, available accounts: %s", strings.Join(accountNames, ", "))
+		}
+
+		return accountNames[0], nil
+	}
+
+	if !Contains(accountNames, accountName) {
+		return "", fmt.Errorf("account %s not found", accountName)
+	}
+
+	return accountName, nil
+}
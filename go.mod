@@ -4,12 +4,16 @@ go 1.20
 
 require (
 	github.com/cheggaaa/pb/v3 v3.1.2
-	golang.org/x/sys v0.6.0
+	github.com/pkg/sftp v1.13.6
+	golang.org/x/crypto v0.14.0
+	golang.org/x/sys v0.13.0
+	golang.org/x/term v0.13.0
 )
 
 require (
 	github.com/VividCortex/ewma v1.2.0 // indirect
 	github.com/fatih/color v1.14.1 // indirect
+	github.com/kr/fs v0.1.0 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.17 // indirect
 	github.com/mattn/go-runewidth v0.0.14 // indirect
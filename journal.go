@@ -0,0 +1,156 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// ReadJournal reads all conversations of the account and interleaves messages sent within [from, to) into single timeline.
+// Each message is tagged by its conversation name.
+func ReadJournal(storages []ChatLogsStorage, accountName string, from time.Time, to time.Time) (Messages, error) {
+	fileNames, err := ListAllChatLogFileNames(storages, accountName)
+	if err != nil {
+		return nil, err
+	}
+
+	var conversations []Messages
+	for _, fileName := range fileNames {
+		messages, err := ReadMergedChatLog(storages, accountName, fileName)
+		if err != nil {
+			return nil, err
+		}
+
+		conversation := strings.TrimSuffix(fileName, ".txt")
+
+		var selected Messages
+		for _, message := range messages {
+			if message.Timestamp < from.Unix() || message.Timestamp >= to.Unix() {
+				continue
+			}
+
+			message.Conversation = conversation
+			selected = append(selected, message)
+		}
+
+		conversations = append(conversations, selected)
+	}
+
+	return Merge(conversations...), nil
+}
+
+// WriteJournal writes journal messages as plain text, each message is prefixed with its conversation name.
+func WriteJournal(w io.Writer, messages Messages) error {
+	var day string
+
+	for _, message := range messages {
+		t := time.Unix(message.Timestamp, 0).UTC()
+
+		if d := t.Format("2006/01/02"); d != day {
+			if day != "" {
+				fmt.Fprintf(w, "\n")
+			}
+			day = d
+
+			_, err := fmt.Fprintf(w, "=== %s ===\n", t.Format("Monday, 2006/01/02"))
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err := fmt.Fprintf(w, "[%s] [%s] %s\n", t.Format("15:04"), message.Conversation, message.Body())
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// runJournal prints or exports all conversations of the account for the date range as single timeline.
+func runJournal(args []string) error {
+	flags := flag.NewFlagSet("journal", flag.ExitOnError)
+	accountName := flags.String("account", "", "account name (can be omitted if there's only one account)")
+	fromDate := flags.String("from", "", "first day of the journal, YYYY-MM-DD (default: today)")
+	toDate := flags.String("to", "", "last day of the journal, YYYY-MM-DD (default: same as -from)")
+	format := flags.String("format", "text", "output format: text or epub")
+	output := flags.String("o", "", "output file name (default: stdout for text, journal.epub for epub)")
+	_ = flags.Parse(args)
+
+	// Chat logs timestamps are in local time of the viewer, they're stored as UTC.
+	from := time.Now()
+	from = time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, time.UTC)
+	if *fromDate != "" {
+		t, err := time.Parse("2006-01-02", *fromDate)
+		if err != nil {
+			return fmt.Errorf("invalid -from date: %w", err)
+		}
+		from = t
+	}
+
+	to := from
+	if *toDate != "" {
+		t, err := time.Parse("2006-01-02", *toDate)
+		if err != nil {
+			return fmt.Errorf("invalid -to date: %w", err)
+		}
+		to = t
+	}
+
+	if to.Before(from) {
+		return fmt.Errorf("-to date is before -from date")
+	}
+
+	storages, archive, err := openReadOnlyStorages()
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	account, err := resolveAccountName(storages, *accountName)
+	if err != nil {
+		return err
+	}
+
+	messages, err := ReadJournal(storages, account, from, to.AddDate(0, 0, 1))
+	if err != nil {
+		return err
+	}
+
+	switch *format {
+	case "text":
+		if *output == "" {
+			return WriteJournal(os.Stdout, messages)
+		}
+
+		err = writeExportFile(*output, func(w io.Writer) error {
+			return WriteJournal(w, messages)
+		})
+
+	case "epub":
+		if *output == "" {
+			*output = "journal.epub"
+		}
+
+		title := fmt.Sprintf("%s: journal %s - %s", account, from.Format("2006/01/02"), to.Format("2006/01/02"))
+		chapters := SplitMessagesByDay(messages)
+
+		err = writeExportFile(*output, func(w io.Writer) error {
+			return WriteEpub(w, title, chapters)
+		})
+
+	default:
+		return fmt.Errorf("unsupported output format: %s", *format)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%d messages exported into %s\n", len(messages), *output)
+
+	return nil
+}
@@ -1,98 +1,420 @@
 package main
 
 import (
+	"archive/zip"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
 	"sort"
 
 	"github.com/cheggaaa/pb/v3"
 )
 
 var (
-	ArchiveOnly     = flag.Bool("archive-only", false, "don't replace existing chat log files, archive only")
+	ArchiveOnly     = flag.Bool("archive-only", false, "don't replace existing chat log files, archive only; other commands read the archive only")
 	ArchiveFileName = flag.String("archive", "sl_chat_logs.zip", "Archive file name")
+	BackupDirectory = flag.String("backup-dir", "", "directory of SecondLife clients' chat logs backups (default: sl-chat-log-sync/backups in user configuration directory)")
+	BackupKeep      = flag.Int("backup-keep", 30, "how many backups of SecondLife clients' chat logs are kept, 0 disables backups")
+	BackupDays      = flag.Int("backup-days", 90, "how many days backups of SecondLife clients' chat logs are kept, 0 keeps them regardless of age")
+	Recover         = flag.Bool("recover", false, "salvage readable chat logs if the archive is damaged, damaged archive is kept aside")
+	KeepGenerations = flag.Int("keep-generations", 10, "how many previous versions of the archive are kept in its history, 0 disables history")
+	HistoryRoot     = flag.String("history-dir", "", "directory of previous versions of archives (default: sl-chat-log-sync/history in user configuration directory)")
+	ShardBy         = flag.String("shard-by", ShardByAccount, "layout of new shards of sharded archive (\"-archive sharded:<directory>\"): account or year")
+	ViewerRunning   = flag.String("viewer-running", ViewerRunningRefuse, "what sync does while SecondLife viewer is running: refuse, defer until it exits, or archive-only")
+	KeyFileName     = flag.String("keyfile", "", "file containing passphrase of encrypted archive (default: "+PassphraseEnvironmentVariable+" environment variable or ask for it)")
+
+	AccountKeyFileNames = make(AccountKeyFiles)
 )
 
+func init() {
+	flag.Var(AccountKeyFileNames, "account-keyfile", "account=file containing passphrase of the account encrypted with its own key, can be repeated (default: "+PassphraseEnvironmentVariable+"_<ACCOUNT> environment variable or ask for it)")
+}
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [options] [command] [command options]\n\n", os.Args[0])
+	fmt.Fprintf(flag.CommandLine.Output(), "Commands:\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "  sync      synchronize chat logs between SecondLife clients and archive (default)\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "  export    export conversation into a file\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "  serve     browse chat logs in web browser\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "  stats     show chat activity report\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "  contacts  show contacts index\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "  journal   show all conversations for the date range as single timeline\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "  encrypt   encrypt archive with passphrase, or change passphrase\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "  decrypt   convert encrypted archive into plain one\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "  verify    check the archive integrity\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "  history   list previous versions of the archive\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "  rollback  restore previous version of the archive\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "  migrate   upgrade the archive to the current format version\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "  serve-peer\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "            serve chat logs of SecondLife clients to other devices in local network\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "  sync-peer synchronize chat logs with another device running serve-peer\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "  watch     keep running and synchronize chat logs whenever they change\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "  restore-backup\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "            put chat logs of SecondLife clients back as they were before sync\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "\nOptions:\n")
+	flag.PrintDefaults()
+}
+
 func main() {
+	flag.Usage = usage
 	flag.Parse()
 
-	var inputStorages []ChatLogsStorage
+	err := checkFlags()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
+		os.Exit(2)
+		return
+	}
 
-	// Check each SecondLife client.
-	for _, clientApp := range SecondLifeClients {
-		directory, err := clientApp.GetDirectory()
+	command := flag.Arg(0)
+
+	// Commands working with the archive file itself don't support other archive storages.
+	switch command {
+	case "encrypt", "decrypt", "verify", "history", "rollback", "migrate":
+		err = requireZipArchive(command, *ArchiveFileName)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "%s detection error, skipping it: %s\n", clientApp, err)
-			continue
+			fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
+			os.Exit(1)
+			return
 		}
+	}
+
+	switch command {
+	case "", "sync":
+		err = runSync()
+	case "export":
+		err = runExport(flag.Args()[1:])
+	case "serve":
+		err = runServe(flag.Args()[1:])
+	case "stats":
+		err = runStats(flag.Args()[1:])
+	case "contacts":
+		err = runContacts(flag.Args()[1:])
+	case "journal":
+		err = runJournal(flag.Args()[1:])
+	case "encrypt":
+		err = runEncryptArchive(flag.Args()[1:])
+	case "decrypt":
+		err = runDecryptArchive(flag.Args()[1:])
+	case "verify":
+		err = runVerify(flag.Args()[1:])
+	case "history":
+		err = runHistory(flag.Args()[1:])
+	case "rollback":
+		err = runRollback(flag.Args()[1:])
+	case "migrate":
+		err = runMigrate(flag.Args()[1:])
+	case "serve-peer":
+		err = runServePeer(flag.Args()[1:])
+	case "sync-peer":
+		err = runSyncPeer(flag.Args()[1:])
+	case "watch":
+		err = runWatch(flag.Args()[1:])
+	case "restore-backup":
+		err = runRestoreBackup(flag.Args()[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command: %s\n", command)
+		flag.Usage()
+		os.Exit(2)
+		return
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
+		os.Exit(1)
+		return
+	}
+}
 
-		exists, err := IsDirectoryExists(directory)
+// Passphrases are asked once per process, even if the archive is opened many times, e.g. by watch.
+var (
+	archivePassphrase        PassphraseFunc
+	archiveAccountPassphrase AccountPassphraseFunc
+)
+
+// checkFlags returns error if value of any option is not supported.
+func checkFlags() error {
+	switch *ShardBy {
+	case ShardByAccount, ShardByYear:
+	default:
+		return fmt.Errorf("unsupported -shard-by %s, account or year expected", *ShardBy)
+	}
+
+	return checkViewerRunningMode()
+}
+
+// archiveOptions returns options for opening archive set by command line flags.
+func archiveOptions() ArchiveOptions {
+	if archivePassphrase == nil {
+		archivePassphrase = NewPassphraseFunc(*KeyFileName)
+		archiveAccountPassphrase = NewAccountPassphraseFunc(AccountKeyFileNames)
+	}
+
+	return ArchiveOptions{
+		Passphrase:        archivePassphrase,
+		AccountPassphrase: archiveAccountPassphrase,
+		KeepGenerations:   *KeepGenerations,
+	}
+}
+
+// backupOptions returns options of SecondLife clients' chat logs backups set by command line flags.
+func backupOptions() (BackupOptions, error) {
+	options := BackupOptions{
+		Directory: *BackupDirectory,
+		Keep:      *BackupKeep,
+		Days:      *BackupDays,
+	}
+
+	if options.Directory == "" {
+		var err error
+		options.Directory, err = DefaultBackupDirectory()
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "%s detection error, skipping it: %s\n", clientApp, err)
-			continue
+			return options, err
 		}
+	}
 
-		if exists {
-			fmt.Printf("%s found\n", clientApp)
+	return options, nil
+}
 
+// openReadOnlyStorages returns detected SecondLife clients and chat logs archive opened for reading.
+// SecondLife clients are skipped if -archive-only is set.
+// Archive must be closed by the caller.
+func openReadOnlyStorages() ([]ChatLogsStorage, ArchiveStorage, error) {
+	var storages []ChatLogsStorage
+	if !*ArchiveOnly {
+		for _, clientApp := range DetectSecondLifeClients() {
 			clientApp := clientApp
-			inputStorages = append(inputStorages, &clientApp)
+			storages = append(storages, &clientApp)
+		}
+	}
+
+	options := archiveOptions()
+
+	archive, err := OpenArchiveStorage(*ArchiveFileName, options)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to open %s: %w", *ArchiveFileName, err)
+	}
+
+	storages = append(storages, archive)
+
+	// Conflicted copies are never closed, they're read until the end of the process.
+	if kind, _ := ParseArchiveSpec(*ArchiveFileName); kind == ArchiveKindZip {
+		for _, conflictCopy := range OpenConflictCopies(*ArchiveFileName, options) {
+			storages = append(storages, conflictCopy)
 		}
 	}
 
+	return storages, archive, nil
+}
+
+// runSync merges chat logs of all found SecondLife clients and the archive, and writes them back.
+func runSync() error {
+	return syncChatLogs(nil, nil)
+}
+
+// syncChatLogs merges chat logs of all found SecondLife clients, peers and the archive, and writes them back.
+// Merged chat logs are staged first, and then committed all together,
+// so failed sync changes nothing, and sync interrupted while committing is resumed on next run.
+// Peers are committed after the archive, they're merged again on next sync if it fails.
+// If SecondLife viewer is running, sync fails, waits for it, or writes the archive only, see -viewer-running.
+// If changed is set, only changed chat logs are merged, see mergeAllChatLogs.
+func syncChatLogs(peers []*PeerStorage, changed ChangedChatLogs) error {
+	committed := false
+	defer func() {
+		if !committed {
+			for _, peer := range peers {
+				peer.Abort()
+			}
+		}
+	}()
+
+	archiveOnly, err := checkRunningViewers()
+	if err != nil {
+		return err
+	}
+
+	stateDirectory, err := StateDirectory()
+	if err != nil {
+		return err
+	}
+
+	transactionDirectory := filepath.Join(stateDirectory, "pending")
+
+	// Another sync, e.g. watch, would discard chat logs staged by this one.
+	lock, err := LockSyncTransaction(transactionDirectory)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	// Interrupted sync writes chat logs of SecondLife clients, so it's resumed only when they can be written.
+	if !archiveOnly {
+		err = RecoverSyncTransaction(transactionDirectory)
+		if err != nil {
+			return err
+		}
+	} else if HasInterruptedSync(transactionDirectory) {
+		fmt.Printf("Interrupted sync is resumed when chat logs of SecondLife clients can be written\n")
+	}
+
+	backupOptions, err := backupOptions()
+	if err != nil {
+		return err
+	}
+
+	// Chat logs of SecondLife clients are saved into the backup before they're changed.
+	transaction := NewSyncTransaction(transactionDirectory, NewChatLogsBackup(backupOptions))
+
+	var inputStorages []ChatLogsStorage
+	var clientStorages []ChatLogsStorage
+
+	// Check each SecondLife client.
+	for _, clientApp := range DetectSecondLifeClients() {
+		fmt.Printf("%s found\n", clientApp)
+
+		clientApp := clientApp
+		inputStorages = append(inputStorages, &clientApp)
+		clientStorages = append(clientStorages, StagedClient{SecondLifeClient: clientApp, transaction: transaction})
+	}
+
+	for _, peer := range peers {
+		fmt.Printf("%s found\n", peer)
+
+		inputStorages = append(inputStorages, peer)
+		clientStorages = append(clientStorages, peer)
+	}
+
 	if len(inputStorages) == 0 {
 		fmt.Printf("No SecondLife clients found.\n")
-		os.Exit(0)
-		return
+		return nil
 	}
 
 	// Open archives.
-	archive, err := ReadChatLogsArchive(*ArchiveFileName)
+	archive, conflictCopies, err := openSyncArchive()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "%s error, skipping it: %s\n", *ArchiveFileName, err)
-		os.Exit(1)
-		return
+		return err
 	}
 
 	inputStorages = append(inputStorages, archive)
-	defer func() {
-		err := archive.Close()
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
-			os.Exit(1)
-			return
-		}
-	}()
 
 	var outputStorages []ChatLogsStorage
-	if *ArchiveOnly {
+	if archiveOnly {
 		outputStorages = []ChatLogsStorage{archive}
 	} else {
-		outputStorages = inputStorages
+		outputStorages = append(clientStorages, archive)
 	}
 
-	// Retrieve all account names.
-	var accountNames []string
+	// Conflicted copies of the archive made by cloud sync clients are merged too, but never written.
+	// They're retired after the sync, so all chat logs are merged with them.
+	if len(conflictCopies) != 0 {
+		changed = nil
+	}
 
-	for _, storage := range inputStorages {
-		storageAccountNames, err := storage.GetAccountNames()
+	for _, conflictCopy := range conflictCopies {
+		fmt.Printf("%s found\n", conflictCopy.fileName)
+		inputStorages = append(inputStorages, conflictCopy)
+	}
+
+	merged, err := mergeAllChatLogs(inputStorages, outputStorages, archive, changed)
+	if err != nil || !merged {
+		archive.Abort()
+		_ = transaction.Discard()
+		return err
+	}
+
+	err = transaction.Commit(archive)
+	if err != nil {
+		return err
+	}
+
+	committed = true
+
+	for _, peer := range peers {
+		err = peer.Close()
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
-			os.Exit(1)
-			return
+			return fmt.Errorf("chat logs of this device are synced, but %s is not: %w", peer, err)
 		}
+	}
 
-		accountNames = append(accountNames, storageAccountNames...)
+	return RetireConflictCopies(*ArchiveFileName, conflictCopies)
+}
+
+// openSyncArchive opens the archive storage for sync.
+// .zip archive is salvaged if -recover is set, and upgraded to the current format version,
+// its conflicted copies made by cloud sync clients are opened too.
+func openSyncArchive() (ArchiveStorage, []*ChatLogsArchive, error) {
+	options := archiveOptions()
+
+	if kind, _ := ParseArchiveSpec(*ArchiveFileName); kind != ArchiveKindZip {
+		archive, err := ReadArchiveStorage(*ArchiveFileName, options)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to open %s: %w", *ArchiveFileName, err)
+		}
+
+		return archive, nil, nil
+	}
+
+	if *Recover {
+		err := RecoverArchive(*ArchiveFileName)
+		if err != nil {
+			return nil, nil, err
+		}
 	}
 
-	accountNames = Unique(accountNames)
-	sort.Strings(accountNames)
+	// Archive written by older version of the application is upgraded first.
+	err := MigrateArchive(*ArchiveFileName, options)
+	if errors.Is(err, zip.ErrFormat) {
+		return nil, nil, fmt.Errorf("%s is damaged, use -recover to salvage readable chat logs: %w", *ArchiveFileName, err)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	archive, err := ReadChatLogsArchive(*ArchiveFileName, options)
+	if errors.Is(err, zip.ErrFormat) {
+		return nil, nil, fmt.Errorf("%s is damaged, use -recover to salvage readable chat logs: %w", *ArchiveFileName, err)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to open %s: %w", *ArchiveFileName, err)
+	}
+
+	return archive, OpenConflictCopies(*ArchiveFileName, options), nil
+}
+
+// mergeAllChatLogs merges chat logs of all accounts found in input storages, and writes them into output storages.
+// If changed is set, only changed chat logs are merged, and contacts indexes are updated for them only.
+// Chat logs which are not merged are kept in the archive as they are.
+// Returns false if there are no accounts to merge.
+func mergeAllChatLogs(inputStorages []ChatLogsStorage, outputStorages []ChatLogsStorage, archive ArchiveStorage, changed ChangedChatLogs) (bool, error) {
+	// Retrieve all account names.
+	accountNames, err := GetAllAccountNames(inputStorages)
+	if err != nil {
+		return false, err
+	}
+
+	if changed != nil {
+		var changedAccountNames []string
+		for _, accountName := range accountNames {
+			if len(changed[accountName]) != 0 {
+				changedAccountNames = append(changedAccountNames, accountName)
+			}
+		}
+		accountNames = changedAccountNames
+	}
+
+	// Accounts encrypted with other people's keys are left untouched.
+	for _, accountName := range archive.LockedAccounts() {
+		if Contains(accountNames, accountName) {
+			fmt.Printf("%s is encrypted with its own key, which is not available, skipping it\n", accountName)
+		}
+	}
+	accountNames = Subtract(accountNames, archive.LockedAccounts())
 
 	if len(accountNames) == 0 {
 		fmt.Printf("No SecondLife accounts found.\n")
-		os.Exit(0)
-		return
+		return false, nil
 	}
 
 	fmt.Printf("Accounts found:\n")
@@ -100,57 +422,128 @@ func main() {
 		fmt.Printf(" - %s\n", accountName)
 	}
 
+	// mergedFileNames are chat logs merged, by account.
+	mergedFileNames := make(map[string][]string)
+
 	// Read all chat logs and merge them.
 	for _, accountName := range accountNames {
 		fmt.Printf("Merging %s chat logs...\n", accountName)
 
-		var chatLogsFileNames []string
-		for _, storage := range inputStorages {
-			_, fileNames, err := storage.ListChatLogFileNames(accountName)
+		chatLogsFileNames, err := ListAllChatLogFileNames(inputStorages, accountName)
+		if err != nil {
+			return false, err
+		}
+
+		var contacts []Contact
+
+		// Contacts of changed chat logs are replaced in the index, whole index is built if there's no one.
+		if changed != nil {
+			contacts, err = archive.ReadContacts(accountName)
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
-				os.Exit(1)
-				return
+				return false, err
 			}
 
-			chatLogsFileNames = append(chatLogsFileNames, fileNames...)
+			if contacts != nil {
+				chatLogsFileNames = changed.FileNames(accountName)
+				contacts = withoutContacts(contacts, chatLogsFileNames)
+			}
 		}
 
-		chatLogsFileNames = Unique(chatLogsFileNames)
-		sort.Strings(chatLogsFileNames)
-
 		bar := pb.StartNew(len(chatLogsFileNames))
 
 		for _, fileName := range chatLogsFileNames {
-			var chatLogs []Messages
-
-			for _, storage := range inputStorages {
-				messages, err := storage.ReadChatLog(accountName, fileName)
-				if err != nil {
-					bar.Finish()
-					fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
-					os.Exit(1)
-					return
-				}
-
-				chatLogs = append(chatLogs, messages)
+			merged, err := ReadMergedChatLog(inputStorages, accountName, fileName)
+			if err != nil {
+				bar.Finish()
+				return false, err
 			}
 
-			merged := Merge(chatLogs...)
-
 			for _, storage := range outputStorages {
 				err := storage.WriteChatLog(accountName, fileName, merged)
 				if err != nil {
 					bar.Finish()
-					fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
-					os.Exit(1)
-					return
+					return false, err
 				}
 			}
 
+			contacts = append(contacts, BuildContact(accountName, fileName, merged))
+
 			bar.Increment()
 		}
 
 		bar.Finish()
+
+		sort.Slice(contacts, func(i, j int) bool {
+			return contacts[i].FileName < contacts[j].FileName
+		})
+
+		err = archive.WriteContacts(accountName, contacts)
+		if err != nil {
+			return false, err
+		}
+
+		mergedFileNames[accountName] = chatLogsFileNames
+	}
+
+	if changed != nil {
+		err = keepUnmergedChatLogs(archive, mergedFileNames)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// keepUnmergedChatLogs copies chat logs and contacts indexes which are not merged into new archive,
+// unless the archive storage keeps them by itself.
+func keepUnmergedChatLogs(archive ArchiveStorage, mergedFileNames map[string][]string) error {
+	if keeper, ok := archive.(UnwrittenKeeper); ok && keeper.KeepsUnwritten() {
+		return nil
+	}
+
+	accountNames, err := archive.GetAccountNames()
+	if err != nil {
+		return err
 	}
+
+	for _, accountName := range Subtract(accountNames, archive.LockedAccounts()) {
+		_, fileNames, err := archive.ListChatLogFileNames(accountName)
+		if err != nil {
+			return err
+		}
+
+		for _, fileName := range Subtract(fileNames, mergedFileNames[accountName]) {
+			messages, err := archive.ReadChatLog(accountName, fileName)
+			if err != nil {
+				return err
+			}
+
+			err = archive.WriteChatLog(accountName, fileName, messages)
+			if err != nil {
+				return err
+			}
+		}
+
+		if _, ok := mergedFileNames[accountName]; ok {
+			continue
+		}
+
+		contacts, err := archive.ReadContacts(accountName)
+		if err != nil {
+			return err
+		}
+
+		// Archives written before contacts index was added have no index for the account.
+		if contacts == nil {
+			continue
+		}
+
+		err = archive.WriteContacts(accountName, contacts)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"archive/zip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// memoryStorage is chat logs storage kept in memory, by account and file name.
+type memoryStorage map[string]map[string]Messages
+
+func (s memoryStorage) GetAccountNames() ([]string, error) {
+	var accountNames []string
+	for accountName := range s {
+		accountNames = append(accountNames, accountName)
+	}
+
+	sort.Strings(accountNames)
+
+	return accountNames, nil
+}
+
+func (s memoryStorage) ListChatLogFileNames(accountName string) (absolutePaths []string, relativePaths []string, err error) {
+	for fileName := range s[accountName] {
+		absolutePaths = append(absolutePaths, accountName+"/"+fileName)
+		relativePaths = append(relativePaths, fileName)
+	}
+
+	return
+}
+
+func (s memoryStorage) ReadChatLog(accountName string, fileName string) (Messages, error) {
+	return s[accountName][fileName], nil
+}
+
+func (s memoryStorage) WriteChatLog(accountName string, fileName string, messages Messages) error {
+	if s[accountName] == nil {
+		s[accountName] = make(map[string]Messages)
+	}
+
+	s[accountName][fileName] = messages
+
+	return nil
+}
+
+func mustReadMessages(t *testing.T, chatLog string) Messages {
+	t.Helper()
+
+	messages, err := ReadMessages(strings.NewReader(chatLog))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return messages
+}
+
+// writeTestZip writes plain zip archive with the entries, as written by older versions of the application.
+func writeTestZip(t *testing.T, fileName string, entries map[string]string) {
+	t.Helper()
+
+	f, err := os.Create(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	w := zip.NewWriter(f)
+	for name, content := range entries {
+		entry, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = entry.Write([]byte(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMergeChangedChatLogsKeepsOtherAccounts(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "sl_chat_logs.zip")
+
+	// Archive without contacts indexes, written before they were added.
+	writeTestZip(t, fileName, map[string]string{
+		"alice/bob.txt":   "[2023/06/30 12:00]  Bob: hi alice\n",
+		"carol/dave.txt":  "[2023/06/30 12:00]  Dave: hi carol\n",
+		"erin/frank.txt":  "[2023/06/30 12:00]  Frank: hi erin\n",
+		"erin/grace.txt":  "[2023/06/30 12:00]  Grace: hi erin\n",
+		"zelda/link.txt":  "[2023/06/30 12:00]  Link: hi zelda\n",
+		"alice/carol.txt": "[2023/06/30 12:00]  Carol: hi alice\n",
+	})
+
+	client := memoryStorage{
+		"carol": {"dave.txt": mustReadMessages(t, "[2023/06/30 12:00]  Dave: hi carol\n[2023/06/30 12:05]  Dave: bye carol\n")},
+	}
+
+	archive, err := ReadChatLogsArchive(fileName, ArchiveOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changed := make(ChangedChatLogs)
+	changed.Add("carol", "dave.txt")
+
+	storages := []ChatLogsStorage{client, archive}
+
+	merged, err := mergeAllChatLogs(storages, storages, archive, changed)
+	if err != nil {
+		archive.Abort()
+		t.Fatal(err)
+	}
+	if !merged {
+		archive.Abort()
+		t.Fatal("nothing is merged")
+	}
+
+	err = archive.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archive, err = OpenChatLogsArchive(fileName, ArchiveOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archive.Close()
+
+	expected := map[string]int{
+		"alice/bob.txt":   1,
+		"alice/carol.txt": 1,
+		"carol/dave.txt":  2,
+		"erin/frank.txt":  1,
+		"erin/grace.txt":  1,
+		"zelda/link.txt":  1,
+	}
+
+	for name, count := range expected {
+		accountName, chatLogFileName, _ := strings.Cut(name, "/")
+
+		messages, err := archive.ReadChatLog(accountName, chatLogFileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(messages) != count {
+			t.Errorf("%s has %d messages, %d expected", name, len(messages), count)
+		}
+	}
+}
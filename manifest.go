@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// manifestMetadataName is name of the archive manifest and accounts' manifests inside of the archive metadata directory.
+// Archive manifest is not encrypted, accounts' manifests are encrypted with their keys.
+const manifestMetadataName = "manifest.json"
+
+// ArchiveManifest describes the archive and the last sync which wrote it.
+type ArchiveManifest struct {
+	FormatVersion int       `json:"format_version"`
+	SyncedAt      time.Time `json:"synced_at"`
+	SyncedBy      string    `json:"synced_by"`
+	Accounts      []string  `json:"accounts"`
+}
+
+// AccountManifest lists chat logs of the account.
+type AccountManifest struct {
+	Files map[string]ManifestEntry `json:"files"`
+}
+
+// ManifestEntry describes chat log file.
+type ManifestEntry struct {
+	Messages int `json:"messages"`
+	// First and Last are timestamps of the first and the last messages, 0 if there are no messages with timestamps.
+	First  int64  `json:"first"`
+	Last   int64  `json:"last"`
+	SHA256 string `json:"sha256"`
+}
+
+// NewManifestEntry describes chat log file content.
+func NewManifestEntry(data []byte, messages Messages) ManifestEntry {
+	hash := sha256.Sum256(data)
+
+	entry := ManifestEntry{
+		Messages: len(messages),
+		SHA256:   hex.EncodeToString(hash[:]),
+	}
+
+	for _, message := range messages {
+		if message.Timestamp == 0 {
+			continue
+		}
+
+		if entry.First == 0 || message.Timestamp < entry.First {
+			entry.First = message.Timestamp
+		}
+		if message.Timestamp > entry.Last {
+			entry.Last = message.Timestamp
+		}
+	}
+
+	return entry
+}
+
+// ReadManifest reads the archive manifest.
+// Returns nil if there's no manifest, e.g. archive was written by older version of the application.
+func (a *ChatLogsArchive) ReadManifest() (*ArchiveManifest, error) {
+	data, err := a.readEntry(strings.Join([]string{ArchiveMetadataDirectory, manifestMetadataName}, "/"), nil)
+	if err != nil || data == nil {
+		return nil, err
+	}
+
+	var manifest ArchiveManifest
+	err = json.Unmarshal(data, &manifest)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse manifest of %s: %w", a.fileName, err)
+	}
+
+	return &manifest, nil
+}
+
+// ReadAccountManifest reads manifest of the account.
+// Returns nil if there's no manifest.
+func (a *ChatLogsArchive) ReadAccountManifest(accountName string) (*AccountManifest, error) {
+	data, err := a.ReadAccountMetadata(accountName, manifestMetadataName)
+	if err != nil || data == nil {
+		return nil, err
+	}
+
+	var manifest AccountManifest
+	err = json.Unmarshal(data, &manifest)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse manifest of %s in %s: %w", accountName, a.fileName, err)
+	}
+
+	return &manifest, nil
+}
+
+// addManifestEntry adds chat log file written into new archive to the account manifest.
+func (a *ChatLogsArchive) addManifestEntry(accountName string, fileName string, data []byte, messages Messages) {
+	manifest := a.writtenManifests[accountName]
+	if manifest == nil {
+		manifest = &AccountManifest{Files: make(map[string]ManifestEntry)}
+		a.writtenManifests[accountName] = manifest
+	}
+
+	manifest.Files[fileName] = NewManifestEntry(data, messages)
+}
+
+// writeManifests writes manifests of written accounts and the archive manifest into new archive.
+// Chat logs which have less messages than before are reported to stderr.
+func (a *ChatLogsArchive) writeManifests() error {
+	accountNames := a.LockedAccounts()
+
+	for accountName, manifest := range a.writtenManifests {
+		accountNames = append(accountNames, accountName)
+
+		previous, err := a.ReadAccountManifest(accountName)
+		if err == nil && previous != nil {
+			for fileName, entry := range previous.Files {
+				if written, ok := manifest.Files[fileName]; ok && written.Messages < entry.Messages {
+					fmt.Fprintf(os.Stderr, "warning: %s/%s has %d messages, it had %d before\n", accountName, fileName, written.Messages, entry.Messages)
+				}
+			}
+		}
+
+		data, err := json.Marshal(manifest)
+		if err != nil {
+			return fmt.Errorf("unable to encode manifest of %s: %w", accountName, err)
+		}
+
+		err = a.WriteAccountMetadata(accountName, manifestMetadataName, data)
+		if err != nil {
+			return err
+		}
+	}
+
+	sort.Strings(accountNames)
+
+	data, err := json.Marshal(ArchiveManifest{
+		FormatVersion: a.writeFormatVersion,
+		SyncedAt:      time.Now().UTC(),
+		SyncedBy:      DeviceName(),
+		Accounts:      accountNames,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to encode archive manifest: %w", err)
+	}
+
+	return a.writeEntry(strings.Join([]string{ArchiveMetadataDirectory, manifestMetadataName}, "/"), data, nil)
+}
+
+// BuildAccountManifest describes chat logs of the account as they're stored in the archive.
+// Chat logs which can't be read are returned separately with their errors.
+func (a *ChatLogsArchive) BuildAccountManifest(accountName string) (AccountManifest, map[string]error, error) {
+	manifest := AccountManifest{Files: make(map[string]ManifestEntry)}
+	damaged := make(map[string]error)
+
+	_, fileNames, err := a.ListChatLogFileNames(accountName)
+	if err != nil {
+		return manifest, nil, err
+	}
+
+	c, err := a.readCipherFor(accountName)
+	if err != nil {
+		return manifest, nil, err
+	}
+
+	for _, fileName := range fileNames {
+		data, err := a.readEntry(strings.Join([]string{accountName, fileName}, "/"), c)
+		if err != nil {
+			damaged[fileName] = err
+			continue
+		}
+
+		messages, err := ReadMessages(bytes.NewReader(data))
+		if err != nil {
+			damaged[fileName] = err
+			continue
+		}
+
+		manifest.Files[fileName] = NewManifestEntry(data, messages)
+	}
+
+	return manifest, damaged, nil
+}
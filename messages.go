@@ -2,7 +2,10 @@ package main
 
 import (
 	"bufio"
+	"fmt"
+	"hash/crc32"
 	"io"
+	"strings"
 	"time"
 )
 
@@ -12,6 +15,78 @@ type Message struct {
 	Timestamp int64
 	// Message is complete chat log message, including timestamp and newlines.
 	Message string
+	// Conversation is chat log name the message was taken from.
+	// It's set only when messages of several conversations are shown together.
+	Conversation string
+}
+
+// ID returns message identifier, which doesn't depend on message position in the chat log.
+func (m *Message) ID() string {
+	return fmt.Sprintf("%d-%08x", m.Timestamp, crc32.ChecksumIEEE([]byte(m.Message)))
+}
+
+// MessageKind is kind of chat log message.
+type MessageKind int
+
+const (
+	// MessageKindText is regular message said by the speaker.
+	MessageKindText MessageKind = iota
+	// MessageKindEmote is /me message of the speaker.
+	MessageKindEmote
+	// MessageKindSystem is message of SecondLife itself or notice without speaker.
+	MessageKindSystem
+)
+
+// String returns name of the message kind.
+func (k MessageKind) String() string {
+	switch k {
+	case MessageKindText:
+		return "text"
+	case MessageKindEmote:
+		return "emote"
+	case MessageKindSystem:
+		return "system"
+	}
+
+	return fmt.Sprintf("MessageKind(%d)", int(k))
+}
+
+// Body returns message without timestamp and trailing newline.
+func (m *Message) Body() string {
+	body := m.Message
+	if m.Timestamp != 0 && len(body) > 18 && body[0] == '[' {
+		body = strings.TrimLeft(body[18:], " ")
+	}
+
+	return strings.TrimRight(body, "\r\n")
+}
+
+// Parse splits message body into speaker and text, and detects message kind.
+// Chat log line looks like "[2023/06/30 12:34]  Speaker Name: text", emotes are logged as "Speaker Name: /me text".
+// Lines without speaker are considered as system messages.
+func (m *Message) Parse() (speaker string, text string, kind MessageKind) {
+	body := m.Body()
+
+	firstLine, _, _ := strings.Cut(body, "\n")
+	index := strings.Index(firstLine, ": ")
+	if index <= 0 {
+		return "", body, MessageKindSystem
+	}
+
+	speaker = body[:index]
+	text = body[index+2:]
+
+	switch {
+	case speaker == "Second Life":
+		kind = MessageKindSystem
+	case strings.HasPrefix(text, "/me ") || strings.HasPrefix(text, "/me'"):
+		kind = MessageKindEmote
+		text = strings.TrimPrefix(text[3:], " ")
+	default:
+		kind = MessageKindText
+	}
+
+	return
 }
 
 // Messages is slice of clat log messages.
@@ -31,7 +106,7 @@ func (m Messages) Less(a, b int) bool {
 // Contains returns true if message is already presents.
 func (m Messages) Contains(message Message) bool {
 	for _, msg := range m {
-		if msg.Timestamp == message.Timestamp && msg.Message == message.Message {
+		if msg.Timestamp == message.Timestamp && msg.Message == message.Message && msg.Conversation == message.Conversation {
 			return true
 		}
 	}
@@ -79,7 +154,7 @@ func ReadMessages(r io.Reader) (messages Messages, err error) {
 	for scanner.Scan() {
 		s := scanner.Text() + "\n"
 
-		if s[0] == '[' && s[17] == ']' {
+		if len(s) > 17 && s[0] == '[' && s[17] == ']' {
 			t, err := time.Parse("2006/01/02 15:04", s[1:17])
 			if err == nil {
 				if message != nil {
@@ -93,6 +168,11 @@ func ReadMessages(r io.Reader) (messages Messages, err error) {
 			}
 		}
 
+		// Keep lines preceding the first timestamp as a message of their own.
+		if message == nil {
+			message = &Message{}
+		}
+
 		message.Message += s
 	}
 
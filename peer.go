@@ -0,0 +1,751 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/term"
+)
+
+// PeerKeyEnvironmentVariable is environment variable holding pre-shared key of peer sync.
+const PeerKeyEnvironmentVariable = "SL_CHAT_LOGS_PEER_KEY"
+
+const (
+	// DefaultPeerPort is TCP port of serve-peer, if it's not set.
+	DefaultPeerPort = "7373"
+	peerSyncPath    = "/sync"
+	// peerKeySalt is salt of peer key derivation, both peers must derive the same key from pre-shared key.
+	peerKeySalt = "sl-chat-log-sync peer"
+	// peerMaxClockSkew is how much clocks of peers may differ, older requests are rejected as replayed.
+	peerMaxClockSkew = 5 * time.Minute
+	// peerSessionTimeout is how long the session of disappeared peer blocks other peers.
+	peerSessionTimeout = 10 * time.Minute
+	// peerMaxRequestSize limits requests read by the peer before they're authenticated, except of merged chat logs.
+	peerMaxRequestSize = 64 << 10
+	// peerMaxChatLogSize limits messages of chat log missing on the peer, sent by "merge_chat_log".
+	peerMaxChatLogSize  = 16 << 20
+	peerMaxResponseSize = 256 << 20
+)
+
+// ErrWrongPeerKey is returned if the peer can't decrypt the request, or its response can't be decrypted.
+var ErrWrongPeerKey = errors.New("wrong peer key")
+
+// PeerCipher encrypts requests and responses of peer sync with AES-256-GCM, the key is derived from pre-shared key with Argon2id.
+// Only peers knowing the key can read and make requests, so the key authenticates them.
+type PeerCipher struct {
+	aead cipher.AEAD
+}
+
+// NewPeerCipher derives cipher from pre-shared key.
+func NewPeerCipher(key []byte) (*PeerCipher, error) {
+	block, err := aes.NewCipher(argon2.IDKey(key, []byte(peerKeySalt), 3, 64*1024, 4, 32))
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PeerCipher{aead: aead}, nil
+}
+
+// Seal encodes the value into JSON and encrypts it, random nonce is prepended to the result.
+// Response is sealed with nonce of the request as additional data, so it can't be replaced by response to another request.
+func (c *PeerCipher) Seal(v any, additionalData []byte) (sealed []byte, nonce []byte, err error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nonce = make([]byte, c.aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to generate nonce: %w", err)
+	}
+
+	return c.aead.Seal(nonce, nonce, data, additionalData), nonce, nil
+}
+
+// Open decrypts sealed value and decodes it from JSON, returns its nonce.
+func (c *PeerCipher) Open(sealed []byte, additionalData []byte, v any) ([]byte, error) {
+	if len(sealed) < c.aead.NonceSize() {
+		return nil, ErrWrongPeerKey
+	}
+
+	nonce := sealed[:c.aead.NonceSize()]
+
+	data, err := c.aead.Open(nil, nonce, sealed[c.aead.NonceSize():], additionalData)
+	if err != nil {
+		return nil, ErrWrongPeerKey
+	}
+
+	err = json.Unmarshal(data, v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid peer message: %w", err)
+	}
+
+	return nonce, nil
+}
+
+// peerRequest is storage request with time it was made, so it can't be replayed later.
+type peerRequest struct {
+	storageRequest
+	Timestamp int64 `json:"timestamp"`
+}
+
+// readPeerKey returns pre-shared key of peer sync from the key file, from environment variable, or asks for it in terminal.
+func readPeerKey(keyFileName string) ([]byte, error) {
+	var key []byte
+
+	if keyFileName != "" {
+		data, err := os.ReadFile(keyFileName)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read key file %s: %w", keyFileName, err)
+		}
+
+		key = bytes.TrimRight(data, "\r\n")
+	} else if env := os.Getenv(PeerKeyEnvironmentVariable); env != "" {
+		key = []byte(env)
+	} else if term.IsTerminal(int(os.Stdin.Fd())) {
+		var err error
+		key, err = askPassphrase("Peer key: ", false)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		return nil, fmt.Errorf("peer key is required, use -peer-keyfile or %s environment variable", PeerKeyEnvironmentVariable)
+	}
+
+	if len(key) == 0 {
+		return nil, fmt.Errorf("peer key is empty")
+	}
+
+	return key, nil
+}
+
+// peerMaxRequestSizeOf returns max size of sealed request with the command.
+func peerMaxRequestSizeOf(command string) int64 {
+	if command == "merge_chat_log" {
+		return peerMaxChatLogSize
+	}
+
+	return peerMaxRequestSize
+}
+
+// peerAddress adds default port to the address, if it's missing.
+func peerAddress(address string) string {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return net.JoinHostPort(strings.Trim(address, "[]"), DefaultPeerPort)
+	}
+
+	return address
+}
+
+// PeerServer exposes chat logs of SecondLife clients of this device to peers.
+// Peer syncs in a session: chat logs written by the peer are staged, and committed or discarded at the end of it.
+// Only one peer can sync at the same time.
+type PeerServer struct {
+	cipher               *PeerCipher
+	backupOptions        BackupOptions
+	transactionDirectory string
+
+	mutex sync.Mutex
+	// nonces are nonces of recent requests, by their expiration time.
+	nonces map[string]time.Time
+
+	session     string
+	lastRequest time.Time
+	clients     []ChatLogsStorage
+	staged      []ChatLogsStorage
+	transaction *SyncTransaction
+}
+
+// NewPeerServer returns peer server, chat logs written by peers are staged in the transaction directory.
+func NewPeerServer(cipher *PeerCipher, backupOptions BackupOptions, transactionDirectory string) *PeerServer {
+	return &PeerServer{
+		cipher:               cipher,
+		backupOptions:        backupOptions,
+		transactionDirectory: transactionDirectory,
+		nonces:               make(map[string]time.Time),
+	}
+}
+
+// ServeHTTP implements http.Handler.
+func (s *PeerServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Command is in the path, so the size of the request is limited before it's decrypted.
+	command, ok := strings.CutPrefix(r.URL.Path, peerSyncPath+"/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, peerMaxRequestSizeOf(command)))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Request is sealed with the command as additional data, so the command in the path can't be replaced.
+	var req peerRequest
+	nonce, err := s.cipher.Open(body, []byte(command), &req)
+	if err == nil && req.Command != command {
+		err = fmt.Errorf("command %s doesn't match request path", req.Command)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rejected request from %s: %s\n", r.RemoteAddr, err.Error())
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	s.mutex.Lock()
+	resp, err := s.handle(req, nonce)
+	s.mutex.Unlock()
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s request of %s: %s\n", req.Command, r.RemoteAddr, err.Error())
+		resp = &storageResponse{Error: err.Error()}
+	}
+
+	sealed, _, err := s.cipher.Seal(resp, nonce)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	_, _ = w.Write(sealed)
+}
+
+// handle checks the request isn't replayed and belongs to the current session, and performs it.
+func (s *PeerServer) handle(req peerRequest, nonce []byte) (*storageResponse, error) {
+	now := time.Now()
+
+	requestTime := time.Unix(req.Timestamp, 0)
+	if requestTime.Before(now.Add(-peerMaxClockSkew)) || requestTime.After(now.Add(peerMaxClockSkew)) {
+		return nil, fmt.Errorf("request time %s differs from peer's time %s, check clocks of both devices",
+			requestTime.Format(time.DateTime), now.Format(time.DateTime))
+	}
+
+	for n, expires := range s.nonces {
+		if expires.Before(now) {
+			delete(s.nonces, n)
+		}
+	}
+
+	if _, ok := s.nonces[string(nonce)]; ok {
+		return nil, fmt.Errorf("request is replayed")
+	}
+	s.nonces[string(nonce)] = now.Add(2 * peerMaxClockSkew)
+
+	if req.Command == "open" {
+		return s.open(now)
+	}
+
+	if s.session == "" || req.Session != s.session {
+		return nil, fmt.Errorf("sync session is expired, sync again")
+	}
+
+	s.lastRequest = now
+
+	switch req.Command {
+	case "get_account_names":
+		accountNames, err := GetAllAccountNames(s.clients)
+		return &storageResponse{AccountNames: accountNames}, err
+	case "list_chat_logs":
+		fileNames, err := ListAllChatLogFileNames(s.clients, req.AccountName)
+		return &storageResponse{FileNames: fileNames}, err
+	case "summarize_chat_log":
+		return s.summarizeChatLog(req.AccountName, req.FileName)
+	case "read_chat_log":
+		return s.readChatLog(req.AccountName, req.FileName, req.Days)
+	case "merge_chat_log":
+		return &storageResponse{}, s.mergeChatLog(req.AccountName, req.FileName, req.ChatLog)
+	case "close":
+		// Chat logs open by the viewer are not written, the peer merges them again on its next sync.
+		if err := checkViewersExited(); err != nil {
+			s.abort()
+			return nil, fmt.Errorf("%w on peer, chat logs are synced after it exits", err)
+		}
+
+		fmt.Printf("Committing chat logs written by peer...\n")
+		err := s.transaction.CommitClients()
+		s.session = ""
+		return &storageResponse{}, err
+	case "abort":
+		s.abort()
+		return &storageResponse{}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported command %s", req.Command)
+}
+
+// open starts new sync session, unless another peer is syncing.
+// SecondLife clients are detected again, so clients installed meanwhile are synced too.
+func (s *PeerServer) open(now time.Time) (*storageResponse, error) {
+	if s.session != "" {
+		if now.Sub(s.lastRequest) < peerSessionTimeout {
+			return nil, fmt.Errorf("another device is syncing with this peer, try again later")
+		}
+
+		fmt.Printf("Sync session of peer is expired, discarding it\n")
+		s.abort()
+	}
+
+	// Interrupted commit writes chat logs of SecondLife clients, it's resumed only when the viewer is not running.
+	// Chat logs of the viewer can still be read by the peer meanwhile, and they're written on close only.
+	if err := checkViewersExited(); err != nil {
+		if HasInterruptedSync(s.transactionDirectory) {
+			return nil, fmt.Errorf("%w on peer, its interrupted sync is resumed after it exits", err)
+		}
+	} else {
+		err := RecoverSyncTransaction(s.transactionDirectory)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s.transaction = NewSyncTransaction(s.transactionDirectory, NewChatLogsBackup(s.backupOptions))
+	s.clients = nil
+	s.staged = nil
+
+	for _, clientApp := range DetectSecondLifeClients() {
+		clientApp := clientApp
+		s.clients = append(s.clients, &clientApp)
+		s.staged = append(s.staged, StagedClient{SecondLifeClient: clientApp, transaction: s.transaction})
+	}
+
+	session := make([]byte, 16)
+	_, err := rand.Read(session)
+	if err != nil {
+		return nil, err
+	}
+
+	s.session = hex.EncodeToString(session)
+	s.lastRequest = now
+
+	fmt.Printf("Peer started sync at %s\n", now.Format(time.DateTime))
+
+	return &storageResponse{Session: s.session}, nil
+}
+
+func (s *PeerServer) abort() {
+	if s.transaction != nil {
+		_ = s.transaction.Discard()
+	}
+
+	s.session = ""
+}
+
+// isPeerChatLogName returns true if the names are names of account and chat log file.
+// Names are joined into file paths by SecondLife clients, so don't let them point outside.
+func isPeerChatLogName(accountName string, fileName string) bool {
+	return isAccountName(accountName) && isChatLogFileName(fileName)
+}
+
+func (s *PeerServer) summarizeChatLog(accountName string, fileName string) (*storageResponse, error) {
+	if !isPeerChatLogName(accountName, fileName) {
+		return nil, fmt.Errorf("invalid chat log name %s/%s", accountName, fileName)
+	}
+
+	messages, err := ReadMergedChatLog(s.clients, accountName, fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	summary := messages.Summarize()
+
+	return &storageResponse{Summary: &summary}, nil
+}
+
+// readChatLog reads merged chat log of SecondLife clients, only messages of the days if they're set.
+func (s *PeerServer) readChatLog(accountName string, fileName string, days []string) (*storageResponse, error) {
+	if !isPeerChatLogName(accountName, fileName) {
+		return nil, fmt.Errorf("invalid chat log name %s/%s", accountName, fileName)
+	}
+
+	messages, err := ReadMergedChatLog(s.clients, accountName, fileName)
+	if days != nil {
+		messages = messages.OnDays(days)
+	}
+	if err != nil || len(messages) == 0 {
+		return &storageResponse{}, err
+	}
+
+	var buf bytes.Buffer
+	err = messages.Write(&buf)
+	if err != nil {
+		return nil, err
+	}
+
+	chatLog := buf.String()
+
+	return &storageResponse{ChatLog: &chatLog}, nil
+}
+
+// mergeChatLog stages the chat log in SecondLife clients.
+// The chat log holds only messages missing in SecondLife clients, so it's merged with their chat logs.
+func (s *PeerServer) mergeChatLog(accountName string, fileName string, chatLog *string) error {
+	if !isPeerChatLogName(accountName, fileName) {
+		return fmt.Errorf("invalid chat log name %s/%s", accountName, fileName)
+	}
+
+	if chatLog == nil {
+		return fmt.Errorf("chat log %s/%s is missing", accountName, fileName)
+	}
+
+	messages, err := ReadMessages(strings.NewReader(*chatLog))
+	if err != nil {
+		return fmt.Errorf("unable to read chat log %s/%s: %w", accountName, fileName, err)
+	}
+
+	current, err := ReadMergedChatLog(s.clients, accountName, fileName)
+	if err != nil {
+		return err
+	}
+
+	messages = Merge(current, messages)
+
+	for _, storage := range s.staged {
+		err = storage.WriteChatLog(accountName, fileName, messages)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// PeerStorage is chat logs of SecondLife clients of another device, served by serve-peer.
+// Chat logs written into it are committed by Close, or discarded by Abort.
+// Chat logs are summarized by the peer first, so only messages missing on either side are transferred.
+type PeerStorage struct {
+	address string
+	cipher  *PeerCipher
+	client  *http.Client
+	session string
+	done    bool
+
+	// summaries are summaries of the peer's chat logs, by "<account>/<file>".
+	summaries map[string]ChatLogSummary
+}
+
+// DialPeer starts sync session with the peer.
+func DialPeer(address string, cipher *PeerCipher) (*PeerStorage, error) {
+	p := &PeerStorage{
+		address: peerAddress(address),
+		cipher:  cipher,
+		client:  &http.Client{Timeout: 5 * time.Minute},
+
+		summaries: make(map[string]ChatLogSummary),
+	}
+
+	resp, err := p.call(storageRequest{Command: "open", Version: PluginProtocolVersion})
+	if err != nil {
+		return nil, err
+	}
+
+	p.session = resp.Session
+
+	return p, nil
+}
+
+// call sends encrypted request to the peer and decrypts its response.
+func (p *PeerStorage) call(req storageRequest) (*storageResponse, error) {
+	req.Session = p.session
+
+	sealed, nonce, err := p.cipher.Seal(peerRequest{storageRequest: req, Timestamp: time.Now().Unix()}, []byte(req.Command))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(sealed)) > peerMaxRequestSizeOf(req.Command) {
+		return nil, fmt.Errorf("%s request for %s/%s is too large for peer %s", req.Command, req.AccountName, req.FileName, p.address)
+	}
+
+	httpResp, err := p.client.Post("http://"+p.address+peerSyncPath+"/"+req.Command, "application/octet-stream", bytes.NewReader(sealed))
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to peer %s: %w", p.address, err)
+	}
+	defer httpResp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(httpResp.Body, peerMaxResponseSize))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read response of peer %s: %w", p.address, err)
+	}
+
+	if httpResp.StatusCode == http.StatusUnauthorized {
+		return nil, fmt.Errorf("peer %s rejected the request: %w", p.address, ErrWrongPeerKey)
+	}
+
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("peer %s: %s", p.address, httpResp.Status)
+	}
+
+	var resp storageResponse
+	_, err = p.cipher.Open(body, nonce, &resp)
+	if err != nil {
+		return nil, fmt.Errorf("invalid response of peer %s: %w", p.address, err)
+	}
+
+	if resp.Error != "" {
+		return nil, fmt.Errorf("peer %s: %s", p.address, resp.Error)
+	}
+
+	return &resp, nil
+}
+
+// GetAccountNames returns names of accounts having chat logs on the peer.
+func (p *PeerStorage) GetAccountNames() ([]string, error) {
+	resp, err := p.call(storageRequest{Command: "get_account_names"})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.AccountNames, nil
+}
+
+// ListChatLogFileNames returns chat logs of the account on the peer.
+func (p *PeerStorage) ListChatLogFileNames(accountName string) (absolutePaths []string, relativePaths []string, err error) {
+	resp, err := p.call(storageRequest{Command: "list_chat_logs", AccountName: accountName})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, fileName := range resp.FileNames {
+		absolutePaths = append(absolutePaths, path.Join(accountName, fileName))
+		relativePaths = append(relativePaths, fileName)
+	}
+
+	return
+}
+
+// ReadChatLog reads chat log of the account, merged from all SecondLife clients of the peer.
+func (p *PeerStorage) ReadChatLog(accountName string, fileName string) (Messages, error) {
+	resp, err := p.call(storageRequest{Command: "read_chat_log", AccountName: accountName, FileName: fileName})
+	if err != nil || resp.ChatLog == nil {
+		return nil, err
+	}
+
+	messages, err := ReadMessages(strings.NewReader(*resp.ChatLog))
+	if err != nil {
+		return messages, fmt.Errorf("unable to read chat log %s/%s of peer %s: %w", accountName, fileName, p.address, err)
+	}
+
+	return messages, nil
+}
+
+// SummarizeChatLog returns summary of the peer's chat log.
+func (p *PeerStorage) SummarizeChatLog(accountName string, fileName string) (ChatLogSummary, error) {
+	resp, err := p.call(storageRequest{Command: "summarize_chat_log", AccountName: accountName, FileName: fileName})
+	if err != nil {
+		return ChatLogSummary{}, err
+	}
+
+	if resp.Summary == nil {
+		return ChatLogSummary{}, fmt.Errorf("peer %s didn't summarize chat log %s/%s", p.address, accountName, fileName)
+	}
+
+	p.summaries[path.Join(accountName, fileName)] = *resp.Summary
+
+	return *resp.Summary, nil
+}
+
+// ReadChatLogDays reads messages of the days from the peer's chat log.
+func (p *PeerStorage) ReadChatLogDays(accountName string, fileName string, days []string) (Messages, error) {
+	resp, err := p.call(storageRequest{Command: "read_chat_log", AccountName: accountName, FileName: fileName, Days: days})
+	if err != nil || resp.ChatLog == nil {
+		return nil, err
+	}
+
+	messages, err := ReadMessages(strings.NewReader(*resp.ChatLog))
+	if err != nil {
+		return messages, fmt.Errorf("unable to read chat log %s/%s of peer %s: %w", accountName, fileName, p.address, err)
+	}
+
+	return messages, nil
+}
+
+// WriteChatLog sends messages of the chat log missing on the peer, they're merged into SecondLife clients of the peer.
+func (p *PeerStorage) WriteChatLog(accountName string, fileName string, messages Messages) error {
+	summary, ok := p.summaries[path.Join(accountName, fileName)]
+	if !ok {
+		var err error
+		summary, err = p.SummarizeChatLog(accountName, fileName)
+		if err != nil {
+			return err
+		}
+	}
+
+	days := summary.DifferentDays(messages.Summarize())
+	if len(days) == 0 {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	err := messages.OnDays(days).Write(&buf)
+	if err != nil {
+		return fmt.Errorf("error writing file %s/%s: %w", accountName, fileName, err)
+	}
+
+	chatLog := buf.String()
+
+	_, err = p.call(storageRequest{Command: "merge_chat_log", AccountName: accountName, FileName: fileName, ChatLog: &chatLog})
+
+	return err
+}
+
+// Close commits chat logs written into the peer.
+func (p *PeerStorage) Close() error {
+	if p.done {
+		return nil
+	}
+	p.done = true
+
+	_, err := p.call(storageRequest{Command: "close"})
+
+	return err
+}
+
+// Abort discards chat logs written into the peer.
+func (p *PeerStorage) Abort() {
+	if p.done {
+		return
+	}
+	p.done = true
+
+	_, _ = p.call(storageRequest{Command: "abort"})
+}
+
+func (p *PeerStorage) String() string {
+	return "peer " + p.address
+}
+
+// runServePeer serves chat logs of SecondLife clients of this device to peers running sync-peer.
+func runServePeer(args []string) error {
+	flags := flag.NewFlagSet("serve-peer", flag.ExitOnError)
+	listen := flags.String("listen", ":"+DefaultPeerPort, "address to listen on")
+	keyFileName := flags.String("peer-keyfile", "", "file containing pre-shared key of peers (default: "+PeerKeyEnvironmentVariable+" environment variable or ask for it)")
+	_ = flags.Parse(args)
+
+	key, err := readPeerKey(*keyFileName)
+	if err != nil {
+		return err
+	}
+
+	peerCipher, err := NewPeerCipher(key)
+	if err != nil {
+		return err
+	}
+
+	backupOptions, err := backupOptions()
+	if err != nil {
+		return err
+	}
+
+	stateDirectory, err := StateDirectory()
+	if err != nil {
+		return err
+	}
+
+	clients := DetectSecondLifeClients()
+	if len(clients) == 0 {
+		fmt.Printf("No SecondLife clients found.\n")
+		return nil
+	}
+
+	for _, clientApp := range clients {
+		fmt.Printf("%s found\n", clientApp)
+	}
+
+	transactionDirectory := filepath.Join(stateDirectory, "pending-peer")
+
+	// Chat logs written by peers are staged in the directory, don't let another serve-peer discard them.
+	lock, err := LockSyncTransaction(transactionDirectory)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	server := &http.Server{
+		Addr:              *listen,
+		Handler:           NewPeerServer(peerCipher, backupOptions, transactionDirectory),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		_ = server.Close()
+	}()
+
+	fmt.Printf("Serving chat logs to peers on %s, press Ctrl+C to stop.\n", *listen)
+
+	err = server.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		return err
+	}
+
+	return nil
+}
+
+// runSyncPeer syncs chat logs with another device running serve-peer, together with the archive.
+func runSyncPeer(args []string) error {
+	flags := flag.NewFlagSet("sync-peer", flag.ExitOnError)
+	keyFileName := flags.String("peer-keyfile", "", "file containing pre-shared key of peers (default: "+PeerKeyEnvironmentVariable+" environment variable or ask for it)")
+	_ = flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		return fmt.Errorf("peer address is not specified, sync-peer <host>[:<port>] expected")
+	}
+
+	key, err := readPeerKey(*keyFileName)
+	if err != nil {
+		return err
+	}
+
+	peerCipher, err := NewPeerCipher(key)
+	if err != nil {
+		return err
+	}
+
+	var peers []*PeerStorage
+	for _, address := range flags.Args() {
+		peer, err := DialPeer(address, peerCipher)
+		if err != nil {
+			for _, peer := range peers {
+				peer.Abort()
+			}
+			return err
+		}
+
+		peers = append(peers, peer)
+	}
+
+	return syncChatLogs(peers, nil)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPeerCipher(t *testing.T) {
+	c, err := NewPeerCipher([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed, nonce, err := c.Seal(storageRequest{Command: "open"}, []byte("open"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var req storageRequest
+	opened, err := c.Open(sealed, []byte("open"), &req)
+	if err != nil || req.Command != "open" || !bytes.Equal(opened, nonce) {
+		t.Errorf("sealed request is opened as %+v, nonce %x (%v)", req, opened, err)
+	}
+
+	_, err = c.Open(sealed, []byte("close"), &req)
+	if !errors.Is(err, ErrWrongPeerKey) {
+		t.Errorf("request is opened with another additional data: %v", err)
+	}
+
+	other, err := NewPeerCipher([]byte("other secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = other.Open(sealed, []byte("open"), &req)
+	if !errors.Is(err, ErrWrongPeerKey) {
+		t.Errorf("request is opened with wrong key: %v", err)
+	}
+}
+
+// postPeerRequest sends sealed request to the peer server, returns HTTP status and error of the response.
+func postPeerRequest(t *testing.T, server *httptest.Server, c *PeerCipher, command string, sealed []byte, nonce []byte) (int, string) {
+	t.Helper()
+
+	httpResp, err := http.Post(server.URL+peerSyncPath+"/"+command, "application/octet-stream", bytes.NewReader(sealed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer httpResp.Body.Close()
+
+	body, err := io.ReadAll(httpResp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if httpResp.StatusCode != http.StatusOK {
+		return httpResp.StatusCode, ""
+	}
+
+	var resp storageResponse
+	_, err = c.Open(body, nonce, &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return httpResp.StatusCode, resp.Error
+}
+
+func TestPeerServerRejectsRequests(t *testing.T) {
+	c, err := NewPeerCipher([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(NewPeerServer(c, BackupOptions{}, t.TempDir()))
+	defer server.Close()
+
+	seal := func(c *PeerCipher, command string, additionalData string, timestamp time.Time) ([]byte, []byte) {
+		sealed, nonce, err := c.Seal(peerRequest{storageRequest: storageRequest{Command: command}, Timestamp: timestamp.Unix()}, []byte(additionalData))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sealed, nonce
+	}
+
+	// Request without session is authenticated, but not performed.
+	sealed, nonce := seal(c, "get_account_names", "get_account_names", time.Now())
+	status, respErr := postPeerRequest(t, server, c, "get_account_names", sealed, nonce)
+	if status != http.StatusOK || !strings.Contains(respErr, "session") {
+		t.Errorf("request without session: status %d, error %q", status, respErr)
+	}
+
+	status, respErr = postPeerRequest(t, server, c, "get_account_names", sealed, nonce)
+	if !strings.Contains(respErr, "replayed") {
+		t.Errorf("replayed request: status %d, error %q", status, respErr)
+	}
+
+	sealed, nonce = seal(c, "get_account_names", "get_account_names", time.Now().Add(-time.Hour))
+	_, respErr = postPeerRequest(t, server, c, "get_account_names", sealed, nonce)
+	if !strings.Contains(respErr, "clocks") {
+		t.Errorf("old request: error %q", respErr)
+	}
+
+	other, err := NewPeerCipher([]byte("other secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed, nonce = seal(other, "get_account_names", "get_account_names", time.Now())
+	status, _ = postPeerRequest(t, server, other, "get_account_names", sealed, nonce)
+	if status != http.StatusUnauthorized {
+		t.Errorf("request sealed with wrong key: status %d", status)
+	}
+
+	// Command in the path must be the one the request is sealed with.
+	sealed, nonce = seal(c, "close", "close", time.Now())
+	status, _ = postPeerRequest(t, server, c, "merge_chat_log", sealed, nonce)
+	if status != http.StatusUnauthorized {
+		t.Errorf("request with another command in the path: status %d", status)
+	}
+
+	sealed, nonce = seal(c, "merge_chat_log", "close", time.Now())
+	status, _ = postPeerRequest(t, server, c, "close", sealed, nonce)
+	if status != http.StatusUnauthorized {
+		t.Errorf("request with another command sealed: status %d", status)
+	}
+
+	status, _ = postPeerRequest(t, server, c, "close", make([]byte, peerMaxRequestSize+1), nil)
+	if status != http.StatusBadRequest {
+		t.Errorf("too large request: status %d", status)
+	}
+}
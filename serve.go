@@ -0,0 +1,430 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// runServe starts local web server for browsing chat logs.
+// The server never writes anything into the storages.
+func runServe(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	listen := flags.String("listen", "127.0.0.1:8080", "address to listen on")
+	pageSize := flags.Int("page-size", 200, "messages per page")
+	_ = flags.Parse(args)
+
+	if *pageSize <= 0 {
+		return fmt.Errorf("page size must be positive")
+	}
+
+	storages, archive, err := openReadOnlyStorages()
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	viewer := &ChatLogsViewer{
+		storages: storages,
+		pageSize: *pageSize,
+		listen:   *listen,
+	}
+
+	server := &http.Server{
+		Addr:              *listen,
+		Handler:           viewer,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		_ = server.Close()
+	}()
+
+	fmt.Printf("Serving chat logs on http://%s/, press Ctrl+C to stop.\n", *listen)
+
+	err = server.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		return err
+	}
+
+	return nil
+}
+
+// ChatLogsViewer is read-only web interface for chat logs storages.
+type ChatLogsViewer struct {
+	storages []ChatLogsStorage
+	pageSize int
+	// listen is address the server listens on.
+	listen string
+}
+
+// maxSearchResults limits count of messages shown on search page.
+const maxSearchResults = 500
+
+// ServeHTTP implements http.Handler.
+func (v *ChatLogsViewer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Web pages of other sites may resolve their names to this address (DNS rebinding), don't let them read chat logs.
+	if !v.isAllowedHost(r.Host) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	// Names are joined into file paths by the storages, so don't let them point outside, or to files other than chat logs.
+	query := r.URL.Query()
+	accountName, fileName := query.Get("account"), query.Get("file")
+	if (accountName != "" && !isAccountName(accountName)) || (fileName != "" && !isChatLogFileName(fileName)) {
+		http.NotFound(w, r)
+		return
+	}
+
+	if (r.URL.Path == "/conversation" || r.URL.Path == "/message") && (accountName == "" || fileName == "") {
+		http.NotFound(w, r)
+		return
+	}
+
+	var err error
+
+	switch r.URL.Path {
+	case "/":
+		err = v.serveAccounts(w, r)
+	case "/account":
+		err = v.serveConversations(w, r)
+	case "/conversation":
+		err = v.serveConversation(w, r)
+	case "/message":
+		err = v.serveMessage(w, r)
+	case "/search":
+		err = v.serveSearch(w, r)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (v *ChatLogsViewer) serveAccounts(w http.ResponseWriter, r *http.Request) error {
+	accountNames, err := GetAllAccountNames(v.storages)
+	if err != nil {
+		return err
+	}
+
+	return viewerAccountsTemplate.Execute(w, accountNames)
+}
+
+func (v *ChatLogsViewer) serveConversations(w http.ResponseWriter, r *http.Request) error {
+	accountName := r.URL.Query().Get("account")
+
+	fileNames, err := ListAllChatLogFileNames(v.storages, accountName)
+	if err != nil {
+		return err
+	}
+
+	if len(fileNames) == 0 {
+		http.NotFound(w, r)
+		return nil
+	}
+
+	return viewerConversationsTemplate.Execute(w, struct {
+		Account   string
+		FileNames []string
+	}{accountName, fileNames})
+}
+
+func (v *ChatLogsViewer) serveConversation(w http.ResponseWriter, r *http.Request) error {
+	query := r.URL.Query()
+	accountName := query.Get("account")
+	fileName := query.Get("file")
+
+	messages, err := ReadMergedChatLog(v.storages, accountName, fileName)
+	if err != nil {
+		return err
+	}
+
+	if len(messages) == 0 {
+		http.NotFound(w, r)
+		return nil
+	}
+
+	pages := (len(messages) + v.pageSize - 1) / v.pageSize
+
+	// Jump to the page containing first message of the date.
+	if date := query.Get("date"); date != "" {
+		t, err := time.Parse("2006-01-02", date)
+		if err != nil {
+			http.Error(w, "invalid date", http.StatusBadRequest)
+			return nil
+		}
+
+		index := sort.Search(len(messages), func(i int) bool {
+			return messages[i].Timestamp >= t.Unix()
+		})
+		if index == len(messages) {
+			index--
+		}
+
+		http.Redirect(w, r, conversationURL(accountName, fileName, index/v.pageSize+1, messages[index].ID()), http.StatusFound)
+		return nil
+	}
+
+	// Last page is shown by default, because it contains the most recent messages.
+	page := pages
+	if s := query.Get("page"); s != "" {
+		page, err = strconv.Atoi(s)
+		if err != nil || page < 1 || page > pages {
+			http.NotFound(w, r)
+			return nil
+		}
+	}
+
+	start := (page - 1) * v.pageSize
+	end := start + v.pageSize
+	if end > len(messages) {
+		end = len(messages)
+	}
+
+	var pageLinks []viewerPageLink
+	for i := 1; i <= pages; i++ {
+		pageLinks = append(pageLinks, viewerPageLink{
+			Number:  i,
+			URL:     conversationURL(accountName, fileName, i, ""),
+			Current: i == page,
+		})
+	}
+
+	return viewerConversationTemplate.Execute(w, struct {
+		Account  string
+		FileName string
+		Messages Messages
+		Pages    []viewerPageLink
+		First    string
+		Last     string
+	}{
+		Account:  accountName,
+		FileName: fileName,
+		Messages: messages[start:end],
+		Pages:    pageLinks,
+		First:    time.Unix(messages[0].Timestamp, 0).UTC().Format("2006-01-02"),
+		Last:     time.Unix(messages[len(messages)-1].Timestamp, 0).UTC().Format("2006-01-02"),
+	})
+}
+
+// serveMessage redirects message permalink to the conversation page containing the message.
+func (v *ChatLogsViewer) serveMessage(w http.ResponseWriter, r *http.Request) error {
+	query := r.URL.Query()
+	accountName := query.Get("account")
+	fileName := query.Get("file")
+	id := query.Get("id")
+
+	messages, err := ReadMergedChatLog(v.storages, accountName, fileName)
+	if err != nil {
+		return err
+	}
+
+	for i, message := range messages {
+		if message.ID() == id {
+			http.Redirect(w, r, conversationURL(accountName, fileName, i/v.pageSize+1, id), http.StatusFound)
+			return nil
+		}
+	}
+
+	http.NotFound(w, r)
+	return nil
+}
+
+func (v *ChatLogsViewer) serveSearch(w http.ResponseWriter, r *http.Request) error {
+	query := r.URL.Query()
+	accountName := query.Get("account")
+	q := strings.TrimSpace(query.Get("q"))
+
+	type searchResult struct {
+		FileName string
+		Message  *Message
+	}
+
+	var results []searchResult
+	var truncated bool
+
+	if q != "" {
+		fileNames, err := ListAllChatLogFileNames(v.storages, accountName)
+		if err != nil {
+			return err
+		}
+
+		needle := strings.ToLower(q)
+
+	files:
+		for _, fileName := range fileNames {
+			messages, err := ReadMergedChatLog(v.storages, accountName, fileName)
+			if err != nil {
+				return err
+			}
+
+			for _, message := range messages {
+				if !strings.Contains(strings.ToLower(message.Message), needle) {
+					continue
+				}
+
+				if len(results) == maxSearchResults {
+					truncated = true
+					break files
+				}
+
+				results = append(results, searchResult{fileName, message})
+			}
+		}
+	}
+
+	return viewerSearchTemplate.Execute(w, struct {
+		Account   string
+		Query     string
+		Results   []searchResult
+		Truncated bool
+	}{accountName, q, results, truncated})
+}
+
+// isPlainName returns true if the name can't be used to point outside of the storage directory.
+func isPlainName(name string) bool {
+	return name != ".." && !strings.ContainsAny(name, "/\\")
+}
+
+// isAllowedHost returns true if the host of the request is the listen address, or this computer.
+func (v *ChatLogsViewer) isAllowedHost(host string) bool {
+	if host == v.listen {
+		return true
+	}
+
+	hostname, _, err := net.SplitHostPort(host)
+	if err != nil {
+		hostname = host
+	}
+
+	return hostname == "localhost" || hostname == "127.0.0.1"
+}
+
+// isAccountName returns true if the name is name of account directory.
+func isAccountName(name string) bool {
+	return name != "" && name != "." && isPlainName(name)
+}
+
+// isChatLogFileName returns true if the name is name of chat log file, not of other files of SecondLife client.
+func isChatLogFileName(name string) bool {
+	return isPlainName(name) && len(name) > len(".txt") && path.Ext(name) == ".txt" && !IsReservedFileName(name)
+}
+
+type viewerPageLink struct {
+	Number  int
+	URL     string
+	Current bool
+}
+
+// conversationURL returns URL of the conversation page, optionally pointing to the message.
+func conversationURL(accountName string, fileName string, page int, messageID string) string {
+	u := fmt.Sprintf("/conversation?%s", url.Values{
+		"account": {accountName},
+		"file":    {fileName},
+		"page":    {strconv.Itoa(page)},
+	}.Encode())
+
+	if messageID != "" {
+		u += "#m-" + messageID
+	}
+
+	return u
+}
+
+var viewerFuncs = template.FuncMap{
+	"time": func(timestamp int64) string {
+		return time.Unix(timestamp, 0).UTC().Format("2006/01/02 15:04")
+	},
+	"text": func(message *Message) string {
+		return message.Body()
+	},
+	"conversation": func(accountName string, fileName string) string {
+		return "/conversation?" + url.Values{"account": {accountName}, "file": {fileName}}.Encode()
+	},
+	"permalink": func(accountName string, fileName string, message *Message) string {
+		return "/message?" + url.Values{"account": {accountName}, "file": {fileName}, "id": {message.ID()}}.Encode()
+	},
+	"title": func(fileName string) string {
+		return strings.TrimSuffix(fileName, ".txt")
+	},
+}
+
+const viewerLayout = `{{define "header"}}<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>SL chat logs</title>
+<style>
+body { font-family: sans-serif; margin: 1em 2em; }
+.message { margin: 0.3em 0; white-space: pre-wrap; }
+.message:target { background: #ffc; }
+.time, .time a { color: #777; font-size: 0.85em; text-decoration: none; }
+.pages a { margin-right: 0.3em; }
+.pages .current { font-weight: bold; }
+form { margin: 1em 0; }
+</style>
+</head>
+<body>
+{{end}}
+{{define "footer"}}</body>
+</html>
+{{end}}`
+
+var viewerAccountsTemplate = template.Must(template.New("accounts").Funcs(viewerFuncs).Parse(viewerLayout + `{{template "header"}}
+<h1>Accounts</h1>
+<ul>
+{{range .}}<li><a href="/account?account={{.}}">{{.}}</a></li>
+{{else}}<li>No accounts found.</li>
+{{end}}</ul>
+{{template "footer"}}`))
+
+var viewerConversationsTemplate = template.Must(template.New("conversations").Funcs(viewerFuncs).Parse(viewerLayout + `{{template "header"}}
+<p><a href="/">Accounts</a></p>
+<h1>{{.Account}}</h1>
+<form action="/search"><input type="hidden" name="account" value="{{.Account}}"><input name="q" placeholder="Search"> <button>Search</button></form>
+<ul>
+{{$account := .Account}}{{range .FileNames}}<li><a href="{{conversation $account .}}">{{title .}}</a></li>
+{{end}}</ul>
+{{template "footer"}}`))
+
+var viewerConversationTemplate = template.Must(template.New("conversation").Funcs(viewerFuncs).Parse(viewerLayout + `{{template "header"}}
+<p><a href="/">Accounts</a> / <a href="/account?account={{.Account}}">{{.Account}}</a></p>
+<h1>{{title .FileName}}</h1>
+<form action="/conversation"><input type="hidden" name="account" value="{{.Account}}"><input type="hidden" name="file" value="{{.FileName}}">
+<input type="date" name="date" min="{{.First}}" max="{{.Last}}"> <button>Go to date</button></form>
+<p class="pages">{{range .Pages}}{{if .Current}}<span class="current">{{.Number}}</span> {{else}}<a href="{{.URL}}">{{.Number}}</a> {{end}}{{end}}</p>
+{{$account := .Account}}{{$fileName := .FileName}}{{range .Messages}}<div class="message" id="m-{{.ID}}"><span class="time"><a href="{{permalink $account $fileName .}}">{{time .Timestamp}}</a></span> {{text .}}</div>
+{{end}}
+<p class="pages">{{range .Pages}}{{if .Current}}<span class="current">{{.Number}}</span> {{else}}<a href="{{.URL}}">{{.Number}}</a> {{end}}{{end}}</p>
+{{template "footer"}}`))
+
+var viewerSearchTemplate = template.Must(template.New("search").Funcs(viewerFuncs).Parse(viewerLayout + `{{template "header"}}
+<p><a href="/">Accounts</a> / <a href="/account?account={{.Account}}">{{.Account}}</a></p>
+<form action="/search"><input type="hidden" name="account" value="{{.Account}}"><input name="q" value="{{.Query}}" placeholder="Search"> <button>Search</button></form>
+{{$account := .Account}}{{range .Results}}<div class="message"><span class="time"><a href="{{permalink $account .FileName .Message}}">{{title .FileName}}, {{time .Message.Timestamp}}</a></span> {{text .Message}}</div>
+{{else}}{{if .Query}}<p>Nothing found.</p>{{end}}{{end}}
+{{if .Truncated}}<p>Only first {{len .Results}} results are shown.</p>{{end}}
+{{template "footer"}}`))
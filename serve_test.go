@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestChatLogsViewerServesChatLogsOnly(t *testing.T) {
+	viewer := &ChatLogsViewer{listen: "127.0.0.1:8080"}
+
+	tests := []string{
+		"/conversation?account=alice&file=settings_per_account.xml",
+		"/conversation?account=alice&file=.txt",
+		"/conversation?account=alice&file=",
+		"/conversation?account=&file=bob.txt",
+		"/conversation?account=..&file=bob.txt",
+		"/conversation?account=alice&file=../bob.txt",
+		"/message?account=alice&file=settings.xml",
+		"/account?account=.",
+	}
+
+	for _, target := range tests {
+		w := httptest.NewRecorder()
+		viewer.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://127.0.0.1:8080"+target, nil))
+
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s: status %d, %d expected", target, w.Code, http.StatusNotFound)
+		}
+	}
+
+	// Requests of other sites resolving their names to this computer are rejected.
+	for host, allowed := range map[string]bool{
+		"127.0.0.1:8080":      true,
+		"localhost:8080":      true,
+		"localhost":           true,
+		"evil.example.com":    false,
+		"evil.example.com:80": false,
+		"192.168.1.2:8080":    false,
+	} {
+		w := httptest.NewRecorder()
+		viewer.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://"+host+"/account?account=.", nil))
+
+		if (w.Code != http.StatusForbidden) != allowed {
+			t.Errorf("%s: status %d", host, w.Code)
+		}
+	}
+}
+
+func TestIsChatLogFileName(t *testing.T) {
+	tests := map[string]bool{
+		"bob.txt":                   true,
+		"Bob Resident.txt":          true,
+		"":                          false,
+		".txt":                      false,
+		"chat.txt":                  true,
+		"settings_per_account.xml":  false,
+		"../bob.txt":                false,
+		`..\bob.txt`:                false,
+		"bob.txt.bak":               false,
+		"conversation.log":          false,
+		"settings.xml":              false,
+		"teleport_history.txt":      false,
+		"nested/bob.txt":            false,
+		"Group Chat (group).txt":    true,
+		"bob.resident-1234abcd.txt": true,
+	}
+
+	for name, expected := range tests {
+		if isChatLogFileName(name) != expected {
+			t.Errorf("%q: chat log file name is %v, %v expected", name, !expected, expected)
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// AccountStats is chat activity report for the account.
+type AccountStats struct {
+	Account  string         `json:"account"`
+	Messages int            `json:"messages"`
+	First    time.Time      `json:"first"`
+	Last     time.Time      `json:"last"`
+	Months   []MonthStats   `json:"months"`
+	Hours    [24]int        `json:"hours"`
+	Contacts []ContactStats `json:"contacts"`
+}
+
+// ChatLogSizer is archive storage which knows size of chat logs stored in it.
+type ChatLogSizer interface {
+	ChatLogSize(accountName string, fileName string) (compressed uint64, uncompressed uint64, ok bool)
+}
+
+// ContactStats is chat activity report for single conversation of the account.
+type ContactStats struct {
+	FileName string `json:"file_name"`
+	Messages int    `json:"messages"`
+	// Size is size of merged chat log in bytes.
+	Size int `json:"size"`
+	// ArchiveSize is compressed size of chat log inside of the archive.
+	ArchiveSize uint64         `json:"archive_size"`
+	First       time.Time      `json:"first"`
+	Last        time.Time      `json:"last"`
+	Months      []MonthStats   `json:"months"`
+	Hours       [24]int        `json:"hours"`
+	Speakers    []SpeakerShare `json:"speakers"`
+	Kinds       map[string]int `json:"kinds"`
+
+	months   map[string]int
+	speakers map[string]int
+}
+
+// MonthStats is count of messages for the month.
+type MonthStats struct {
+	Month    string `json:"month"`
+	Messages int    `json:"messages"`
+}
+
+// SpeakerShare is count of messages of the speaker and their share of the conversation.
+type SpeakerShare struct {
+	Speaker  string  `json:"speaker"`
+	Messages int     `json:"messages"`
+	Share    float64 `json:"share"`
+}
+
+// runStats prints chat activity report for merged chat logs.
+func runStats(args []string) error {
+	flags := flag.NewFlagSet("stats", flag.ExitOnError)
+	accountName := flags.String("account", "", "account name (default: all accounts)")
+	format := flags.String("format", "table", "output format: table or json")
+	topHours := flags.Int("top-hours", 3, "count of the most active hours to show in table")
+	_ = flags.Parse(args)
+
+	if *format != "table" && *format != "json" {
+		return fmt.Errorf("unsupported output format: %s", *format)
+	}
+
+	storages, archive, err := openReadOnlyStorages()
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	accountNames, err := GetAllAccountNames(storages)
+	if err != nil {
+		return err
+	}
+
+	if *accountName != "" {
+		if !Contains(accountNames, *accountName) {
+			return fmt.Errorf("account %s not found", *accountName)
+		}
+
+		accountNames = []string{*accountName}
+	}
+
+	var report []AccountStats
+	for _, account := range accountNames {
+		stats, err := CollectAccountStats(storages, archive, account)
+		if err != nil {
+			return err
+		}
+
+		report = append(report, stats)
+	}
+
+	if *format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	}
+
+	for _, stats := range report {
+		stats.WriteTable(os.Stdout, *topHours)
+	}
+
+	return nil
+}
+
+// CollectAccountStats collects chat activity report for the account from merged chat logs.
+// Archive is used to get compressed sizes of the chat logs, it may be nil.
+func CollectAccountStats(storages []ChatLogsStorage, archive ArchiveStorage, accountName string) (AccountStats, error) {
+	stats := AccountStats{Account: accountName}
+
+	fileNames, err := ListAllChatLogFileNames(storages, accountName)
+	if err != nil {
+		return stats, err
+	}
+
+	months := make(map[string]int)
+
+	for _, fileName := range fileNames {
+		messages, err := ReadMergedChatLog(storages, accountName, fileName)
+		if err != nil {
+			return stats, err
+		}
+
+		contact := collectContactStats(fileName, messages)
+		if sizer, ok := archive.(ChatLogSizer); ok {
+			contact.ArchiveSize, _, _ = sizer.ChatLogSize(accountName, fileName)
+		}
+
+		stats.Messages += contact.Messages
+		for i, count := range contact.Hours {
+			stats.Hours[i] += count
+		}
+		for month, count := range contact.months {
+			months[month] += count
+		}
+		if contact.Messages > 0 {
+			if stats.First.IsZero() || contact.First.Before(stats.First) {
+				stats.First = contact.First
+			}
+			if contact.Last.After(stats.Last) {
+				stats.Last = contact.Last
+			}
+		}
+
+		stats.Contacts = append(stats.Contacts, contact)
+	}
+
+	stats.Months = sortedMonths(months)
+
+	return stats, nil
+}
+
+func collectContactStats(fileName string, messages Messages) ContactStats {
+	contact := ContactStats{
+		FileName: fileName,
+		Kinds:    make(map[string]int),
+		months:   make(map[string]int),
+		speakers: make(map[string]int),
+	}
+
+	var spoken int
+
+	for _, message := range messages {
+		contact.Size += len(message.Message)
+
+		// Lines without timestamp can't be placed in time.
+		if message.Timestamp == 0 {
+			continue
+		}
+
+		t := time.Unix(message.Timestamp, 0).UTC()
+
+		contact.Messages++
+		contact.Hours[t.Hour()]++
+		contact.months[t.Format("2006-01")]++
+
+		if contact.First.IsZero() || t.Before(contact.First) {
+			contact.First = t
+		}
+		if t.After(contact.Last) {
+			contact.Last = t
+		}
+
+		speaker, _, kind := message.Parse()
+		contact.Kinds[kind.String()]++
+
+		if kind != MessageKindSystem {
+			contact.speakers[speaker]++
+			spoken++
+		}
+	}
+
+	contact.Months = sortedMonths(contact.months)
+
+	for speaker, count := range contact.speakers {
+		contact.Speakers = append(contact.Speakers, SpeakerShare{
+			Speaker:  speaker,
+			Messages: count,
+			Share:    float64(count) / float64(spoken),
+		})
+	}
+
+	sort.Slice(contact.Speakers, func(a, b int) bool {
+		if contact.Speakers[a].Messages != contact.Speakers[b].Messages {
+			return contact.Speakers[a].Messages > contact.Speakers[b].Messages
+		}
+		return contact.Speakers[a].Speaker < contact.Speakers[b].Speaker
+	})
+
+	return contact
+}
+
+func sortedMonths(months map[string]int) []MonthStats {
+	result := make([]MonthStats, 0, len(months))
+	for month, count := range months {
+		result = append(result, MonthStats{Month: month, Messages: count})
+	}
+
+	sort.Slice(result, func(a, b int) bool {
+		return result[a].Month < result[b].Month
+	})
+
+	return result
+}
+
+// mostActiveHours returns hours with the most messages, the most active first.
+func mostActiveHours(hours [24]int, count int) []int {
+	var result []int
+	for hour, messages := range hours {
+		if messages > 0 {
+			result = append(result, hour)
+		}
+	}
+
+	sort.SliceStable(result, func(a, b int) bool {
+		return hours[result[a]] > hours[result[b]]
+	})
+
+	if len(result) > count {
+		result = result[:count]
+	}
+
+	return result
+}
+
+// WriteTable writes human-readable report into the writer.
+func (s AccountStats) WriteTable(w io.Writer, topHours int) {
+	fmt.Fprintf(w, "Account %s: %d messages", s.Account, s.Messages)
+	if s.Messages > 0 {
+		fmt.Fprintf(w, ", %s - %s", s.First.Format("2006/01/02"), s.Last.Format("2006/01/02"))
+	}
+	fmt.Fprintf(w, "\n")
+
+	if s.Messages == 0 {
+		fmt.Fprintf(w, "\n")
+		return
+	}
+
+	var hours []string
+	for _, hour := range mostActiveHours(s.Hours, topHours) {
+		hours = append(hours, fmt.Sprintf("%02d:00 (%.0f%%)", hour, 100*float64(s.Hours[hour])/float64(s.Messages)))
+	}
+	fmt.Fprintf(w, "Most active hours: %s\n\n", strings.Join(hours, ", "))
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "CONTACT\tMESSAGES\tFIRST\tLAST\tSIZE\tARCHIVED\tSPEAKERS\n")
+	for _, contact := range s.Contacts {
+		var first, last string
+		if contact.Messages > 0 {
+			first = contact.First.Format("2006/01/02")
+			last = contact.Last.Format("2006/01/02")
+		}
+
+		var speakers []string
+		for _, speaker := range contact.Speakers {
+			speakers = append(speakers, fmt.Sprintf("%s %.0f%%", speaker.Speaker, 100*speaker.Share))
+		}
+
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\t%s\t%s\n",
+			strings.TrimSuffix(contact.FileName, ".txt"), contact.Messages, first, last,
+			FormatSize(uint64(contact.Size)), FormatSize(contact.ArchiveSize), strings.Join(speakers, ", "))
+	}
+	_ = tw.Flush()
+	fmt.Fprintf(w, "\n")
+
+	tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "MONTH\tMESSAGES\n")
+	for _, month := range s.Months {
+		fmt.Fprintf(tw, "%s\t%d\n", month.Month, month.Messages)
+	}
+	_ = tw.Flush()
+	fmt.Fprintf(w, "\n")
+}
@@ -0,0 +1,21 @@
+//go:build linux || darwin || solaris
+
+package main
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// lockFile takes exclusive lock of the file, it's released when the file is closed or the process exits.
+// Returns errSyncLocked if the file is locked by another process.
+func lockFile(f *os.File) error {
+	err := unix.FcntlFlock(f.Fd(), unix.F_SETLK, &unix.Flock_t{Type: unix.F_WRLCK})
+	if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EACCES) {
+		return errSyncLocked
+	}
+
+	return err
+}
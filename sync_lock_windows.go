@@ -0,0 +1,21 @@
+package main
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// lockFile takes exclusive lock of the file, it's released when the file is closed or the process exits.
+// Returns errSyncLocked if the file is locked by another process.
+func lockFile(f *os.File) error {
+	var overlapped windows.Overlapped
+
+	err := windows.LockFileEx(windows.Handle(f.Fd()), windows.LOCKFILE_EXCLUSIVE_LOCK|windows.LOCKFILE_FAIL_IMMEDIATELY, 0, 1, 0, &overlapped)
+	if errors.Is(err, windows.ERROR_LOCK_VIOLATION) {
+		return errSyncLocked
+	}
+
+	return err
+}
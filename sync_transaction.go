@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// syncJournalName is name of the journal inside of the sync transaction directory.
+const syncJournalName = "journal.json"
+
+// errSyncLocked is returned by lockFile if the lock is held by another process.
+var errSyncLocked = errors.New("locked by another process")
+
+// StateDirectory returns directory of the application's own files inside of the user's configuration directory.
+func StateDirectory() (string, error) {
+	directory, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("unable to retrieve user configuration directory: %w", err)
+	}
+
+	return filepath.Join(directory, "sl-chat-log-sync"), nil
+}
+
+// SyncJournal describes sync which is being committed.
+type SyncJournal struct {
+	Started time.Time `json:"started"`
+	// Archive is file name of the archive being committed.
+	Archive string `json:"archive"`
+	// ArchiveCommitted is true if the archive is already replaced, so chat logs of SecondLife clients must be written too.
+	ArchiveCommitted bool `json:"archive_committed"`
+	// Backup is file name of the backup of SecondLife clients' chat logs changed by the sync.
+	Backup string       `json:"backup,omitempty"`
+	Files  []StagedFile `json:"files"`
+}
+
+// StagedFile is chat log file of SecondLife client staged for writing.
+type StagedFile struct {
+	Client      SecondLifeClient `json:"client"`
+	AccountName string           `json:"account"`
+	FileName    string           `json:"file"`
+	// Path is absolute path of the chat log file.
+	Path string `json:"path"`
+	// Staged is name of the file with new content inside of the transaction directory.
+	Staged string `json:"staged"`
+	// Original is hash of the chat log file when it was staged, empty if there was no such file.
+	// The file is merged again on commit if it's changed by SecondLife client meanwhile.
+	Original string `json:"original,omitempty"`
+}
+
+// SyncLock is exclusive lock of sync transaction directory, held for the whole sync,
+// so syncs running at the same time, e.g. watch and sync run by hand, don't discard chat logs staged by each other.
+type SyncLock struct {
+	f *os.File
+}
+
+// LockSyncTransaction locks the transaction directory, it fails if another sync holds the lock.
+// Lock file is next to the directory, because the directory is removed after each sync.
+func LockSyncTransaction(directory string) (*SyncLock, error) {
+	err := os.MkdirAll(filepath.Dir(directory), 0700)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create directory %s: %w", filepath.Dir(directory), err)
+	}
+
+	f, err := os.OpenFile(directory+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open lock file: %w", err)
+	}
+
+	err = lockFile(f)
+	if errors.Is(err, errSyncLocked) {
+		_ = f.Close()
+		return nil, fmt.Errorf("another sync is running, try again later")
+	}
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("unable to lock %s: %w", f.Name(), err)
+	}
+
+	return &SyncLock{f: f}, nil
+}
+
+// Unlock releases the lock.
+func (l *SyncLock) Unlock() {
+	_ = l.f.Close()
+}
+
+// SyncTransaction stages chat logs of SecondLife clients, and commits them together with the archive.
+// Commit is recorded into the journal, so interrupted commit is resumed on next sync.
+type SyncTransaction struct {
+	directory string
+	backup    *ChatLogsBackup
+	journal   SyncJournal
+	// recovered is true if the transaction is interrupted sync read from the directory.
+	recovered bool
+}
+
+// NewSyncTransaction returns new sync transaction, staged files are stored in the directory.
+// Chat logs of SecondLife clients are saved into the backup before they're staged.
+func NewSyncTransaction(directory string, backup *ChatLogsBackup) *SyncTransaction {
+	return &SyncTransaction{
+		directory: directory,
+		backup:    backup,
+		journal:   SyncJournal{Started: time.Now()},
+	}
+}
+
+// RecoverSyncTransaction finishes sync interrupted while it was committed.
+// If the archive was already replaced, chat logs of SecondLife clients are written as well.
+// Otherwise, staged chat logs and their backup are discarded, and SecondLife clients are left untouched.
+// The transaction directory must be locked by LockSyncTransaction.
+func RecoverSyncTransaction(directory string) error {
+	data, err := os.ReadFile(filepath.Join(directory, syncJournalName))
+
+	// Sync was interrupted before commit, or there's nothing to recover.
+	if errors.Is(err, os.ErrNotExist) {
+		return os.RemoveAll(directory)
+	}
+
+	if err != nil {
+		return fmt.Errorf("unable to read journal of interrupted sync: %w", err)
+	}
+
+	t := &SyncTransaction{directory: directory, recovered: true}
+	err = json.Unmarshal(data, &t.journal)
+	if err != nil {
+		return fmt.Errorf("unable to parse journal of interrupted sync %s: %w", filepath.Join(directory, syncJournalName), err)
+	}
+
+	if !t.journal.ArchiveCommitted {
+		fmt.Printf("Sync started at %s was interrupted before %s was written, discarding it\n", t.journal.Started.Format(time.DateTime), t.journal.Archive)
+
+		// Chat logs saved into the backup were not changed.
+		if t.journal.Backup != "" {
+			err = os.Remove(t.journal.Backup)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("unable to remove backup %s of interrupted sync: %w", t.journal.Backup, err)
+			}
+		}
+
+		return t.Discard()
+	}
+
+	fmt.Printf("Sync started at %s was interrupted, resuming it\n", t.journal.Started.Format(time.DateTime))
+
+	return t.apply()
+}
+
+// HasInterruptedSync returns true if there's interrupted sync in the directory, which is not recovered yet.
+func HasInterruptedSync(directory string) bool {
+	_, err := os.Stat(filepath.Join(directory, syncJournalName))
+	return err == nil
+}
+
+// Stage saves chat log file into the backup and stores its new content in the transaction directory.
+func (t *SyncTransaction) Stage(client SecondLifeClient, accountName string, fileName string, path string, data []byte) error {
+	err := t.backup.Save(client, accountName, fileName, path)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(t.directory, 0700)
+	if err != nil {
+		return fmt.Errorf("unable to create directory %s: %w", t.directory, err)
+	}
+
+	original, err := fileDigest(path)
+	if err != nil {
+		return err
+	}
+
+	file := StagedFile{
+		Client:      client,
+		AccountName: accountName,
+		FileName:    fileName,
+		Path:        path,
+		Staged:      fmt.Sprintf("%d.txt", len(t.journal.Files)),
+		Original:    original,
+	}
+
+	err = os.WriteFile(filepath.Join(t.directory, file.Staged), data, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to stage chat log %s/%s: %w", accountName, fileName, err)
+	}
+
+	t.journal.Files = append(t.journal.Files, file)
+
+	return nil
+}
+
+// Commit replaces the archive and writes staged chat logs into SecondLife clients.
+// If the archive can't be replaced, SecondLife clients are left untouched, and the backup is removed.
+func (t *SyncTransaction) Commit(archive ArchiveStorage) error {
+	if len(t.journal.Files) == 0 {
+		t.backup.Abort()
+		return archive.Close()
+	}
+
+	t.journal.Archive = archive.String()
+	t.journal.Backup = t.backup.fileName
+
+	err := t.writeJournal()
+	if err != nil {
+		archive.Abort()
+		_ = t.Discard()
+		return err
+	}
+
+	err = archive.Close()
+	if err != nil {
+		_ = t.Discard()
+		return err
+	}
+
+	// Backup is completed only when chat logs of SecondLife clients are going to be changed.
+	// If it fails, they're not changed, and chat logs of the archive are merged into them on next sync.
+	err = t.backup.Close()
+	if err != nil {
+		_ = t.Discard()
+		return err
+	}
+
+	// Backup is renamed from its temp name when it's completed.
+	t.journal.Backup = t.backup.fileName
+	t.journal.ArchiveCommitted = true
+
+	err = t.writeJournal()
+	if err != nil {
+		return err
+	}
+
+	return t.apply()
+}
+
+// CommitClients writes staged chat logs into SecondLife clients, when there's no archive to commit together with them.
+func (t *SyncTransaction) CommitClients() error {
+	err := t.backup.Close()
+	if err != nil {
+		_ = t.Discard()
+		return err
+	}
+
+	if len(t.journal.Files) == 0 {
+		return nil
+	}
+
+	t.journal.Backup = t.backup.fileName
+	t.journal.ArchiveCommitted = true
+
+	err = t.writeJournal()
+	if err != nil {
+		_ = t.Discard()
+		return err
+	}
+
+	return t.apply()
+}
+
+// Discard removes staged chat logs and the journal.
+// Backup is removed too, if it's not completed yet, because chat logs of SecondLife clients are not changed.
+func (t *SyncTransaction) Discard() error {
+	if t.backup != nil {
+		t.backup.Abort()
+	}
+
+	// Nothing is staged, the directory may hold interrupted sync which is not recovered yet.
+	if len(t.journal.Files) == 0 && !t.recovered {
+		return nil
+	}
+
+	err := os.RemoveAll(t.directory)
+	if err != nil {
+		return fmt.Errorf("unable to remove directory %s: %w", t.directory, err)
+	}
+
+	return nil
+}
+
+// apply writes staged chat logs into SecondLife clients and removes the transaction directory.
+// Chat log changed since it was staged, e.g. SecondLife client wrote new messages into it meanwhile,
+// is merged with the staged one, so its messages are not lost. It can be repeated if interrupted.
+func (t *SyncTransaction) apply() error {
+	for _, file := range t.journal.Files {
+		err := os.MkdirAll(filepath.Dir(file.Path), 0755)
+		if err != nil {
+			return fmt.Errorf("unable to create directory %s: %w", filepath.Dir(file.Path), err)
+		}
+
+		current, err := fileDigest(file.Path)
+		if err != nil {
+			return err
+		}
+
+		if current != file.Original {
+			err = t.mergeStaged(file)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = CopyFile(filepath.Join(t.directory, file.Staged), file.Path)
+		if err != nil {
+			return fmt.Errorf("error writing chat log %s/%s into %s: %w", file.AccountName, file.FileName, file.Path, err)
+		}
+	}
+
+	fmt.Printf("%d chat logs of SecondLife clients updated\n", len(t.journal.Files))
+
+	return t.Discard()
+}
+
+// mergeStaged merges staged chat log with the current content of the chat log file.
+func (t *SyncTransaction) mergeStaged(file StagedFile) error {
+	stagedFileName := filepath.Join(t.directory, file.Staged)
+
+	staged, err := os.ReadFile(stagedFileName)
+	if err != nil {
+		return fmt.Errorf("unable to read staged chat log %s/%s: %w", file.AccountName, file.FileName, err)
+	}
+
+	current, err := os.ReadFile(file.Path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("unable to read %s: %w", file.Path, err)
+	}
+
+	stagedMessages, err := ReadMessages(bytes.NewReader(staged))
+	if err != nil {
+		return fmt.Errorf("unable to read staged chat log %s/%s: %w", file.AccountName, file.FileName, err)
+	}
+
+	currentMessages, err := ReadMessages(bytes.NewReader(current))
+	if err != nil {
+		return fmt.Errorf("unable to read %s: %w", file.Path, err)
+	}
+
+	var buf bytes.Buffer
+	err = Merge(currentMessages, stagedMessages).Write(&buf)
+	if err != nil {
+		return fmt.Errorf("error writing chat log %s/%s: %w", file.AccountName, file.FileName, err)
+	}
+
+	err = os.WriteFile(stagedFileName, buf.Bytes(), 0600)
+	if err != nil {
+		return fmt.Errorf("unable to stage chat log %s/%s: %w", file.AccountName, file.FileName, err)
+	}
+
+	return nil
+}
+
+// fileDigest returns hash of the file content, empty if there's no such file.
+func fileDigest(fileName string) (string, error) {
+	data, err := os.ReadFile(fileName)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("unable to read %s: %w", fileName, err)
+	}
+
+	hash := sha256.Sum256(data)
+
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// writeJournal writes the journal into the transaction directory.
+// Journal is written into temp file first, so it's never seen partially written.
+func (t *SyncTransaction) writeJournal() error {
+	data, err := json.MarshalIndent(t.journal, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to encode sync journal: %w", err)
+	}
+
+	err = os.MkdirAll(t.directory, 0700)
+	if err != nil {
+		return fmt.Errorf("unable to create directory %s: %w", t.directory, err)
+	}
+
+	journalFileName := filepath.Join(t.directory, syncJournalName)
+
+	f, err := os.Create(journalFileName + ".tmp")
+	if err != nil {
+		return fmt.Errorf("unable to create sync journal: %w", err)
+	}
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return fmt.Errorf("unable to write sync journal: %w", err)
+	}
+
+	err = os.Rename(f.Name(), journalFileName)
+	if err != nil {
+		return fmt.Errorf("unable to write sync journal: %w", err)
+	}
+
+	return nil
+}
+
+// StagedClient is SecondLife client which chat logs are staged by the sync transaction instead of being written at once.
+// Chat log files which content is not changed are not staged.
+type StagedClient struct {
+	SecondLifeClient
+	transaction *SyncTransaction
+}
+
+// WriteChatLog stages new content of the chat log file.
+func (c StagedClient) WriteChatLog(accountName string, fileName string, messages Messages) error {
+	path, err := c.ChatLogFilePath(accountName, fileName)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	err = messages.Write(&buf)
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(path)
+	if err == nil && bytes.Equal(data, buf.Bytes()) {
+		return nil
+	}
+
+	return c.transaction.Stage(c.SecondLifeClient, accountName, fileName, path, buf.Bytes())
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// failingArchive is archive storage which can't be written.
+type failingArchive struct {
+	memoryStorage
+}
+
+func (a failingArchive) LockedAccounts() []string {
+	return nil
+}
+
+func (a failingArchive) ReadContacts(accountName string) ([]Contact, error) {
+	return nil, nil
+}
+
+func (a failingArchive) WriteContacts(accountName string, contacts []Contact) error {
+	return nil
+}
+
+func (a failingArchive) Close() error {
+	return errors.New("archive is not writable")
+}
+
+func (a failingArchive) Abort() {
+}
+
+func (a failingArchive) String() string {
+	return "failing archive"
+}
+
+func TestSyncTransactionMergesChatLogChangedAfterStaging(t *testing.T) {
+	directory := t.TempDir()
+	path := filepath.Join(directory, "client", "alice", "bob.txt")
+
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(path, []byte("[2023/06/30 12:00]  Bob: first\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transaction := NewSyncTransaction(filepath.Join(directory, "pending"), NewChatLogsBackup(BackupOptions{}))
+
+	err = transaction.Stage("SecondLife", "alice", "bob.txt", path, []byte("[2023/06/30 12:00]  Bob: first\n[2023/06/30 12:01]  Bob: from archive\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// SecondLife client writes new message before the transaction is committed.
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteString("[2023/06/30 12:02]  Bob: from viewer\n")
+	_ = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = transaction.CommitClients()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "[2023/06/30 12:00]  Bob: first\n[2023/06/30 12:01]  Bob: from archive\n[2023/06/30 12:02]  Bob: from viewer\n"
+	if string(data) != expected {
+		t.Errorf("chat log is %q, %q expected", data, expected)
+	}
+}
+
+func TestSyncTransactionRemovesBackupIfArchiveFails(t *testing.T) {
+	directory := t.TempDir()
+	backupDirectory := filepath.Join(directory, "backups")
+	path := filepath.Join(directory, "client", "alice", "bob.txt")
+
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	original := []byte("[2023/06/30 12:00]  Bob: first\n")
+
+	err = os.WriteFile(path, original, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transaction := NewSyncTransaction(filepath.Join(directory, "pending"), NewChatLogsBackup(BackupOptions{Directory: backupDirectory, Keep: 10}))
+
+	err = transaction.Stage("SecondLife", "alice", "bob.txt", path, []byte("[2023/06/30 12:00]  Bob: first\n[2023/06/30 12:01]  Bob: second\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = transaction.Commit(failingArchive{})
+	if err == nil {
+		t.Fatal("commit succeeded without the archive")
+	}
+
+	backups, err := ListBackups(backupDirectory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 0 {
+		t.Errorf("backup of the failed sync is kept: %v", backups)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != string(original) {
+		t.Errorf("chat log is changed by the failed sync: %q", data)
+	}
+}
+
+func TestRecoverSyncTransactionRemovesIncompleteBackup(t *testing.T) {
+	directory := t.TempDir()
+	backupDirectory := filepath.Join(directory, "backups")
+	path := filepath.Join(directory, "client", "alice", "bob.txt")
+
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(path, []byte("[2023/06/30 12:00]  Bob: first\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transaction := NewSyncTransaction(filepath.Join(directory, "pending"), NewChatLogsBackup(BackupOptions{Directory: backupDirectory, Keep: 10}))
+
+	err = transaction.Stage("SecondLife", "alice", "bob.txt", path, []byte("[2023/06/30 12:00]  Bob: first\n[2023/06/30 12:01]  Bob: second\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Sync is interrupted while the archive is written, backup is not completed.
+	transaction.journal.Archive = "archive"
+	transaction.journal.Backup = transaction.backup.fileName
+	err = transaction.writeJournal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = transaction.backup.f.Close()
+
+	backups, err := ListBackups(backupDirectory)
+	if err != nil || len(backups) != 0 {
+		t.Errorf("incomplete backup is listed: %v (%v)", backups, err)
+	}
+
+	err = RecoverSyncTransaction(filepath.Join(directory, "pending"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(backupDirectory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		t.Errorf("%s is left in backups directory", entry.Name())
+	}
+}
+
+func TestPruneBackupsRemovesOldTempFiles(t *testing.T) {
+	directory := t.TempDir()
+
+	for _, name := range []string{"20230630-120000.000-1" + backupTempSuffix, "20230630-120000.000-2" + backupTempSuffix} {
+		err := os.WriteFile(filepath.Join(directory, name), nil, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Backup of another run may still be written.
+	past := time.Now().Add(-backupTempMaxAge - time.Hour)
+	err := os.Chtimes(filepath.Join(directory, "20230630-120000.000-1"+backupTempSuffix), past, past)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = PruneBackups(BackupOptions{Directory: directory, Keep: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(directory, "20230630-120000.000-1"+backupTempSuffix)); !os.IsNotExist(err) {
+		t.Errorf("old temp file is kept: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(directory, "20230630-120000.000-2"+backupTempSuffix)); err != nil {
+		t.Errorf("temp file being written is removed: %v", err)
+	}
+}
+
+func TestChatLogsBackupIsRenamedOnClose(t *testing.T) {
+	directory := t.TempDir()
+	path := filepath.Join(directory, "bob.txt")
+
+	err := os.WriteFile(path, []byte("[2023/06/30 12:00]  Bob: first\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backup := NewChatLogsBackup(BackupOptions{Directory: filepath.Join(directory, "backups"), Keep: 10})
+
+	err = backup.Save("SecondLife", "alice", "bob.txt", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasSuffix(backup.fileName, backupTempSuffix) {
+		t.Errorf("backup is written as %s", backup.fileName)
+	}
+
+	err = backup.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backups, err := ListBackups(filepath.Join(directory, "backups"))
+	if err != nil || len(backups) != 1 || backups[0].FileName != backup.fileName {
+		t.Fatalf("backups are %v (%v)", backups, err)
+	}
+
+	entries, err := os.ReadDir(filepath.Join(directory, "backups"))
+	if err != nil || len(entries) != 1 {
+		t.Errorf("backups directory has %d files (%v)", len(entries), err)
+	}
+}
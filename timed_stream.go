@@ -6,7 +6,7 @@ type TimedMessagesStream struct {
 }
 
 func (t *TimedMessagesStream) NextMessages() Messages {
-	var messages []string
+	var messages Messages
 	var timestamp int64 = -1
 
 	for _, source := range t.sources {
@@ -26,8 +26,12 @@ func (t *TimedMessagesStream) NextMessages() Messages {
 			}
 
 			if source[0].Timestamp == timestamp {
-				if !Contains(messages, source[0].Message) {
-					messages = append(messages, source[0].Message)
+				if !messages.Contains(*source[0]) {
+					messages = append(messages, &Message{
+						Timestamp:    timestamp,
+						Message:      source[0].Message,
+						Conversation: source[0].Conversation,
+					})
 				}
 				source = source[1:]
 				continue
@@ -39,15 +43,7 @@ func (t *TimedMessagesStream) NextMessages() Messages {
 		t.sources[i] = source
 	}
 
-	result := make(Messages, len(messages))
-	for i, message := range messages {
-		result[i] = &Message{
-			Timestamp: timestamp,
-			Message:   message,
-		}
-	}
-
 	t.lastTimestamp = timestamp
 
-	return result
+	return messages
 }
@@ -70,6 +70,38 @@ func Contains(items []string, item string) bool {
 	return false
 }
 
+// FormatSize returns human-readable size in bytes.
+func FormatSize(size uint64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	div, exp := uint64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+// Subtract returns items which are not in the excluded slice, preserving items order.
+func Subtract[K comparable](items []K, excluded []K) (result []K) {
+	m := make(map[K]interface{})
+	for _, item := range excluded {
+		m[item] = nil
+	}
+
+	for _, item := range items {
+		if _, ok := m[item]; !ok {
+			result = append(result, item)
+		}
+	}
+
+	return
+}
+
 // MoveFile moves file from sourcePath to destPath.
 // Took from https://stackoverflow.com/a/50741908
 func MoveFile(sourcePath, destPath string) error {
@@ -95,3 +127,35 @@ func MoveFile(sourcePath, destPath string) error {
 	}
 	return nil
 }
+
+// CopyFile copies file from sourcePath to destPath, overwriting it.
+func CopyFile(sourcePath, destPath string) error {
+	inputFile, err := os.Open(sourcePath)
+	if err != nil {
+		return fmt.Errorf("couldn't open source file: %s", err)
+	}
+	defer inputFile.Close()
+
+	outputFile, err := os.Create(destPath)
+	if err != nil {
+		return fmt.Errorf("couldn't open dest file: %s", err)
+	}
+
+	_, err = io.Copy(outputFile, inputFile)
+	if err != nil {
+		outputFile.Close()
+		return fmt.Errorf("writing to output file failed: %s", err)
+	}
+
+	return outputFile.Close()
+}
+
+// DeviceName returns host name of the device, "unknown" if it's not available.
+func DeviceName() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		return "unknown"
+	}
+
+	return host
+}
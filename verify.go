@@ -0,0 +1,248 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// VerifyProblem is problem found by verify command.
+type VerifyProblem struct {
+	// Kind is one of: corrupt, missing, unlisted, shrunk, backwards, behind, ahead.
+	Kind        string
+	AccountName string
+	FileName    string
+	Details     string
+}
+
+// Serious returns true if the problem means chat logs are lost or damaged.
+// SecondLife clients being behind or ahead of the archive are fixed by sync.
+func (p VerifyProblem) Serious() bool {
+	return p.Kind != "behind" && p.Kind != "ahead" && p.Kind != "unlisted"
+}
+
+// VerifyAccount checks chat logs of the account against the account manifest and the previous version of the archive.
+// Previous version may be nil.
+func VerifyAccount(archive *ChatLogsArchive, previous *ChatLogsArchive, accountName string) ([]VerifyProblem, int, error) {
+	var problems []VerifyProblem
+	add := func(kind string, fileName string, format string, args ...interface{}) {
+		problems = append(problems, VerifyProblem{Kind: kind, AccountName: accountName, FileName: fileName, Details: fmt.Sprintf(format, args...)})
+	}
+
+	actual, damaged, err := archive.BuildAccountManifest(accountName)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	for fileName, err := range damaged {
+		add("corrupt", fileName, "%s", err)
+	}
+
+	stored, err := archive.ReadAccountManifest(accountName)
+	if err != nil {
+		add("corrupt", manifestMetadataName, "%s", err)
+	}
+
+	if stored != nil {
+		for fileName, entry := range stored.Files {
+			current, ok := actual.Files[fileName]
+			switch {
+			case damaged[fileName] != nil:
+			case !ok:
+				add("missing", fileName, "listed in the manifest, but not found")
+			case current.SHA256 != entry.SHA256:
+				add("corrupt", fileName, "content doesn't match the manifest: %d messages, %d expected", current.Messages, entry.Messages)
+			}
+		}
+
+		for fileName := range actual.Files {
+			if _, ok := stored.Files[fileName]; !ok {
+				add("unlisted", fileName, "not listed in the manifest")
+			}
+		}
+	}
+
+	if previous != nil {
+		before, _, err := previous.BuildAccountManifest(accountName)
+		if err == nil {
+			for fileName, entry := range before.Files {
+				current, ok := actual.Files[fileName]
+				switch {
+				case damaged[fileName] != nil:
+				case !ok:
+					add("missing", fileName, "found in the previous version %s", previous.fileName)
+				case current.Messages < entry.Messages:
+					add("shrunk", fileName, "%d messages, %d in the previous version", current.Messages, entry.Messages)
+				case current.Last < entry.Last:
+					add("backwards", fileName, "the last message is sent at %s, at %s in the previous version",
+						formatTimestamp(current.Last), formatTimestamp(entry.Last))
+				}
+			}
+		}
+	}
+
+	return problems, len(actual.Files) + len(damaged), nil
+}
+
+// VerifyClients compares chat logs of SecondLife clients with the archived ones.
+func VerifyClients(clients []SecondLifeClient, archive *ChatLogsArchive, accountName string) ([]VerifyProblem, error) {
+	var problems []VerifyProblem
+
+	for _, client := range clients {
+		_, fileNames, err := client.ListChatLogFileNames(accountName)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, fileName := range fileNames {
+			messages, err := client.ReadChatLog(accountName, fileName)
+			if err != nil {
+				problems = append(problems, VerifyProblem{Kind: "corrupt", AccountName: accountName, FileName: fileName,
+					Details: fmt.Sprintf("%s: %s", client, err)})
+				continue
+			}
+
+			archived, err := archive.ReadChatLog(accountName, fileName)
+			if err != nil {
+				// Damaged chat logs of the archive are reported by VerifyAccount.
+				continue
+			}
+
+			merged := Merge(archived, messages)
+			if missing := len(merged) - len(messages); missing > 0 {
+				problems = append(problems, VerifyProblem{Kind: "behind", AccountName: accountName, FileName: fileName,
+					Details: fmt.Sprintf("%s misses %d messages of the archive", client, missing)})
+			}
+			if added := len(merged) - len(archived); added > 0 {
+				problems = append(problems, VerifyProblem{Kind: "ahead", AccountName: accountName, FileName: fileName,
+					Details: fmt.Sprintf("%s has %d messages which are not archived yet", client, added)})
+			}
+		}
+	}
+
+	return problems, nil
+}
+
+// WriteVerifyProblems writes problems sorted by account and file name.
+func WriteVerifyProblems(w io.Writer, problems []VerifyProblem) {
+	sort.SliceStable(problems, func(i, j int) bool {
+		if problems[i].AccountName != problems[j].AccountName {
+			return problems[i].AccountName < problems[j].AccountName
+		}
+		return problems[i].FileName < problems[j].FileName
+	})
+
+	for _, p := range problems {
+		fmt.Fprintf(w, "%-9s %s/%s: %s\n", p.Kind, p.AccountName, p.FileName, p.Details)
+	}
+}
+
+func formatTimestamp(timestamp int64) string {
+	if timestamp == 0 {
+		return "unknown time"
+	}
+
+	return time.Unix(timestamp, 0).UTC().Format("2006/01/02 15:04")
+}
+
+// runVerify checks the archive against its manifest and the previous version, and optionally chat logs of SecondLife clients.
+func runVerify(args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	accountName := flags.String("account", "", "verify only this account")
+	clients := flags.Bool("clients", false, "compare chat logs of SecondLife clients with the archive too")
+	_ = flags.Parse(args)
+
+	options := archiveOptions()
+
+	archive, err := OpenChatLogsArchive(*ArchiveFileName, options)
+	if err != nil {
+		return fmt.Errorf("unable to open %s: %w", *ArchiveFileName, err)
+	}
+	defer archive.Close()
+
+	manifest, err := archive.ReadManifest()
+	if err != nil {
+		return err
+	}
+
+	if manifest == nil {
+		fmt.Printf("%s has no manifest, it's written on next sync\n", *ArchiveFileName)
+	} else {
+		fmt.Printf("%s: format version %d, synced at %s by %s\n", *ArchiveFileName, manifest.FormatVersion,
+			manifest.SyncedAt.Local().Format(time.DateTime), manifest.SyncedBy)
+	}
+
+	var previous *ChatLogsArchive
+	if snapshots, err := ListSnapshots(*ArchiveFileName); err == nil && len(snapshots) != 0 {
+		previous, err = OpenChatLogsArchive(snapshots[0].FileName, options)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s error, skipping it: %s\n", snapshots[0].FileName, err)
+			previous = nil
+		} else {
+			defer previous.Close()
+		}
+	}
+
+	accountNames, err := archive.GetAccountNames()
+	if err != nil {
+		return err
+	}
+
+	if *accountName != "" {
+		if !Contains(accountNames, *accountName) {
+			return fmt.Errorf("account %s not found", *accountName)
+		}
+		accountNames = []string{*accountName}
+	}
+
+	sort.Strings(accountNames)
+
+	for _, lockedAccountName := range archive.LockedAccounts() {
+		fmt.Printf("%s is encrypted with its own key, which is not available, skipping it\n", lockedAccountName)
+	}
+
+	var detected []SecondLifeClient
+	if *clients {
+		detected = DetectSecondLifeClients()
+	}
+
+	var problems []VerifyProblem
+	var verified int
+
+	for _, account := range accountNames {
+		accountProblems, n, err := VerifyAccount(archive, previous, account)
+		if err != nil {
+			return err
+		}
+
+		problems = append(problems, accountProblems...)
+		verified += n
+
+		clientProblems, err := VerifyClients(detected, archive, account)
+		if err != nil {
+			return err
+		}
+
+		problems = append(problems, clientProblems...)
+	}
+
+	WriteVerifyProblems(os.Stdout, problems)
+
+	var serious int
+	for _, p := range problems {
+		if p.Serious() {
+			serious++
+		}
+	}
+
+	fmt.Printf("%d chat logs verified, %d problems found\n", verified, serious)
+
+	if serious != 0 {
+		return fmt.Errorf("%s has %d problems", *ArchiveFileName, serious)
+	}
+
+	return nil
+}
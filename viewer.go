@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Modes of sync while SecondLife viewer is running, see -viewer-running flag.
+const (
+	// ViewerRunningRefuse makes sync fail.
+	ViewerRunningRefuse = "refuse"
+	// ViewerRunningDefer makes sync wait until the viewer exits.
+	ViewerRunningDefer = "defer"
+	// ViewerRunningArchiveOnly makes sync write the archive only, as with -archive-only.
+	ViewerRunningArchiveOnly = "archive-only"
+)
+
+// viewerPollInterval is how often running viewers are checked while sync waits for them to exit.
+const viewerPollInterval = 5 * time.Second
+
+// ErrViewerRunning is returned by sync if SecondLife viewer is running, and -viewer-running is refuse.
+var ErrViewerRunning = errors.New("SecondLife viewer is running")
+
+// viewerNames are prefixes of executable names of SecondLife viewers, lowercase and without spaces.
+// Linux viewers are started by wrapper script, the binary is named like "do-not-directly-run-secondlife-bin".
+var viewerNames = []string{"secondlife", "kokua", "firestorm"}
+
+// isViewerProcess returns true if executable name or path of the process is one of SecondLife viewers.
+func isViewerProcess(name string) bool {
+	name = strings.ToLower(filepath.Base(strings.ReplaceAll(name, `\`, "/")))
+	name = strings.TrimSuffix(name, ".exe")
+	name = strings.TrimPrefix(name, "do-not-directly-run-")
+	name = strings.ReplaceAll(name, " ", "")
+
+	for _, viewerName := range viewerNames {
+		if strings.HasPrefix(name, viewerName) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// RunningViewers returns names of SecondLife viewer processes running on this machine.
+func RunningViewers() ([]string, error) {
+	names, err := runningProcessNames()
+	if err != nil {
+		return nil, fmt.Errorf("unable to list running processes: %w", err)
+	}
+
+	var viewers []string
+	for _, name := range names {
+		if isViewerProcess(name) {
+			viewers = append(viewers, filepath.Base(name))
+		}
+	}
+
+	return Unique(viewers), nil
+}
+
+// checkViewerRunningMode returns error if -viewer-running is not one of supported modes.
+func checkViewerRunningMode() error {
+	switch *ViewerRunning {
+	case ViewerRunningRefuse, ViewerRunningDefer, ViewerRunningArchiveOnly:
+		return nil
+	}
+
+	return fmt.Errorf("unsupported -viewer-running %s, refuse, defer or archive-only expected", *ViewerRunning)
+}
+
+// checkViewersExited returns ErrViewerRunning if SecondLife viewer is running.
+// Viewer is considered running if it can't be detected, so its chat logs are never written by mistake.
+func checkViewersExited() error {
+	viewers, err := RunningViewers()
+	if err != nil {
+		return fmt.Errorf("%w, or it can't be checked: %s", ErrViewerRunning, err)
+	}
+
+	if len(viewers) != 0 {
+		return fmt.Errorf("%w: %s", ErrViewerRunning, strings.Join(viewers, ", "))
+	}
+
+	return nil
+}
+
+// awaitViewersExited is checkViewersExited, which waits for viewers to exit if -viewer-running is defer.
+// It's used before chat logs of SecondLife clients are written.
+func awaitViewersExited() error {
+	err := checkViewerRunningMode()
+	if err != nil {
+		return err
+	}
+
+	err = checkViewersExited()
+	if err == nil || *ViewerRunning != ViewerRunningDefer {
+		return err
+	}
+
+	fmt.Printf("%s, waiting for it to exit...\n", err)
+
+	for {
+		time.Sleep(viewerPollInterval)
+
+		viewers, err := RunningViewers()
+		if err != nil {
+			return fmt.Errorf("%w, or it can't be checked: %s", ErrViewerRunning, err)
+		}
+
+		if len(viewers) == 0 {
+			return nil
+		}
+	}
+}
+
+// checkRunningViewers handles SecondLife viewers running while sync is about to write their chat logs,
+// the viewer keeps chat log files open and appends to them, so lines written by both would be interleaved or lost.
+// Returns true if chat logs of SecondLife clients must not be written.
+func checkRunningViewers() (archiveOnly bool, err error) {
+	if *ArchiveOnly {
+		return true, nil
+	}
+
+	err = awaitViewersExited()
+	if errors.Is(err, ErrViewerRunning) {
+		if *ViewerRunning == ViewerRunningArchiveOnly {
+			fmt.Printf("%s, only the archive is written\n", err)
+			return true, nil
+		}
+
+		return false, fmt.Errorf("%w; exit it first, or see -viewer-running", err)
+	}
+
+	return false, err
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"os/exec"
+	"strings"
+)
+
+// runningProcessNames returns executable paths of running processes, taken from ps.
+func runningProcessNames() ([]string, error) {
+	output, err := exec.Command("ps", "-A", "-o", "comm=").Output()
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, line := range strings.Split(string(output), "\n") {
+		if name := strings.TrimSpace(line); name != "" {
+			names = append(names, name)
+		}
+	}
+
+	return names, nil
+}
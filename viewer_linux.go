@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// runningProcessNames returns executable names of running processes, taken from /proc.
+// Command line is used instead of /proc/<pid>/comm, which is truncated to 15 characters.
+func runningProcessNames() ([]string, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.TrimLeft(entry.Name(), "0123456789") != "" {
+			continue
+		}
+
+		cmdline, err := os.ReadFile(filepath.Join("/proc", entry.Name(), "cmdline"))
+		// Process may exit meanwhile.
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		name, _, _ := bytes.Cut(cmdline, []byte{0})
+		if len(name) != 0 {
+			names = append(names, string(name))
+		}
+	}
+
+	return names, nil
+}
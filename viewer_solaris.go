@@ -0,0 +1,26 @@
+package main
+
+import (
+	"os/exec"
+	"strings"
+)
+
+// runningProcessNames returns executable names of running processes, taken from ps.
+func runningProcessNames() ([]string, error) {
+	output, err := exec.Command("ps", "-e", "-o", "comm").Output()
+	if err != nil {
+		return nil, err
+	}
+
+	lines := strings.Split(string(output), "\n")
+
+	var names []string
+	// The first line is header.
+	for _, line := range lines[1:] {
+		if name := strings.TrimSpace(line); name != "" {
+			names = append(names, name)
+		}
+	}
+
+	return names, nil
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ChangedChatLogs are file names of changed chat logs, by account.
+type ChangedChatLogs map[string]map[string]bool
+
+// Add adds the chat log.
+func (c ChangedChatLogs) Add(accountName string, fileName string) {
+	if c[accountName] == nil {
+		c[accountName] = make(map[string]bool)
+	}
+
+	c[accountName][fileName] = true
+}
+
+// FileNames returns sorted file names of changed chat logs of the account.
+func (c ChangedChatLogs) FileNames(accountName string) []string {
+	var fileNames []string
+	for fileName := range c[accountName] {
+		fileNames = append(fileNames, fileName)
+	}
+
+	sort.Strings(fileNames)
+
+	return fileNames
+}
+
+// Count returns count of changed chat logs.
+func (c ChangedChatLogs) Count() (count int) {
+	for _, fileNames := range c {
+		count += len(fileNames)
+	}
+
+	return
+}
+
+// fileStamp is size and modification time of the file, it's changed whenever the file is written.
+type fileStamp struct {
+	size    int64
+	modTime time.Time
+}
+
+// chatLogFile is chat log file of SecondLife client, with its stamp.
+type chatLogFile struct {
+	accountName string
+	fileName    string
+	stamp       fileStamp
+}
+
+func statFile(fileName string) (fileStamp, error) {
+	info, err := os.Stat(fileName)
+	if err != nil {
+		return fileStamp{}, err
+	}
+
+	return fileStamp{size: info.Size(), modTime: info.ModTime()}, nil
+}
+
+// stampChatLogs returns chat log files of all SecondLife clients, by path.
+func stampChatLogs(clients []SecondLifeClient) (map[string]chatLogFile, error) {
+	files := make(map[string]chatLogFile)
+
+	for _, clientApp := range clients {
+		accountNames, err := clientApp.GetAccountNames()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, accountName := range accountNames {
+			paths, fileNames, err := clientApp.ListChatLogFileNames(accountName)
+			if err != nil {
+				return nil, err
+			}
+
+			for i, path := range paths {
+				stamp, err := statFile(path)
+				// Chat log may be removed meanwhile.
+				if errors.Is(err, os.ErrNotExist) {
+					continue
+				}
+				if err != nil {
+					return nil, err
+				}
+
+				files[path] = chatLogFile{accountName: accountName, fileName: fileNames[i], stamp: stamp}
+			}
+		}
+	}
+
+	return files, nil
+}
+
+// stampArchive returns stamps of the archive files, by path.
+// Returns nil if the archive storage is not local, so its changes can't be noticed.
+func stampArchive(spec string) (map[string]fileStamp, error) {
+	kind, location := ParseArchiveSpec(spec)
+
+	var fileNames []string
+
+	switch kind {
+	case ArchiveKindZip:
+		copies, err := FindConflictCopies(location)
+		if err != nil {
+			return nil, err
+		}
+
+		fileNames = append(copies, location)
+	case ArchiveKindSharded, ArchiveKindGit:
+		err := filepath.WalkDir(location, func(path string, entry fs.DirEntry, err error) error {
+			if errors.Is(err, fs.ErrNotExist) && path == location {
+				return filepath.SkipDir
+			}
+			if err != nil {
+				return err
+			}
+
+			// Git repository changes on each commit, chat logs are files of its working tree.
+			if entry.IsDir() && path != location && strings.HasPrefix(entry.Name(), ".") && entry.Name() != ArchiveMetadataDirectory {
+				return filepath.SkipDir
+			}
+
+			if !entry.IsDir() {
+				fileNames = append(fileNames, path)
+			}
+
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, nil
+	}
+
+	stamps := make(map[string]fileStamp)
+	for _, fileName := range fileNames {
+		stamp, err := statFile(fileName)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		stamps[fileName] = stamp
+	}
+
+	return stamps, nil
+}
+
+func equalStamps(a map[string]fileStamp, b map[string]fileStamp) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for fileName, stamp := range a {
+		other, ok := b[fileName]
+		if !ok || !other.modTime.Equal(stamp.modTime) || other.size != stamp.size {
+			return false
+		}
+	}
+
+	return true
+}
+
+// changedChatLogFiles adds chat logs which are new or changed since the previous stamps, returns false if there are none.
+func changedChatLogFiles(previous map[string]chatLogFile, current map[string]chatLogFile, changed ChangedChatLogs) bool {
+	found := false
+
+	for path, file := range current {
+		previousFile, ok := previous[path]
+		if ok && previousFile.stamp.modTime.Equal(file.stamp.modTime) && previousFile.stamp.size == file.stamp.size {
+			continue
+		}
+
+		changed.Add(file.accountName, file.fileName)
+		found = true
+	}
+
+	return found
+}
+
+// runWatch keeps running, and syncs chat logs whenever chat logs of SecondLife clients or the archive are changed.
+// Changes are debounced, SecondLife client writes chat log on each message.
+// Only changed chat logs are merged, unless the archive is changed by another device, or by its cloud sync client.
+func runWatch(args []string) error {
+	flags := flag.NewFlagSet("watch", flag.ExitOnError)
+	interval := flags.Duration("interval", 5*time.Second, "how often chat logs and the archive are checked for changes")
+	debounce := flags.Duration("debounce", 30*time.Second, "how long to wait after the last change before sync")
+	fullInterval := flags.Duration("full-interval", 15*time.Minute, "how often all chat logs are synced, e.g. to pick up changes of remote archive storage; 0 disables it")
+	_ = flags.Parse(args)
+
+	if *interval <= 0 || *debounce < 0 {
+		return fmt.Errorf("interval must be positive, and debounce must not be negative")
+	}
+
+	err := checkViewerRunningMode()
+	if err != nil {
+		return err
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+
+	fmt.Printf("Watching chat logs, press Ctrl+C to stop.\n")
+
+	var chatLogFiles map[string]chatLogFile
+	var lastChange, lastFullSync time.Time
+
+	archiveStamps, err := stampArchive(*ArchiveFileName)
+	if err != nil {
+		return err
+	}
+
+	changed := make(ChangedChatLogs)
+	full := true
+	viewerWasRunning := false
+
+	for {
+		if *fullInterval > 0 && time.Since(lastFullSync) >= *fullInterval {
+			full = true
+		}
+
+		// Viewer is considered running if it can't be detected.
+		var viewerErr error
+		if !*ArchiveOnly {
+			viewerErr = checkViewersExited()
+		}
+
+		viewerRunning := viewerErr != nil
+		if viewerRunning && !viewerWasRunning {
+			if *ViewerRunning == ViewerRunningArchiveOnly {
+				fmt.Printf("%s, only the archive is written until it exits\n", viewerErr)
+			} else {
+				fmt.Printf("%s, chat logs are synced after it exits\n", viewerErr)
+			}
+		}
+
+		// Chat logs are written back into SecondLife clients right after the viewer exits, without debounce.
+		if !viewerRunning && viewerWasRunning {
+			fmt.Printf("SecondLife viewer exited\n")
+			full = true
+			lastChange = time.Time{}
+		}
+		viewerWasRunning = viewerRunning
+
+		syncAllowed := !viewerRunning || *ViewerRunning == ViewerRunningArchiveOnly
+
+		if syncAllowed && (full || len(changed) != 0) && time.Since(lastChange) >= *debounce {
+			clients := DetectSecondLifeClients()
+
+			// Chat logs are stamped before the sync, so messages added while syncing are noticed.
+			beforeSync, err := stampChatLogs(clients)
+			if err != nil {
+				return err
+			}
+
+			if full {
+				fmt.Printf("\n%s: syncing all chat logs\n", time.Now().Format(time.DateTime))
+				err = syncChatLogs(nil, nil)
+			} else {
+				fmt.Printf("\n%s: syncing %d changed chat logs\n", time.Now().Format(time.DateTime), changed.Count())
+				err = syncChatLogs(nil, changed)
+			}
+
+			if err != nil {
+				// Sync is retried after the next debounce interval.
+				fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
+				lastChange = time.Now()
+			} else {
+				synced := changed
+				if full {
+					synced = nil
+					lastFullSync = time.Now()
+				}
+
+				// Chat logs written by the sync itself are not changes, except for chat logs which were not synced,
+				// or which were not written at all, because only the archive was written.
+				chatLogFiles, err = stampChatLogs(clients)
+				if err != nil {
+					return err
+				}
+
+				changed = make(ChangedChatLogs)
+				full = false
+
+				// Viewer may be started while syncing, then sync writes the archive only.
+				clientsWritten := !*ArchiveOnly && !viewerRunning && checkViewersExited() == nil
+
+				for path, file := range chatLogFiles {
+					if clientsWritten && (synced == nil || synced[file.accountName][file.fileName]) {
+						continue
+					}
+
+					if previous, ok := beforeSync[path]; !ok || previous.stamp != file.stamp {
+						changed.Add(file.accountName, file.fileName)
+					}
+				}
+			}
+
+			archiveStamps, err = stampArchive(*ArchiveFileName)
+			if err != nil {
+				return err
+			}
+		}
+
+		select {
+		case <-interrupt:
+			return nil
+		case <-ticker.C:
+		}
+
+		currentChatLogFiles, err := stampChatLogs(DetectSecondLifeClients())
+		if err != nil {
+			return err
+		}
+
+		if chatLogFiles != nil && changedChatLogFiles(chatLogFiles, currentChatLogFiles, changed) {
+			lastChange = time.Now()
+		}
+		chatLogFiles = currentChatLogFiles
+
+		// Archive replaced by another device or its cloud sync client, e.g. with conflicted copy next to it.
+		currentArchiveStamps, err := stampArchive(*ArchiveFileName)
+		if err != nil {
+			return err
+		}
+
+		if !equalStamps(archiveStamps, currentArchiveStamps) {
+			fmt.Printf("%s is changed\n", *ArchiveFileName)
+			full = true
+			lastChange = time.Now()
+		}
+		archiveStamps = currentArchiveStamps
+	}
+}